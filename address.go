@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+)
+
+// recipient is one entry of a compose address field: the parsed address,
+// or the text as typed along with why it didn't parse
+type recipient struct {
+	raw  string
+	addr *mail.Address
+	err  error
+}
+
+// parseRecipients splits a comma-separated address field into entries
+// using RFC 5322 rules. An unquoted display name containing a comma, as in
+// Doe, Jane <jane@x>, is read as a single "Doe, Jane" name rather than as a
+// broken address followed by a second one.
+func parseRecipients(value string) []recipient {
+	parts := splitRecipientList(value)
+
+	var result []recipient
+	for i := 0; i < len(parts); i++ {
+		part := parts[i]
+		if i+1 < len(parts) && isBareName(part) && isUnquotedNameAddr(parts[i+1]) {
+			next := parts[i+1]
+			name := part + ", " + strings.TrimSpace(next[:strings.Index(next, "<")])
+			part = quoteDisplayName(name) + " " + next[strings.Index(next, "<"):]
+			i++
+		}
+
+		addr, err := addressParser.Parse(part)
+		if err != nil {
+			result = append(result, recipient{raw: part, err: fmt.Errorf("%q is not a valid address", part)})
+			continue
+		}
+		result = append(result, recipient{raw: part, addr: addr})
+	}
+	return result
+}
+
+// splitRecipientList splits at commas (or the semicolons some clients use)
+// outside quotes and angle brackets, dropping empty entries such as the one
+// after a trailing comma
+func splitRecipientList(value string) []string {
+	var parts []string
+	var current strings.Builder
+	inQuotes, inAngle, escaped := false, false, false
+
+	flush := func() {
+		if part := strings.TrimSpace(current.String()); part != "" {
+			parts = append(parts, part)
+		}
+		current.Reset()
+	}
+
+	for _, r := range value {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\' && inQuotes:
+			escaped = true
+		case r == '"':
+			inQuotes = !inQuotes
+		case r == '<' && !inQuotes:
+			inAngle = true
+		case r == '>' && !inQuotes:
+			inAngle = false
+		case (r == ',' || r == ';') && !inQuotes && !inAngle:
+			flush()
+			continue
+		}
+		current.WriteRune(r)
+	}
+	flush()
+	return parts
+}
+
+// lastRecipient splits an address field into the entries already typed
+// and the one still being typed, which is what completion works on
+func lastRecipient(value string) (done, current string) {
+	cut := 0
+	inQuotes, inAngle, escaped := false, false, false
+	for i, r := range value {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\' && inQuotes:
+			escaped = true
+		case r == '"':
+			inQuotes = !inQuotes
+		case r == '<' && !inQuotes:
+			inAngle = true
+		case r == '>' && !inQuotes:
+			inAngle = false
+		case (r == ',' || r == ';') && !inQuotes && !inAngle:
+			cut = i + 1
+		}
+	}
+	return value[:cut], strings.TrimSpace(value[cut:])
+}
+
+// isBareName reports text that can only be the first half of a display name
+func isBareName(s string) bool {
+	return !strings.ContainsAny(s, `@<>"`)
+}
+
+// isUnquotedNameAddr reports a "Name <addr>" entry without quotes
+func isUnquotedNameAddr(s string) bool {
+	i := strings.Index(s, "<")
+	return i > 0 && strings.HasSuffix(s, ">") && !strings.Contains(s, `"`)
+}
+
+func quoteDisplayName(name string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(name) + `"`
+}
+
+// formatRecipients rewrites an address field in canonical form, quoting
+// display names where needed. Entries that don't parse are kept as typed.
+func formatRecipients(value string) string {
+	recipients := parseRecipients(value)
+	formatted := make([]string, len(recipients))
+	for i, r := range recipients {
+		if r.err != nil {
+			formatted[i] = r.raw
+		} else {
+			formatted[i] = formatAddress(r.addr)
+		}
+	}
+	return strings.Join(formatted, ", ")
+}
+
+// recipientsError returns the first invalid entry of an address field
+func recipientsError(value string) error {
+	for _, r := range parseRecipients(value) {
+		if r.err != nil {
+			return r.err
+		}
+	}
+	return nil
+}
+
+var errNoRecipients = errors.New("add at least one recipient")
+
+// validateRecipients checks the To, Cc and Bcc fields before sending
+func validateRecipients(to, cc, bcc string) error {
+	fields := []struct{ name, value string }{{"To", to}, {"CC", cc}, {"BCC", bcc}}
+
+	count := 0
+	for _, f := range fields {
+		if err := recipientsError(f.value); err != nil {
+			return fmt.Errorf("%s: %w", f.name, err)
+		}
+		count += len(parseRecipients(f.value))
+	}
+	if count == 0 {
+		return errNoRecipients
+	}
+	return nil
+}
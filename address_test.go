@@ -0,0 +1,112 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitRecipientList(t *testing.T) {
+	tests := []struct {
+		name, value string
+		want        []string
+	}{
+		{"commas", "a@x, b@x,c@x", []string{"a@x", "b@x", "c@x"}},
+		{"semicolons", "a@x; b@x", []string{"a@x", "b@x"}},
+		{"trailing comma", "a@x, ", []string{"a@x"}},
+		{"empty entries", ",, a@x,,", []string{"a@x"}},
+		{"quoted comma", `"Doe, Jane" <jane@x>, b@x`, []string{`"Doe, Jane" <jane@x>`, "b@x"}},
+		{"quoted semicolon", `"a; b" <ab@x>`, []string{`"a; b" <ab@x>`}},
+		{"escaped quote", `"say \"hi, there\"" <hi@x>, b@x`, []string{`"say \"hi, there\"" <hi@x>`, "b@x"}},
+		{"comma in angle brackets", "Jane <jane,x@y>, b@x", []string{"Jane <jane,x@y>", "b@x"}},
+		{"empty", "  ", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := splitRecipientList(tt.value); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRecipients(t *testing.T) {
+	tests := []struct {
+		name, value string
+		want        []string // parsed addresses; "!" marks an invalid entry
+	}{
+		{"plain", "a@x.com, Bob <b@x.com>", []string{"a@x.com", "b@x.com"}},
+		{"unquoted name with comma", "Doe, Jane <jane@x.com>", []string{"jane@x.com"}},
+		{"unquoted name with comma then more", "Doe, Jane <jane@x.com>, b@x.com", []string{"jane@x.com", "b@x.com"}},
+		{"bare word before address isn't merged", "Doe, jane@x.com", []string{"!", "jane@x.com"}},
+		{"quoted name with comma", `"Doe, Jane" <jane@x.com>`, []string{"jane@x.com"}},
+		{"escaped quote in name", `"Jane \"JD\" Doe" <jane@x.com>`, []string{"jane@x.com"}},
+		{"trailing comma", "a@x.com,", []string{"a@x.com"}},
+		{"invalid entry", "a@x.com, not an address, b@x.com", []string{"a@x.com", "!", "b@x.com"}},
+		{"unclosed angle", "Jane <jane@x.com", []string{"!"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, r := range parseRecipients(tt.value) {
+				if r.err != nil {
+					got = append(got, "!")
+				} else {
+					got = append(got, r.addr.Address)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if got := parseRecipients("Doe, Jane <jane@x.com>"); got[0].addr.Name != "Doe, Jane" {
+		t.Errorf("merged name is %q, want %q", got[0].addr.Name, "Doe, Jane")
+	}
+}
+
+func TestLastRecipient(t *testing.T) {
+	tests := []struct {
+		value, done, current string
+	}{
+		{"", "", ""},
+		{"ja", "", "ja"},
+		{"a@x, ja", "a@x,", "ja"},
+		{"a@x; ja", "a@x;", "ja"},
+		{"a@x, ", "a@x,", ""},
+		{`"Doe, J`, "", `"Doe, J`},
+		{`"Doe, Jane" <jane@x>, b`, `"Doe, Jane" <jane@x>,`, "b"},
+		{`"a \"b, c\"" <d@x>, e`, `"a \"b, c\"" <d@x>,`, "e"},
+	}
+
+	for _, tt := range tests {
+		done, current := lastRecipient(tt.value)
+		if done != tt.done || current != tt.current {
+			t.Errorf("lastRecipient(%q) = %q, %q; want %q, %q", tt.value, done, current, tt.done, tt.current)
+		}
+	}
+}
+
+func TestFormatRecipientsRoundTrips(t *testing.T) {
+	tests := []struct {
+		value, want string
+	}{
+		{"a@x.com", "a@x.com"},
+		{"Bob <b@x.com>;c@x.com", "Bob <b@x.com>, c@x.com"},
+		{"Doe, Jane <jane@x.com>", `"Doe, Jane" <jane@x.com>`},
+		{`"Jane \"JD\" Doe" <jane@x.com>`, `"Jane \"JD\" Doe" <jane@x.com>`},
+		{"a@x.com, oops", "a@x.com, oops"},
+	}
+
+	for _, tt := range tests {
+		got := formatRecipients(tt.value)
+		if got != tt.want {
+			t.Errorf("formatRecipients(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+		if again := formatRecipients(got); again != got {
+			t.Errorf("formatting %q again gave %q", got, again)
+		}
+	}
+}
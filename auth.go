@@ -2,11 +2,12 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
+	"log"
 	"net/http"
 	"os"
-	"path/filepath"
 
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
@@ -16,19 +17,27 @@ import (
 
 const (
 	credentialsFile = "credentials.json"
-	tokenFileName   = ".gmail-tui-token.json"
 )
 
 // getGmailService initializes and returns an authenticated Gmail API service
-func getGmailService() (*gmail.Service, error) {
+func getGmailService(paths appPaths) (*gmail.Service, error) {
 	ctx := context.Background()
 
-	config, err := loadOAuthConfig()
+	credentialsPath, err := paths.credentialsPath()
+	if err != nil {
+		return nil, err
+	}
+	config, err := loadOAuthConfig(credentialsPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load OAuth config: %w", err)
 	}
 
-	client, err := getAuthenticatedClient(ctx, config)
+	tokenPath, err := paths.tokenPath()
+	if err != nil {
+		return nil, fmt.Errorf("failed to determine token path: %w", err)
+	}
+
+	client, err := getAuthenticatedClient(ctx, config, tokenPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get authenticated client: %w", err)
 	}
@@ -42,8 +51,8 @@ func getGmailService() (*gmail.Service, error) {
 }
 
 // loadOAuthConfig reads and parses the OAuth2 credentials file
-func loadOAuthConfig() (*oauth2.Config, error) {
-	data, err := os.ReadFile(credentialsFile)
+func loadOAuthConfig(path string) (*oauth2.Config, error) {
+	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("unable to read credentials file: %w", err)
 	}
@@ -57,110 +66,58 @@ func loadOAuthConfig() (*oauth2.Config, error) {
 }
 
 // getAuthenticatedClient returns an authenticated HTTP client
-func getAuthenticatedClient(ctx context.Context, config *oauth2.Config) (*http.Client, error) {
-	tokenPath, err := getTokenPath()
-	if err != nil {
-		return nil, fmt.Errorf("failed to determine token path: %w", err)
-	}
-
+func getAuthenticatedClient(ctx context.Context, config *oauth2.Config, tokenPath string) (*http.Client, error) {
 	token, err := loadToken(tokenPath)
-	if err != nil {
-		// Token doesn't exist or is invalid, perform OAuth flow
-		token, err = performOAuthFlow(ctx, config)
-		if err != nil {
-			return nil, fmt.Errorf("OAuth flow failed: %w", err)
-		}
-
-		if err := saveToken(tokenPath, token); err != nil {
-			return nil, fmt.Errorf("failed to save token: %w", err)
-		}
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return authorize(ctx, config, tokenPath)
+	case errors.Is(err, errNoPassphrase), errors.Is(err, errWrongPassphrase):
+		// Signing in again would overwrite a token that's only locked
+		return nil, err
+	case err != nil:
+		log.Printf("Saved token at %s can't be read (%v); authorizing again.", tokenPath, err)
+		return authorize(ctx, config, tokenPath)
 	}
 
 	// Create a TokenSource from the loaded token so we can attempt a refresh now.
-	ts := config.TokenSource(ctx, token)
+	ts := config.TokenSource(ctx, token.Token)
 
 	// Try to retrieve a valid token from the source (this will refresh if needed).
 	refreshedToken, err := ts.Token()
+	if err != nil && isOfflineError(err) {
+		// Google is unreachable; re-authorizing wouldn't help, so let the
+		// caller decide whether to continue offline.
+		return nil, fmt.Errorf("failed to refresh token: %w", err)
+	}
 	if err != nil {
 		// Refresh failed (invalid_grant, revoked refresh token, etc.).
-		// Fall back to interactive OAuth flow to obtain a new token.
-		token, err = performOAuthFlow(ctx, config)
-		if err != nil {
-			return nil, fmt.Errorf("OAuth flow failed after refresh error: %w", err)
-		}
-
-		if err := saveToken(tokenPath, token); err != nil {
-			return nil, fmt.Errorf("failed to save token: %w", err)
-		}
-
-		return config.Client(ctx, token), nil
+		log.Printf("Saved authorization was rejected (%v); authorizing again.", err)
+		return authorize(ctx, config, tokenPath)
 	}
 
-	// If the token has been refreshed, persist it.
-	if refreshedToken.AccessToken != token.AccessToken || refreshedToken.RefreshToken != token.RefreshToken || !refreshedToken.Expiry.Equal(token.Expiry) {
-		_ = saveToken(tokenPath, refreshedToken) // best-effort save; ignore error here
+	// Persist a refreshed token, and encrypt one saved in the clear if a
+	// passphrase has been set since.
+	changed := refreshedToken.AccessToken != token.AccessToken || refreshedToken.RefreshToken != token.RefreshToken || !refreshedToken.Expiry.Equal(token.Expiry)
+	if changed || (os.Getenv(passphraseEnv) != "" && !isSealed(tokenPath)) {
+		if err := saveToken(tokenPath, newStoredToken(refreshedToken, token.Scope)); err != nil {
+			log.Printf("Warning: could not save refreshed token: %v", err)
+		}
 	}
 
 	// Return an HTTP client that uses the token source (it will handle refreshes).
 	return oauth2.NewClient(ctx, ts), nil
 }
 
-// getTokenPath returns the full path to the token file
-func getTokenPath() (string, error) {
-	homeDir, err := os.UserHomeDir()
-	if err != nil {
-		return "", fmt.Errorf("failed to get home directory: %w", err)
-	}
-	return filepath.Join(homeDir, tokenFileName), nil
-}
-
-// loadToken reads and deserializes a token from disk
-func loadToken(path string) (*oauth2.Token, error) {
-	f, err := os.Open(path)
+// authorize signs in through the browser and saves the new token
+func authorize(ctx context.Context, config *oauth2.Config, tokenPath string) (*http.Client, error) {
+	token, err := performOAuthFlow(ctx, config)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("OAuth flow failed: %w", err)
 	}
-	defer f.Close()
 
-	token := &oauth2.Token{}
-	if err := json.NewDecoder(f).Decode(token); err != nil {
-		return nil, fmt.Errorf("failed to decode token: %w", err)
-	}
-
-	return token, nil
-}
-
-// saveToken serializes and saves a token to disk
-func saveToken(path string, token *oauth2.Token) error {
-	f, err := os.Create(path)
-	if err != nil {
-		return fmt.Errorf("failed to create token file: %w", err)
-	}
-	defer f.Close()
-
-	if err := json.NewEncoder(f).Encode(token); err != nil {
-		return fmt.Errorf("failed to encode token: %w", err)
-	}
-
-	return nil
-}
-
-// performOAuthFlow executes the OAuth2 authorization code flow
-func performOAuthFlow(ctx context.Context, config *oauth2.Config) (*oauth2.Token, error) {
-	// Request offline access and force consent so Google returns a refresh token.
-	authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline, oauth2.SetAuthURLParam("prompt", "consent"))
-	fmt.Printf("\nAuthorization required. Please visit:\n%s\n\n", authURL)
-	fmt.Print("Enter authorization code: ")
-
-	var code string
-	if _, err := fmt.Scanln(&code); err != nil {
-		return nil, fmt.Errorf("failed to read authorization code: %w", err)
-	}
-
-	token, err := config.Exchange(ctx, code)
-	if err != nil {
-		return nil, fmt.Errorf("failed to exchange authorization code: %w", err)
+	if err := saveToken(tokenPath, newStoredToken(token, "")); err != nil {
+		return nil, fmt.Errorf("failed to save token: %w", err)
 	}
 
-	return token, nil
+	return config.Client(ctx, token), nil
 }
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	revokeURL          = "https://oauth2.googleapis.com/revoke"
+	tokenInfoURL       = "https://oauth2.googleapis.com/tokeninfo"
+	authRequestTimeout = 10 * time.Second
+)
+
+const usage = "usage: gmail-tui [flags] [logout | auth status]"
+
+// runCommand runs the subcommand named by args instead of the UI
+func runCommand(args []string, paths appPaths) error {
+	switch strings.Join(args, " ") {
+	case "logout":
+		return logout(paths)
+	case "auth status":
+		return authStatus(paths)
+	case "help", "-h", "--help":
+		fmt.Println(usage)
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q; %s", strings.Join(args, " "), usage)
+	}
+}
+
+// logout revokes our access with Google and deletes the saved token
+func logout(paths appPaths) error {
+	path, err := paths.tokenPath()
+	if err != nil {
+		return fmt.Errorf("failed to determine token path: %w", err)
+	}
+	token, err := loadToken(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		fmt.Println("Not signed in.")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%w; to discard it without revoking access, delete %s", err, path)
+	}
+
+	// Revoking the refresh token ends the whole grant, access tokens included
+	revoke := token.RefreshToken
+	if revoke == "" {
+		revoke = token.AccessToken
+	}
+	if err := revokeToken(revoke); err != nil {
+		fmt.Printf("Warning: could not revoke access (%v).\nRemove gmail-tui at https://myaccount.google.com/permissions to revoke it yourself.\n", err)
+	}
+
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("failed to delete token: %w", err)
+	}
+	fmt.Printf("Signed out; deleted %s\n", path)
+	return nil
+}
+
+// revokeToken asks Google to revoke token. One that's already invalid
+// counts as revoked.
+func revokeToken(token string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), authRequestTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, revokeURL, strings.NewReader(url.Values{"token": {token}}.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	var body struct {
+		Error string `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+	if body.Error == "invalid_token" {
+		return nil
+	}
+	return fmt.Errorf("revoke failed: %s %s", resp.Status, body.Error)
+}
+
+// authStatus prints where the token is kept and what it allows
+func authStatus(paths appPaths) error {
+	path, err := paths.tokenPath()
+	if err != nil {
+		return fmt.Errorf("failed to determine token path: %w", err)
+	}
+	token, err := loadToken(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		fmt.Printf("Not signed in (no token at %s)\n", path)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	protection := "not encrypted; set " + passphraseEnv + " to encrypt it"
+	if isSealed(path) {
+		protection = "encrypted"
+	}
+	fmt.Printf("Token:         %s (%s)\n", path, protection)
+
+	if token.RefreshToken != "" {
+		fmt.Println("Refresh token: present")
+	} else {
+		fmt.Println("Refresh token: missing; you'll be asked to sign in when the access token expires")
+	}
+
+	switch {
+	case token.Expiry.IsZero():
+		fmt.Println("Access token:  no expiry recorded")
+	case token.Expiry.After(time.Now()):
+		fmt.Printf("Access token:  expires %s (in %s)\n", token.Expiry.Local().Format(time.DateTime), strings.TrimSuffix(time.Until(token.Expiry).Round(time.Minute).String(), "0s"))
+	default:
+		fmt.Printf("Access token:  expired %s; it's renewed on next start\n", token.Expiry.Local().Format(time.DateTime))
+	}
+
+	scope := token.Scope
+	if scope == "" && token.Valid() {
+		scope, err = tokenScopes(token.AccessToken)
+		if err != nil {
+			fmt.Printf("Scopes:        unknown (%v)\n", err)
+			return nil
+		}
+	}
+	if scope == "" {
+		fmt.Println("Scopes:        unknown until the next sign-in")
+		return nil
+	}
+	fmt.Printf("Scopes:        %s\n", strings.Join(strings.Fields(scope), "\n               "))
+	return nil
+}
+
+// tokenScopes asks Google which scopes an access token carries
+func tokenScopes(accessToken string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), authRequestTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, tokenInfoURL+"?"+url.Values{"access_token": {accessToken}}.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token info: %s", resp.Status)
+	}
+
+	var info struct {
+		Scope string `json:"scope"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return "", fmt.Errorf("failed to decode token info: %w", err)
+	}
+	return info.Scope, nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// MailBackend is the set of mailbox operations the TUI depends on. The Gmail
+// API is the production implementation; memBackend is an in-memory fake used
+// to drive the Update/View loop without a network.
+type MailBackend interface {
+	// ListMessages returns one page of message IDs matching query and all of labelIDs.
+	ListMessages(ctx context.Context, query string, labelIDs []string, pageToken string, maxResults int64) (*gmail.ListMessagesResponse, error)
+	// GetMessage fetches a single message in the given format ("full", "metadata", "minimal").
+	GetMessage(ctx context.Context, id, format string) (*gmail.Message, error)
+	SendMessage(ctx context.Context, msg *gmail.Message) (*gmail.Message, error)
+	ModifyMessage(ctx context.Context, id string, req *gmail.ModifyMessageRequest) (*gmail.Message, error)
+	TrashMessage(ctx context.Context, id string) (*gmail.Message, error)
+	UntrashMessage(ctx context.Context, id string) (*gmail.Message, error)
+	// BatchModify changes the labels of up to 1000 messages in one call
+	BatchModify(ctx context.Context, req *gmail.BatchModifyMessagesRequest) error
+	// BatchDelete permanently deletes up to 1000 messages, bypassing the trash
+	BatchDelete(ctx context.Context, ids []string) error
+	ListLabels(ctx context.Context) ([]*gmail.Label, error)
+	// CreateLabel adds a user label; a name like "Parent/Child" nests it
+	CreateLabel(ctx context.Context, label *gmail.Label) (*gmail.Label, error)
+	// PatchLabel changes only the fields that are set on label
+	PatchLabel(ctx context.Context, id string, label *gmail.Label) (*gmail.Label, error)
+	// DeleteLabel removes a user label from the mailbox and all its messages
+	DeleteLabel(ctx context.Context, id string) error
+	GetAttachment(ctx context.Context, msgID, attachmentID string) (*gmail.MessagePartBody, error)
+	// GetThread fetches a conversation with its messages oldest first
+	GetThread(ctx context.Context, id, format string) (*gmail.Thread, error)
+	// ModifyThread changes the labels of every message in a conversation
+	ModifyThread(ctx context.Context, id string, req *gmail.ModifyThreadRequest) (*gmail.Thread, error)
+	GetProfile(ctx context.Context) (*gmail.Profile, error)
+	// ListSendAs returns the addresses the user can send mail as
+	ListSendAs(ctx context.Context) ([]*gmail.SendAs, error)
+	// ListHistory returns one page of mailbox changes after startHistoryID
+	ListHistory(ctx context.Context, startHistoryID uint64, pageToken string) (*gmail.ListHistoryResponse, error)
+	// ListDrafts returns the user's drafts; each carries only its ID and message ID
+	ListDrafts(ctx context.Context) ([]*gmail.Draft, error)
+	// GetDraft fetches a draft with its message in the given format ("full", "metadata", "raw")
+	GetDraft(ctx context.Context, id, format string) (*gmail.Draft, error)
+	CreateDraft(ctx context.Context, draft *gmail.Draft) (*gmail.Draft, error)
+	UpdateDraft(ctx context.Context, id string, draft *gmail.Draft) (*gmail.Draft, error)
+	// SendDraft sends draft.Id, replacing its message first when draft.Message is set
+	SendDraft(ctx context.Context, draft *gmail.Draft) (*gmail.Message, error)
+	DeleteDraft(ctx context.Context, id string) error
+}
+
+// gmailBackend implements MailBackend on top of the Gmail REST API
+type gmailBackend struct {
+	srv *gmail.Service
+}
+
+func newGmailBackend(srv *gmail.Service) *gmailBackend {
+	return &gmailBackend{srv: srv}
+}
+
+func (g *gmailBackend) ListMessages(ctx context.Context, query string, labelIDs []string, pageToken string, maxResults int64) (*gmail.ListMessagesResponse, error) {
+	call := g.srv.Users.Messages.List("me").Context(ctx)
+	if query != "" {
+		call = call.Q(query)
+	}
+	if len(labelIDs) > 0 {
+		call = call.LabelIds(labelIDs...)
+	}
+	if pageToken != "" {
+		call = call.PageToken(pageToken)
+	}
+	if maxResults > 0 {
+		call = call.MaxResults(maxResults)
+	}
+	return call.Do()
+}
+
+func (g *gmailBackend) GetMessage(ctx context.Context, id, format string) (*gmail.Message, error) {
+	return g.srv.Users.Messages.Get("me", id).Format(format).Context(ctx).Do()
+}
+
+func (g *gmailBackend) SendMessage(ctx context.Context, msg *gmail.Message) (*gmail.Message, error) {
+	return g.srv.Users.Messages.Send("me", msg).Context(ctx).Do()
+}
+
+func (g *gmailBackend) ModifyMessage(ctx context.Context, id string, req *gmail.ModifyMessageRequest) (*gmail.Message, error) {
+	return g.srv.Users.Messages.Modify("me", id, req).Context(ctx).Do()
+}
+
+func (g *gmailBackend) TrashMessage(ctx context.Context, id string) (*gmail.Message, error) {
+	return g.srv.Users.Messages.Trash("me", id).Context(ctx).Do()
+}
+
+func (g *gmailBackend) UntrashMessage(ctx context.Context, id string) (*gmail.Message, error) {
+	return g.srv.Users.Messages.Untrash("me", id).Context(ctx).Do()
+}
+
+func (g *gmailBackend) BatchModify(ctx context.Context, req *gmail.BatchModifyMessagesRequest) error {
+	return g.srv.Users.Messages.BatchModify("me", req).Context(ctx).Do()
+}
+
+func (g *gmailBackend) BatchDelete(ctx context.Context, ids []string) error {
+	req := &gmail.BatchDeleteMessagesRequest{Ids: ids}
+	return g.srv.Users.Messages.BatchDelete("me", req).Context(ctx).Do()
+}
+
+func (g *gmailBackend) ListLabels(ctx context.Context) ([]*gmail.Label, error) {
+	resp, err := g.srv.Users.Labels.List("me").Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	return resp.Labels, nil
+}
+
+func (g *gmailBackend) CreateLabel(ctx context.Context, label *gmail.Label) (*gmail.Label, error) {
+	return g.srv.Users.Labels.Create("me", label).Context(ctx).Do()
+}
+
+func (g *gmailBackend) PatchLabel(ctx context.Context, id string, label *gmail.Label) (*gmail.Label, error) {
+	return g.srv.Users.Labels.Patch("me", id, label).Context(ctx).Do()
+}
+
+func (g *gmailBackend) DeleteLabel(ctx context.Context, id string) error {
+	return g.srv.Users.Labels.Delete("me", id).Context(ctx).Do()
+}
+
+func (g *gmailBackend) GetAttachment(ctx context.Context, msgID, attachmentID string) (*gmail.MessagePartBody, error) {
+	return g.srv.Users.Messages.Attachments.Get("me", msgID, attachmentID).Context(ctx).Do()
+}
+
+func (g *gmailBackend) GetThread(ctx context.Context, id, format string) (*gmail.Thread, error) {
+	return g.srv.Users.Threads.Get("me", id).Format(format).Context(ctx).Do()
+}
+
+func (g *gmailBackend) ModifyThread(ctx context.Context, id string, req *gmail.ModifyThreadRequest) (*gmail.Thread, error) {
+	return g.srv.Users.Threads.Modify("me", id, req).Context(ctx).Do()
+}
+
+func (g *gmailBackend) GetProfile(ctx context.Context) (*gmail.Profile, error) {
+	return g.srv.Users.GetProfile("me").Context(ctx).Do()
+}
+
+func (g *gmailBackend) ListSendAs(ctx context.Context) ([]*gmail.SendAs, error) {
+	resp, err := g.srv.Users.Settings.SendAs.List("me").Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	return resp.SendAs, nil
+}
+
+func (g *gmailBackend) ListHistory(ctx context.Context, startHistoryID uint64, pageToken string) (*gmail.ListHistoryResponse, error) {
+	call := g.srv.Users.History.List("me").StartHistoryId(startHistoryID).Context(ctx)
+	if pageToken != "" {
+		call = call.PageToken(pageToken)
+	}
+	return call.Do()
+}
+
+func (g *gmailBackend) ListDrafts(ctx context.Context) ([]*gmail.Draft, error) {
+	resp, err := g.srv.Users.Drafts.List("me").Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	return resp.Drafts, nil
+}
+
+func (g *gmailBackend) GetDraft(ctx context.Context, id, format string) (*gmail.Draft, error) {
+	return g.srv.Users.Drafts.Get("me", id).Format(format).Context(ctx).Do()
+}
+
+func (g *gmailBackend) CreateDraft(ctx context.Context, draft *gmail.Draft) (*gmail.Draft, error) {
+	return g.srv.Users.Drafts.Create("me", draft).Context(ctx).Do()
+}
+
+func (g *gmailBackend) UpdateDraft(ctx context.Context, id string, draft *gmail.Draft) (*gmail.Draft, error) {
+	return g.srv.Users.Drafts.Update("me", id, draft).Context(ctx).Do()
+}
+
+func (g *gmailBackend) SendDraft(ctx context.Context, draft *gmail.Draft) (*gmail.Message, error) {
+	return g.srv.Users.Drafts.Send("me", draft).Context(ctx).Do()
+}
+
+func (g *gmailBackend) DeleteDraft(ctx context.Context, id string) error {
+	return g.srv.Users.Drafts.Delete("me", id).Context(ctx).Do()
+}
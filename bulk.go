@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/charmbracelet/bubbles/list"
+	tea "github.com/charmbracelet/bubbletea"
+	"google.golang.org/api/gmail/v1"
+)
+
+const (
+	// bulkChunkSize is how many messages each batch call covers. The API
+	// takes up to 1000; smaller chunks let the status line show progress.
+	bulkChunkSize = 100
+	// maxSelectAll caps how many messages "select all matching" collects
+	maxSelectAll = 5000
+)
+
+// bulkOp is a label change or permanent delete applied to many messages,
+// sent to the server one chunk at a time
+type bulkOp struct {
+	verb   string // past tense, for the summary: "Archived"
+	detail string // the rest of the summary: " to trash"
+	ids    []string
+	add    []string
+	remove []string
+	delete bool // BatchDelete instead of BatchModify
+	done   int
+	failed int
+	err    error
+
+	// succeeded, rows and before are what undo needs: the IDs that were
+	// changed, their rows beforehand and the labels each message had
+	succeeded []string
+	rows      []emailItem
+	before    map[string][]string
+}
+
+// bulkProgressMsg reports a finished chunk of a bulk operation
+type bulkProgressMsg struct {
+	op     *bulkOp
+	ids    []string
+	before map[string][]string // labels of the chunk's messages that weren't loaded
+	err    error
+}
+
+// allMatchingMsg carries every message ID of the current listing
+type allMatchingMsg struct {
+	ids       []string
+	truncated bool
+}
+
+// runBulkChunk sends the next chunk of op. For a label change, the labels
+// of messages selected beyond the loaded rows are read first, on the
+// metadata worker pool, so that undo knows what each one had.
+func runBulkChunk(b MailBackend, op *bulkOp) tea.Cmd {
+	start := op.done + op.failed
+	chunk := op.ids[start:min(start+bulkChunkSize, len(op.ids))]
+	add, remove, del := op.add, op.remove, op.delete
+	var unknown []string
+	if !del {
+		for _, id := range chunk {
+			if _, ok := op.before[id]; !ok {
+				unknown = append(unknown, id)
+			}
+		}
+	}
+	return func() tea.Msg {
+		ctx := context.Background()
+		if del {
+			return bulkProgressMsg{op: op, ids: chunk, err: b.BatchDelete(ctx, chunk)}
+		}
+
+		msgs, errs := fetchEach(ctx, unknown, func(ctx context.Context, id string) (*gmail.Message, error) {
+			return b.GetMessage(ctx, id, "minimal")
+		})
+		before := make(map[string][]string, len(unknown))
+		for i, id := range unknown {
+			if errs[i] != nil {
+				return bulkProgressMsg{op: op, ids: chunk, err: errs[i]}
+			}
+			before[id] = msgs[i].LabelIds
+		}
+		err := b.BatchModify(ctx, &gmail.BatchModifyMessagesRequest{
+			Ids:            chunk,
+			AddLabelIds:    add,
+			RemoveLabelIds: remove,
+		})
+		return bulkProgressMsg{op: op, ids: chunk, before: before, err: err}
+	}
+}
+
+func (op *bulkOp) finished() bool {
+	return op.done+op.failed >= len(op.ids)
+}
+
+// summary describes the outcome once every chunk has been sent
+func (op *bulkOp) summary() string {
+	if op.failed == 0 {
+		return fmt.Sprintf("%s %s%s", op.verb, pluralize(op.done, "message"), op.detail)
+	}
+	return fmt.Sprintf("%s %d of %s%s; %d failed: %v", op.verb, op.done, pluralize(len(op.ids), "message"), op.detail, op.failed, op.err)
+}
+
+func pluralize(n int, noun string) string {
+	if n == 1 {
+		return fmt.Sprintf("1 %s", noun)
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
+
+// listAllMatching collects the IDs of every message in a listing, beyond
+// the pages loaded so far
+func listAllMatching(b MailBackend, query string, labelIDs []string) tea.Cmd {
+	return func() tea.Msg {
+		var ids []string
+		pageToken := ""
+		for {
+			resp, err := b.ListMessages(context.Background(), query, labelIDs, pageToken, 500)
+			if err != nil {
+				return emailLoadErrorMsg{err: fmt.Errorf("failed to list matching messages: %w", err)}
+			}
+			for _, msg := range resp.Messages {
+				ids = append(ids, msg.Id)
+			}
+			if len(ids) >= maxSelectAll {
+				return allMatchingMsg{ids: ids[:maxSelectAll], truncated: true}
+			}
+			if resp.NextPageToken == "" {
+				return allMatchingMsg{ids: ids}
+			}
+			pageToken = resp.NextPageToken
+		}
+	}
+}
+
+// selectionDelegate draws the message lists, marking selected rows. The
+// selection map is shared with the model, so it must be cleared in place
+// rather than replaced.
+type selectionDelegate struct {
+	list.DefaultDelegate
+	selected map[string]bool
+}
+
+// markedItem shows a selected row with a check mark
+type markedItem struct {
+	list.DefaultItem
+}
+
+func (i markedItem) Title() string { return "✓ " + i.DefaultItem.Title() }
+
+func (d selectionDelegate) Render(w io.Writer, m list.Model, index int, item list.Item) {
+	if d.isSelected(item) {
+		item = markedItem{item.(list.DefaultItem)}
+	}
+	d.DefaultDelegate.Render(w, m, index, item)
+}
+
+func (d selectionDelegate) isSelected(item list.Item) bool {
+	switch item := item.(type) {
+	case emailItem:
+		return d.selected[item.id]
+	case threadItem:
+		for _, msg := range item.messages {
+			if !d.selected[msg.id] {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// itemIDs returns the message IDs behind a row
+func itemIDs(item list.Item) []string {
+	switch item := item.(type) {
+	case emailItem:
+		return []string{item.id}
+	case threadItem:
+		ids := make([]string, len(item.messages))
+		for i, msg := range item.messages {
+			ids[i] = msg.id
+		}
+		return ids
+	}
+	return nil
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+const (
+	cacheDirName   = "gmail-tui"
+	cacheIndexFile = "index.json"
+	cacheMsgDir    = "messages"
+	cacheBodyDir   = "bodies"
+	// cacheVersion changes when the layout on disk does; a cache written in
+	// another layout is dropped rather than misread
+	cacheVersion = 1
+	// cacheMaxMessages caps the messages kept; past it, those stored
+	// longest ago are evicted
+	cacheMaxMessages = 5000
+)
+
+// cachedMessage is the on-disk form of a message's headers and labels.
+// Full records whether its body is kept too, in a file of its own that is
+// only read when the message is opened. Stored is when it was last written
+// (Unix nanoseconds) and decides what is evicted first.
+type cachedMessage struct {
+	Full    bool           `json:"full"`
+	Stored  int64          `json:"stored"`
+	Message *gmail.Message `json:"message"`
+}
+
+// cacheIndex holds everything that isn't per-message
+type cacheIndex struct {
+	Version   int                 `json:"version"`
+	Labels    []*gmail.Label      `json:"labels"`
+	Threads   map[string][]string `json:"threads"`
+	HistoryID uint64              `json:"historyId"`
+}
+
+// cacheStore is a write-through store of messages, labels and thread
+// membership kept under the user's cache directory. Only headers and
+// labels are held in memory.
+type cacheStore struct {
+	mu          sync.Mutex
+	dir         string
+	maxMessages int
+	now         func() time.Time
+	messages    map[string]*cachedMessage
+	index       cacheIndex
+}
+
+// openCache loads the cache in dir, creating it if needed
+func openCache(dir string) (*cacheStore, error) {
+	for _, sub := range []string{cacheMsgDir, cacheBodyDir} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return nil, fmt.Errorf("failed to create cache directory: %w", err)
+		}
+	}
+
+	c := &cacheStore{
+		dir:         dir,
+		maxMessages: cacheMaxMessages,
+		now:         time.Now,
+		messages:    make(map[string]*cachedMessage),
+		index:       cacheIndex{Threads: make(map[string][]string)},
+	}
+
+	if data, err := os.ReadFile(filepath.Join(dir, cacheIndexFile)); err == nil {
+		if err := json.Unmarshal(data, &c.index); err != nil {
+			return nil, fmt.Errorf("failed to parse cache index: %w", err)
+		}
+		if c.index.Threads == nil {
+			c.index.Threads = make(map[string][]string)
+		}
+	}
+	if c.index.Version != cacheVersion {
+		// New, or written by an older version
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c, c.clear()
+	}
+
+	entries, err := os.ReadDir(filepath.Join(dir, cacheMsgDir))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cache: %w", err)
+	}
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(dir, cacheMsgDir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		var cm cachedMessage
+		if err := json.Unmarshal(data, &cm); err != nil || cm.Message == nil {
+			continue // skip corrupt entries rather than failing the whole cache
+		}
+		c.messages[cm.Message.Id] = &cm
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c, c.prune()
+}
+
+// Message returns the cached copy of a message. Requests for the full
+// format are only satisfied by entries that were stored with bodies, which
+// are read from disk.
+func (c *cacheStore) Message(id string, full bool) (*gmail.Message, bool) {
+	c.mu.Lock()
+	cm, ok := c.messages[id]
+	c.mu.Unlock()
+	if !ok || (full && !cm.Full) {
+		return nil, false
+	}
+	if !full {
+		return cm.Message, true
+	}
+
+	data, err := os.ReadFile(c.bodyPath(id))
+	if err != nil {
+		return nil, false
+	}
+	var msg gmail.Message
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, false
+	}
+	// Labels are kept current on the headers only
+	msg.LabelIds = cm.Message.LabelIds
+	msg.Snippet = cm.Message.Snippet
+	msg.HistoryId = cm.Message.HistoryId
+	return &msg, true
+}
+
+// PutMessage stores msg, keeping previously cached bodies when msg was
+// fetched without them
+func (c *cacheStore) PutMessage(msg *gmail.Message, full bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if full {
+		data, err := json.Marshal(msg)
+		if err != nil {
+			return fmt.Errorf("failed to encode message: %w", err)
+		}
+		if err := writeFileAtomic(c.bodyPath(msg.Id), data, 0600); err != nil {
+			return err
+		}
+	} else if existing, ok := c.messages[msg.Id]; ok && existing.Full {
+		full = true
+	}
+	return c.store(&cachedMessage{Full: full, Message: headersOnly(msg)})
+}
+
+// SetLabelIDs updates the labels of a cached message in place
+func (c *cacheStore) SetLabelIDs(id string, labelIDs []string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cm, ok := c.messages[id]
+	if !ok {
+		return nil
+	}
+	updated := *cm.Message
+	updated.LabelIds = labelIDs
+	return c.store(&cachedMessage{Full: cm.Full, Message: &updated})
+}
+
+// store writes cm and its thread membership, then evicts if the cache has
+// grown past its cap. It must be called with c.mu held.
+func (c *cacheStore) store(cm *cachedMessage) error {
+	msg := cm.Message
+	cm.Stored = c.now().UnixNano()
+	c.messages[msg.Id] = cm
+	if msg.ThreadId != "" && !containsString(c.index.Threads[msg.ThreadId], msg.Id) {
+		c.index.Threads[msg.ThreadId] = append(c.index.Threads[msg.ThreadId], msg.Id)
+		if err := c.saveIndex(); err != nil {
+			return err
+		}
+	}
+
+	data, err := json.Marshal(cm)
+	if err != nil {
+		return fmt.Errorf("failed to encode message: %w", err)
+	}
+	if err := writeFileAtomic(c.messagePath(msg.Id), data, 0600); err != nil {
+		return err
+	}
+	return c.prune()
+}
+
+// prune evicts the messages stored longest ago once there are more than
+// c.maxMessages. It must be called with c.mu held.
+func (c *cacheStore) prune() error {
+	if len(c.messages) <= c.maxMessages {
+		return nil
+	}
+	byAge := make([]*cachedMessage, 0, len(c.messages))
+	for _, cm := range c.messages {
+		byAge = append(byAge, cm)
+	}
+	sort.Slice(byAge, func(i, j int) bool { return byAge[i].Stored < byAge[j].Stored })
+
+	// Evict a tenth more than needed, so pruning doesn't run on every write
+	keep := max(c.maxMessages-c.maxMessages/10, 1)
+	for _, cm := range byAge[:len(byAge)-keep] {
+		if err := c.remove(cm.Message.Id); err != nil {
+			return err
+		}
+	}
+	return c.saveIndex()
+}
+
+// headersOnly returns msg without bodies or parts, the form kept in memory
+func headersOnly(msg *gmail.Message) *gmail.Message {
+	stripped := *msg
+	stripped.Raw = ""
+	if p := msg.Payload; p != nil {
+		stripped.Payload = &gmail.MessagePart{MimeType: p.MimeType, Filename: p.Filename, Headers: p.Headers}
+	}
+	return &stripped
+}
+
+// DeleteMessage drops a message and its thread membership
+func (c *cacheStore) DeleteMessage(id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.messages[id]; !ok {
+		return nil
+	}
+	if err := c.remove(id); err != nil {
+		return err
+	}
+	return c.saveIndex()
+}
+
+// remove drops a message, its body and its thread membership, leaving the
+// caller to save the index. It must be called with c.mu held.
+func (c *cacheStore) remove(id string) error {
+	cm, ok := c.messages[id]
+	if !ok {
+		return nil
+	}
+	delete(c.messages, id)
+
+	threadID := cm.Message.ThreadId
+	ids := c.index.Threads[threadID]
+	for i, mid := range ids {
+		if mid == id {
+			c.index.Threads[threadID] = append(ids[:i:i], ids[i+1:]...)
+			break
+		}
+	}
+	if len(c.index.Threads[threadID]) == 0 {
+		delete(c.index.Threads, threadID)
+	}
+
+	for _, path := range []string{c.messagePath(id), c.bodyPath(id)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove cached message: %w", err)
+		}
+	}
+	return nil
+}
+
+// clear drops every cached message and thread, keeping the labels. It
+// must be called with c.mu held.
+func (c *cacheStore) clear() error {
+	for _, sub := range []string{cacheMsgDir, cacheBodyDir} {
+		dir := filepath.Join(c.dir, sub)
+		if err := os.RemoveAll(dir); err != nil {
+			return fmt.Errorf("failed to clear cache: %w", err)
+		}
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return fmt.Errorf("failed to create cache directory: %w", err)
+		}
+	}
+	c.messages = make(map[string]*cachedMessage)
+	c.index.Version = cacheVersion
+	c.index.Threads = make(map[string][]string)
+	c.index.HistoryID = 0
+	return c.saveIndex()
+}
+
+// Clear drops every cached message and thread, keeping the labels. It is
+// used when history can no longer be replayed, since any cached message may
+// since have been deleted or relabelled.
+func (c *cacheStore) Clear() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.clear()
+}
+
+// Messages returns cached messages matching query and labelIDs, newest first
+func (c *cacheStore) Messages(query string, labelIDs []string) []*gmail.Message {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var result []*gmail.Message
+	for _, cm := range c.messages {
+		if hasAllLabels(cm.Message, labelIDs) && matchesQuery(cm.Message, query) {
+			result = append(result, cm.Message)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].InternalDate > result[j].InternalDate
+	})
+	return result
+}
+
+// ThreadMessageIDs returns the cached members of a thread
+func (c *cacheStore) ThreadMessageIDs(threadID string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.index.Threads[threadID]...)
+}
+
+// HistoryID is the mailbox history ID the cache is known to be current at
+func (c *cacheStore) HistoryID() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.index.HistoryID
+}
+
+func (c *cacheStore) SetHistoryID(id uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.index.HistoryID = id
+	return c.saveIndex()
+}
+
+func (c *cacheStore) Labels() []*gmail.Label {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.index.Labels
+}
+
+func (c *cacheStore) PutLabels(labels []*gmail.Label) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.index.Labels = labels
+	return c.saveIndex()
+}
+
+// saveIndex must be called with c.mu held
+func (c *cacheStore) saveIndex() error {
+	data, err := json.Marshal(c.index)
+	if err != nil {
+		return fmt.Errorf("failed to encode cache index: %w", err)
+	}
+	return writeFileAtomic(filepath.Join(c.dir, cacheIndexFile), data, 0600)
+}
+
+func (c *cacheStore) messagePath(id string) string {
+	return filepath.Join(c.dir, cacheMsgDir, cacheFileName(id))
+}
+
+func (c *cacheStore) bodyPath(id string) string {
+	return filepath.Join(c.dir, cacheBodyDir, cacheFileName(id))
+}
+
+func cacheFileName(id string) string {
+	// Gmail IDs are hex, but never trust a path component from the network
+	return strings.ReplaceAll(filepath.Base(id), ".", "_") + ".json"
+}
+
+// writeFileAtomic writes data to a temp file in the same directory and
+// renames it over path, so readers never observe a partial file
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %w", filepath.Base(path), err)
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to set permissions on %s: %w", filepath.Base(path), err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close %s: %w", filepath.Base(path), err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace %s: %w", filepath.Base(path), err)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+func cachedTestMessage(i int) *gmail.Message {
+	return &gmail.Message{
+		Id:       fmt.Sprint("m", i),
+		ThreadId: fmt.Sprint("t", i),
+		LabelIds: []string{"INBOX"},
+		Payload: &gmail.MessagePart{
+			MimeType: "text/plain",
+			Headers:  []*gmail.MessagePartHeader{{Name: "Subject", Value: fmt.Sprint("Subject ", i)}},
+			Body:     &gmail.MessagePartBody{Data: "aGVsbG8gdGhlcmU"},
+		},
+	}
+}
+
+func TestCacheKeepsBodiesOnDisk(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := openCache(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.PutMessage(cachedTestMessage(0), true); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.SetLabelIDs("m0", []string{"STARRED"}); err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err = openCache(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers, ok := cache.Message("m0", false)
+	if !ok {
+		t.Fatal("message wasn't reloaded")
+	}
+	if headers.Payload.Body != nil {
+		t.Error("body was loaded into memory")
+	}
+	full, ok := cache.Message("m0", true)
+	if !ok || full.Payload.Body == nil || full.Payload.Body.Data == "" {
+		t.Fatalf("body wasn't read back: %+v", full)
+	}
+	if len(full.LabelIds) != 1 || full.LabelIds[0] != "STARRED" {
+		t.Errorf("labels = %v, want the updated ones", full.LabelIds)
+	}
+
+	// A later metadata fetch keeps the body
+	if err := cache.PutMessage(headers, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache.Message("m0", true); !ok {
+		t.Error("metadata fetch dropped the cached body")
+	}
+}
+
+func TestCacheEvictsOldest(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := openCache(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.maxMessages = 10
+	// Each message is stored a second after the one before
+	clock := time.Unix(0, 0)
+	cache.now = func() time.Time {
+		clock = clock.Add(time.Second)
+		return clock
+	}
+	for i := 0; i < 11; i++ {
+		if err := cache.PutMessage(cachedTestMessage(i), true); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := len(cache.Messages("", nil)); n != 9 {
+		t.Errorf("%d messages kept, want 9", n)
+	}
+	for _, id := range []string{"m0", "m1"} {
+		if _, ok := cache.Message(id, false); ok {
+			t.Errorf("%s was kept over newer messages", id)
+		}
+		if _, err := os.Stat(cache.bodyPath(id)); !os.IsNotExist(err) {
+			t.Errorf("%s body left on disk: %v", id, err)
+		}
+		if ids := cache.ThreadMessageIDs("t" + id[1:]); len(ids) != 0 {
+			t.Errorf("%s still listed in its thread", id)
+		}
+	}
+	if _, ok := cache.Message("m10", true); !ok {
+		t.Error("newest message was evicted")
+	}
+}
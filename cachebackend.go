@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// errOffline is returned for operations that need the network while the
+// client is running from the local cache only
+var errOffline = errors.New("offline: this action needs a connection to Gmail")
+
+// cachingBackend records everything read through it in a cacheStore and
+// serves reads from that store when the Gmail API can't be reached. With a
+// nil remote it runs in read-only offline mode.
+type cachingBackend struct {
+	remote MailBackend
+	cache  *cacheStore
+
+	mu       sync.Mutex
+	onNotice func(cacheNotice)
+}
+
+// cacheNotice reports a fallback to the cache or a failed cache write, which
+// the UI shows in the log rather than failing the call
+type cacheNotice struct {
+	text    string
+	isError bool
+}
+
+func newCachingBackend(remote MailBackend, cache *cacheStore) *cachingBackend {
+	return &cachingBackend{remote: remote, cache: cache}
+}
+
+// OnNotice sets a function told about cache fallbacks and write failures.
+// Until it's set they go unreported.
+func (c *cachingBackend) OnNotice(f func(cacheNotice)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onNotice = f
+}
+
+func (c *cachingBackend) notice(text string, isError bool) {
+	c.mu.Lock()
+	f := c.onNotice
+	c.mu.Unlock()
+	if f != nil {
+		f(cacheNotice{text: text, isError: isError})
+	}
+}
+
+// warn reports a cache write that failed; the call itself still succeeds
+func (c *cachingBackend) warn(format string, args ...any) {
+	c.notice("Cache: "+fmt.Sprintf(format, args...), true)
+}
+
+// Offline reports whether the backend has no remote to talk to
+func (c *cachingBackend) Offline() bool {
+	return c.remote == nil
+}
+
+// isOfflineError reports whether err means the API was unreachable, as
+// opposed to the API rejecting the request
+func isOfflineError(err error) bool {
+	if errors.Is(err, errOffline) {
+		return true
+	}
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+func (c *cachingBackend) ListMessages(ctx context.Context, query string, labelIDs []string, pageToken string, maxResults int64) (*gmail.ListMessagesResponse, error) {
+	if c.remote != nil {
+		resp, err := c.remote.ListMessages(ctx, query, labelIDs, pageToken, maxResults)
+		if err == nil || !isOfflineError(err) {
+			return resp, err
+		}
+		c.notice(fmt.Sprintf("Gmail unreachable (%v); listing from cache", err), false)
+	}
+	return c.cachedListing(query, labelIDs, pageToken, maxResults)
+}
+
+// cachedListing pages through cached messages the same way the API would.
+// Page tokens are plain offsets, so they're only valid against the cache.
+func (c *cachingBackend) cachedListing(query string, labelIDs []string, pageToken string, maxResults int64) (*gmail.ListMessagesResponse, error) {
+	matched := c.cache.Messages(query, labelIDs)
+
+	start, _ := strconv.Atoi(pageToken)
+	start = min(max(start, 0), len(matched))
+	end := len(matched)
+	if maxResults > 0 && int64(end-start) > maxResults {
+		end = start + int(maxResults)
+	}
+
+	resp := &gmail.ListMessagesResponse{ResultSizeEstimate: int64(len(matched))}
+	for _, msg := range matched[start:end] {
+		resp.Messages = append(resp.Messages, &gmail.Message{Id: msg.Id, ThreadId: msg.ThreadId})
+	}
+	if end < len(matched) {
+		resp.NextPageToken = strconv.Itoa(end)
+	}
+	return resp, nil
+}
+
+func (c *cachingBackend) GetMessage(ctx context.Context, id, format string) (*gmail.Message, error) {
+	full := format == "full"
+	if c.remote == nil {
+		if msg, ok := c.cache.Message(id, full); ok {
+			return msg, nil
+		}
+		return nil, errOffline
+	}
+
+	msg, err := c.remote.GetMessage(ctx, id, format)
+	if err != nil {
+		if cached, ok := c.cache.Message(id, full); ok && isOfflineError(err) {
+			return cached, nil
+		}
+		return nil, err
+	}
+
+	if format != "minimal" {
+		if err := c.cache.PutMessage(msg, full); err != nil {
+			c.warn("could not cache message %s: %v", id, err)
+		}
+	}
+	return msg, nil
+}
+
+func (c *cachingBackend) SendMessage(ctx context.Context, msg *gmail.Message) (*gmail.Message, error) {
+	if c.remote == nil {
+		return nil, errOffline
+	}
+	return c.remote.SendMessage(ctx, msg)
+}
+
+func (c *cachingBackend) ModifyMessage(ctx context.Context, id string, req *gmail.ModifyMessageRequest) (*gmail.Message, error) {
+	if c.remote == nil {
+		return nil, errOffline
+	}
+	msg, err := c.remote.ModifyMessage(ctx, id, req)
+	if err != nil {
+		return nil, err
+	}
+	c.updateLabels(msg)
+	return msg, nil
+}
+
+func (c *cachingBackend) TrashMessage(ctx context.Context, id string) (*gmail.Message, error) {
+	if c.remote == nil {
+		return nil, errOffline
+	}
+	msg, err := c.remote.TrashMessage(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	c.updateLabels(msg)
+	return msg, nil
+}
+
+func (c *cachingBackend) UntrashMessage(ctx context.Context, id string) (*gmail.Message, error) {
+	if c.remote == nil {
+		return nil, errOffline
+	}
+	msg, err := c.remote.UntrashMessage(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	c.updateLabels(msg)
+	return msg, nil
+}
+
+func (c *cachingBackend) BatchModify(ctx context.Context, req *gmail.BatchModifyMessagesRequest) error {
+	if c.remote == nil {
+		return errOffline
+	}
+	if err := c.remote.BatchModify(ctx, req); err != nil {
+		return err
+	}
+	// The API returns nothing, so work out the new labels from the cached ones
+	for _, id := range req.Ids {
+		if msg, ok := c.cache.Message(id, false); ok {
+			c.updateLabels(&gmail.Message{Id: id, LabelIds: applyLabelChanges(msg.LabelIds, req.AddLabelIds, req.RemoveLabelIds)})
+		}
+	}
+	return nil
+}
+
+func (c *cachingBackend) BatchDelete(ctx context.Context, ids []string) error {
+	if c.remote == nil {
+		return errOffline
+	}
+	if err := c.remote.BatchDelete(ctx, ids); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := c.cache.DeleteMessage(id); err != nil {
+			c.warn("could not remove cached message %s: %v", id, err)
+		}
+	}
+	return nil
+}
+
+func (c *cachingBackend) ListLabels(ctx context.Context) ([]*gmail.Label, error) {
+	if c.remote != nil {
+		labels, err := c.remote.ListLabels(ctx)
+		if err == nil {
+			if err := c.cache.PutLabels(labels); err != nil {
+				c.warn("could not cache labels: %v", err)
+			}
+			return labels, nil
+		}
+		if !isOfflineError(err) {
+			return nil, err
+		}
+	}
+	return c.cache.Labels(), nil
+}
+
+func (c *cachingBackend) ModifyThread(ctx context.Context, id string, req *gmail.ModifyThreadRequest) (*gmail.Thread, error) {
+	if c.remote == nil {
+		return nil, errOffline
+	}
+	thread, err := c.remote.ModifyThread(ctx, id, req)
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range thread.Messages {
+		c.updateLabels(msg)
+	}
+	return thread, nil
+}
+
+// Label changes go straight to the server; the cached copy of the labels is
+// refreshed by the ListLabels call that follows them
+
+func (c *cachingBackend) CreateLabel(ctx context.Context, label *gmail.Label) (*gmail.Label, error) {
+	if c.remote == nil {
+		return nil, errOffline
+	}
+	return c.remote.CreateLabel(ctx, label)
+}
+
+func (c *cachingBackend) PatchLabel(ctx context.Context, id string, label *gmail.Label) (*gmail.Label, error) {
+	if c.remote == nil {
+		return nil, errOffline
+	}
+	return c.remote.PatchLabel(ctx, id, label)
+}
+
+func (c *cachingBackend) DeleteLabel(ctx context.Context, id string) error {
+	if c.remote == nil {
+		return errOffline
+	}
+	return c.remote.DeleteLabel(ctx, id)
+}
+
+func (c *cachingBackend) GetAttachment(ctx context.Context, msgID, attachmentID string) (*gmail.MessagePartBody, error) {
+	if c.remote == nil {
+		return nil, errOffline
+	}
+	return c.remote.GetAttachment(ctx, msgID, attachmentID)
+}
+
+func (c *cachingBackend) GetThread(ctx context.Context, id, format string) (*gmail.Thread, error) {
+	full := format == "full"
+	if c.remote != nil {
+		thread, err := c.remote.GetThread(ctx, id, format)
+		if err == nil && format == "minimal" {
+			// Labels alone would overwrite the headers cached for the list
+			return thread, nil
+		}
+		if err == nil {
+			for _, msg := range thread.Messages {
+				if err := c.cache.PutMessage(msg, full); err != nil {
+					c.warn("could not cache message %s: %v", msg.Id, err)
+				}
+			}
+			return thread, nil
+		}
+		if !isOfflineError(err) {
+			return nil, err
+		}
+	}
+
+	thread := &gmail.Thread{Id: id}
+	for _, msgID := range c.cache.ThreadMessageIDs(id) {
+		if msg, ok := c.cache.Message(msgID, full); ok {
+			thread.Messages = append(thread.Messages, msg)
+		}
+	}
+	if len(thread.Messages) == 0 {
+		return nil, errOffline
+	}
+	sort.Slice(thread.Messages, func(i, j int) bool {
+		return thread.Messages[i].InternalDate < thread.Messages[j].InternalDate
+	})
+	return thread, nil
+}
+
+func (c *cachingBackend) GetProfile(ctx context.Context) (*gmail.Profile, error) {
+	if c.remote == nil {
+		return nil, errOffline
+	}
+	return c.remote.GetProfile(ctx)
+}
+
+func (c *cachingBackend) ListSendAs(ctx context.Context) ([]*gmail.SendAs, error) {
+	if c.remote == nil {
+		return nil, errOffline
+	}
+	return c.remote.ListSendAs(ctx)
+}
+
+func (c *cachingBackend) ListHistory(ctx context.Context, startHistoryID uint64, pageToken string) (*gmail.ListHistoryResponse, error) {
+	if c.remote == nil {
+		return nil, errOffline
+	}
+	return c.remote.ListHistory(ctx, startHistoryID, pageToken)
+}
+
+// updateLabels mirrors a Modify/Trash response into the cache
+func (c *cachingBackend) updateLabels(msg *gmail.Message) {
+	if msg == nil {
+		return
+	}
+	if err := c.cache.SetLabelIDs(msg.Id, msg.LabelIds); err != nil {
+		c.warn("could not update cached message %s: %v", msg.Id, err)
+	}
+}
+
+// Drafts aren't cached; they only make sense against the live mailbox
+
+func (c *cachingBackend) ListDrafts(ctx context.Context) ([]*gmail.Draft, error) {
+	if c.remote == nil {
+		return nil, errOffline
+	}
+	return c.remote.ListDrafts(ctx)
+}
+
+func (c *cachingBackend) GetDraft(ctx context.Context, id, format string) (*gmail.Draft, error) {
+	if c.remote == nil {
+		return nil, errOffline
+	}
+	return c.remote.GetDraft(ctx, id, format)
+}
+
+func (c *cachingBackend) CreateDraft(ctx context.Context, draft *gmail.Draft) (*gmail.Draft, error) {
+	if c.remote == nil {
+		return nil, errOffline
+	}
+	return c.remote.CreateDraft(ctx, draft)
+}
+
+func (c *cachingBackend) UpdateDraft(ctx context.Context, id string, draft *gmail.Draft) (*gmail.Draft, error) {
+	if c.remote == nil {
+		return nil, errOffline
+	}
+	return c.remote.UpdateDraft(ctx, id, draft)
+}
+
+func (c *cachingBackend) SendDraft(ctx context.Context, draft *gmail.Draft) (*gmail.Message, error) {
+	if c.remote == nil {
+		return nil, errOffline
+	}
+	return c.remote.SendDraft(ctx, draft)
+}
+
+func (c *cachingBackend) DeleteDraft(ctx context.Context, id string) error {
+	if c.remote == nil {
+		return errOffline
+	}
+	return c.remote.DeleteDraft(ctx, id)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/mail"
+	"strings"
+
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// headerDecoder decodes RFC 2047 encoded words in any charset the WHATWG
+// encoding index knows, not just the UTF-8 and ISO-8859-1 mime handles
+var headerDecoder = &mime.WordDecoder{CharsetReader: charsetReader}
+
+var addressParser = &mail.AddressParser{WordDecoder: headerDecoder}
+
+func charsetReader(label string, input io.Reader) (io.Reader, error) {
+	enc, err := htmlindex.Get(label)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported charset %q", label)
+	}
+	return enc.NewDecoder().Reader(input), nil
+}
+
+// decodeHeader decodes the encoded words in a header value, returning the
+// value unchanged if it can't be decoded
+func decodeHeader(value string) string {
+	decoded, err := headerDecoder.DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+// decodeAddressHeader decodes an address list header. Names are decoded
+// per address so that a decoded comma can't split one address into two.
+func decodeAddressHeader(value string) string {
+	addresses, err := addressParser.ParseList(value)
+	if err != nil {
+		return decodeHeader(value)
+	}
+
+	formatted := make([]string, len(addresses))
+	for i, addr := range addresses {
+		formatted[i] = formatAddress(addr)
+	}
+	return strings.Join(formatted, ", ")
+}
+
+// toUTF8 converts text in the charset named by contentType to UTF-8. With
+// no charset it falls back to a <meta> declaration for HTML, then to UTF-8
+// if the data is valid UTF-8, then to Windows-1252.
+func toUTF8(data []byte, contentType string) string {
+	enc, _, _ := charset.DetermineEncoding(data, contentType)
+	text, err := enc.NewDecoder().Bytes(data)
+	if err != nil {
+		return string(data)
+	}
+	return string(text)
+}
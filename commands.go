@@ -1,12 +1,9 @@
 package main
 
 import (
+	"context"
 	"encoding/base64"
 	"fmt"
-	"io"
-	"mime"
-	"mime/multipart"
-	"net/textproto"
 	"os"
 	"path/filepath"
 	"strings"
@@ -18,81 +15,114 @@ import (
 
 const (
 	maxAttachmentSize = 25 * 1024 * 1024 // 25MB Gmail limit
-	downloadsDir      = "downloads"
+	searchMaxResults  = 30
 )
 
-func loadEmail(srv *gmail.Service, msgID string) tea.Cmd {
+func loadEmail(ctx context.Context, b MailBackend, msgID string) tea.Cmd {
 	return func() tea.Msg {
-		content, err := fetchFullEmailBody(srv, msgID)
+		item, content, err := fetchFullEmailBody(ctx, b, msgID)
 		if err != nil {
-			return emailLoadErrorMsg{err: err}
+			return emailLoadErrorMsg{reqID: requestID(ctx), err: err}
 		}
-		return emailLoadedMsg{content: content}
+		return emailLoadedMsg{reqID: requestID(ctx), item: item, content: content}
 	}
 }
 
-func loadEmailsByLabel(srv *gmail.Service, labelID string) tea.Cmd {
+func loadThread(ctx context.Context, b MailBackend, threadID string) tea.Cmd {
 	return func() tea.Msg {
-		msgs, err := srv.Users.Messages.List("me").LabelIds(labelID).MaxResults(10).Do()
+		thread, err := b.GetThread(ctx, threadID, "full")
 		if err != nil {
-			return emailLoadErrorMsg{err: err}
+			return emailLoadErrorMsg{reqID: requestID(ctx), err: err}
 		}
-		return searchResultMsg{messages: msgs.Messages}
+
+		messages := make([]*emailItem, 0, len(thread.Messages))
+		for _, msg := range thread.Messages {
+			messages = append(messages, newEmailItem(msg))
+		}
+		return threadLoadedMsg{reqID: requestID(ctx), messages: messages}
 	}
 }
 
-func sendEmail(srv *gmail.Service, to, cc, bcc, subject, body string, attachments []string) tea.Cmd {
+func loadEmailsByLabel(ctx context.Context, b MailBackend, labelID string) tea.Cmd {
+	return fetchMessagePage(ctx, b, "", []string{labelID}, "", defaultMaxResults, listReplace)
+}
+
+// fetchMessagePage lists one page of messages; mode says how the result is
+// merged into the current list
+func fetchMessagePage(ctx context.Context, b MailBackend, query string, labelIDs []string, pageToken string, maxResults int64, mode listMode) tea.Cmd {
 	return func() tea.Msg {
-		tmpFile, err := os.CreateTemp("", "gmail-msg-")
+		resp, err := b.ListMessages(ctx, query, labelIDs, pageToken, maxResults)
 		if err != nil {
-			return emailLoadErrorMsg{err: fmt.Errorf("failed to create temp file: %w", err)}
+			return emailLoadErrorMsg{reqID: requestID(ctx), err: err}
 		}
-		defer os.Remove(tmpFile.Name())
-		defer tmpFile.Close()
-
-		writer := multipart.NewWriter(tmpFile)
-		boundary := writer.Boundary()
-
-		// Write headers
-		headers := buildEmailHeaders(to, cc, bcc, subject, boundary)
-		if _, err := tmpFile.WriteString(headers); err != nil {
-			return emailLoadErrorMsg{err: fmt.Errorf("failed to write headers: %w", err)}
+		return searchResultMsg{
+			reqID:         requestID(ctx),
+			query:         query,
+			labelIDs:      labelIDs,
+			messages:      resp.Messages,
+			nextPageToken: resp.NextPageToken,
+			estimate:      resp.ResultSizeEstimate,
+			mode:          mode,
 		}
+	}
+}
 
-		// Write text body
-		textPart := fmt.Sprintf("--%s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n", boundary, body)
-		if _, err := tmpFile.WriteString(textPart); err != nil {
-			return emailLoadErrorMsg{err: fmt.Errorf("failed to write body: %w", err)}
+func sendEmail(b MailBackend, email outgoingEmail) tea.Cmd {
+	return func() tea.Msg {
+		raw, err := buildRawMessage(email)
+		if err != nil {
+			return emailLoadErrorMsg{err: err}
 		}
 
-		// Process attachments
-		for _, filePath := range attachments {
-			if err := addAttachment(writer, filePath); err != nil {
-				return emailLoadErrorMsg{err: err}
-			}
+		_, err = b.SendMessage(context.Background(), &gmail.Message{Raw: raw, ThreadId: email.threadID})
+		if err != nil {
+			return emailLoadErrorMsg{err: err}
 		}
 
-		// Finalize
-		if _, err := tmpFile.WriteString(fmt.Sprintf("\r\n--%s--\r\n", boundary)); err != nil {
-			return emailLoadErrorMsg{err: fmt.Errorf("failed to write final boundary: %w", err)}
-		}
+		return emailSentMsg{}
+	}
+}
 
-		if err := writer.Close(); err != nil {
-			return emailLoadErrorMsg{err: fmt.Errorf("failed to close writer: %w", err)}
+// saveDraft creates a draft from email, or replaces draftID's message when
+// the draft already exists. The result is tagged with the compose session
+// the save came from.
+func saveDraft(b MailBackend, session int, draftID string, email outgoingEmail) tea.Cmd {
+	return func() tea.Msg {
+		saved := draftSavedMsg{session: session, id: draftID, created: draftID == ""}
+		raw, err := buildRawMessage(email)
+		if err != nil {
+			saved.err = err
+			return saved
 		}
 
-		// Read back and send
-		if _, err := tmpFile.Seek(0, 0); err != nil {
-			return emailLoadErrorMsg{err: fmt.Errorf("failed to seek temp file: %w", err)}
+		draft := &gmail.Draft{Message: &gmail.Message{Raw: raw, ThreadId: email.threadID}}
+		if draftID == "" {
+			draft, err = b.CreateDraft(context.Background(), draft)
+		} else {
+			draft, err = b.UpdateDraft(context.Background(), draftID, draft)
+		}
+		if err != nil {
+			saved.err = fmt.Errorf("failed to save draft: %w", err)
+			return saved
 		}
 
-		content, err := io.ReadAll(tmpFile)
+		saved.id = draft.Id
+		return saved
+	}
+}
+
+// sendDraft sends an existing draft with the form's current contents
+func sendDraft(b MailBackend, draftID string, email outgoingEmail) tea.Cmd {
+	return func() tea.Msg {
+		raw, err := buildRawMessage(email)
 		if err != nil {
-			return emailLoadErrorMsg{err: fmt.Errorf("failed to read temp file: %w", err)}
+			return emailLoadErrorMsg{err: err}
 		}
 
-		raw := base64.URLEncoding.EncodeToString(content)
-		_, err = srv.Users.Messages.Send("me", &gmail.Message{Raw: raw}).Do()
+		_, err = b.SendDraft(context.Background(), &gmail.Draft{
+			Id:      draftID,
+			Message: &gmail.Message{Raw: raw, ThreadId: email.threadID},
+		})
 		if err != nil {
 			return emailLoadErrorMsg{err: err}
 		}
@@ -101,135 +131,368 @@ func sendEmail(srv *gmail.Service, to, cc, bcc, subject, body string, attachment
 	}
 }
 
-func buildEmailHeaders(to, cc, bcc, subject, boundary string) string {
-	headers := fmt.Sprintf("To: %s\r\n", to)
-	if cc != "" {
-		headers += fmt.Sprintf("Cc: %s\r\n", cc)
-	}
-	if bcc != "" {
-		headers += fmt.Sprintf("Bcc: %s\r\n", bcc)
+// downloadAttachment saves an attachment into dir
+func downloadAttachment(b MailBackend, dir, msgID string, attachment *gmail.MessagePart) tea.Cmd {
+	return func() tea.Msg {
+		att, err := b.GetAttachment(context.Background(), msgID, attachment.Body.AttachmentId)
+		if err != nil {
+			return emailLoadErrorMsg{err: fmt.Errorf("download failed: %w", err)}
+		}
+
+		data, err := base64.RawURLEncoding.DecodeString(att.Data)
+		if err != nil {
+			return emailLoadErrorMsg{err: fmt.Errorf("failed to decode attachment: %w", err)}
+		}
+
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return emailLoadErrorMsg{err: fmt.Errorf("couldn't create downloads directory: %w", err)}
+		}
+
+		filename := filepath.Join(dir, sanitizeFilename(attachment.Filename))
+		if err := os.WriteFile(filename, data, 0644); err != nil {
+			return emailLoadErrorMsg{err: fmt.Errorf("failed to save attachment: %w", err)}
+		}
+
+		return attachmentDownloadedMsg{filename: filename}
 	}
-	headers += fmt.Sprintf("Subject: %s\r\n", subject)
-	headers += fmt.Sprintf("MIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=%s\r\n\r\n", boundary)
-	return headers
 }
 
-func addAttachment(writer *multipart.Writer, filePath string) error {
-	file, err := os.Open(filePath)
-	if err != nil {
-		return fmt.Errorf("failed to open attachment: %w", err)
+// forwardEmail fetches a message with the data of all its attachments so
+// they can be re-attached to the forward
+func forwardEmail(ctx context.Context, b MailBackend, msgID string) tea.Cmd {
+	return func() tea.Msg {
+		msg, err := b.GetMessage(ctx, msgID, "full")
+		if err != nil {
+			return emailLoadErrorMsg{reqID: requestID(ctx), err: err}
+		}
+		original := newEmailItem(msg)
+
+		attachments := make([]outgoingAttachment, 0, len(original.attachments))
+		for _, part := range original.attachments {
+			encoded := part.Body.Data
+			if part.Body.AttachmentId != "" {
+				body, err := b.GetAttachment(ctx, msgID, part.Body.AttachmentId)
+				if err != nil {
+					return emailLoadErrorMsg{reqID: requestID(ctx), err: fmt.Errorf("failed to fetch %s: %w", part.Filename, err)}
+				}
+				encoded = body.Data
+			}
+
+			data, err := base64.URLEncoding.DecodeString(padBase64(encoded))
+			if err != nil {
+				return emailLoadErrorMsg{reqID: requestID(ctx), err: fmt.Errorf("failed to decode %s: %w", part.Filename, err)}
+			}
+			attachments = append(attachments, outgoingAttachment{
+				name:     part.Filename,
+				mimeType: part.MimeType,
+				data:     data,
+			})
+		}
+
+		return forwardReadyMsg{reqID: requestID(ctx), original: original, attachments: attachments}
 	}
-	defer file.Close()
+}
 
-	fileInfo, err := file.Stat()
-	if err != nil {
-		return fmt.Errorf("failed to get file info: %w", err)
+// loadDrafts lists the user's drafts with enough headers to show them
+func loadDrafts(ctx context.Context, b MailBackend) tea.Cmd {
+	return func() tea.Msg {
+		drafts, err := b.ListDrafts(ctx)
+		if err != nil {
+			return emailLoadErrorMsg{reqID: requestID(ctx), err: err}
+		}
+
+		ids := make([]string, len(drafts))
+		for i, d := range drafts {
+			ids[i] = d.Id
+		}
+		full, errs := fetchEach(ctx, ids, func(ctx context.Context, id string) (*gmail.Draft, error) {
+			return b.GetDraft(ctx, id, "metadata")
+		})
+
+		items := make([]draftItem, 0, len(drafts))
+		for i, draft := range full {
+			if errs[i] != nil {
+				return emailLoadErrorMsg{reqID: requestID(ctx), err: errs[i]}
+			}
+			items = append(items, draftItem{id: draft.Id, email: newEmailItem(draft.Message)})
+		}
+		return draftsLoadedMsg{reqID: requestID(ctx), drafts: items}
 	}
+}
+
+// openDraft fetches a draft's raw message and parses it back into the
+// fields of the compose form, attachments included
+func openDraft(ctx context.Context, b MailBackend, draftID string) tea.Cmd {
+	return func() tea.Msg {
+		draft, err := b.GetDraft(ctx, draftID, "raw")
+		if err != nil {
+			return emailLoadErrorMsg{reqID: requestID(ctx), err: err}
+		}
 
-	if fileInfo.Size() > maxAttachmentSize {
-		return fmt.Errorf("attachment too large: %s (max 25MB)", filepath.Base(filePath))
+		email, err := parseRawMessage(draft.Message.Raw)
+		if err != nil {
+			return emailLoadErrorMsg{reqID: requestID(ctx), err: fmt.Errorf("failed to read draft: %w", err)}
+		}
+		email.threadID = draft.Message.ThreadId
+		return draftReadyMsg{reqID: requestID(ctx), id: draft.Id, email: email}
 	}
+}
 
-	partHeader := textproto.MIMEHeader{}
-	mimeType := mime.TypeByExtension(filepath.Ext(filePath))
-	if mimeType == "" {
-		mimeType = "application/octet-stream"
+func deleteDraft(b MailBackend, draftID string) tea.Cmd {
+	return func() tea.Msg {
+		if err := b.DeleteDraft(context.Background(), draftID); err != nil {
+			return emailLoadErrorMsg{err: err}
+		}
+		return draftDeletedMsg{id: draftID}
 	}
-	partHeader.Set("Content-Type", mimeType)
-	partHeader.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filepath.Base(filePath)))
-	partHeader.Set("Content-Transfer-Encoding", "base64")
+}
 
-	partWriter, err := writer.CreatePart(partHeader)
-	if err != nil {
-		return fmt.Errorf("failed to create attachment part: %w", err)
+// loadIdentity looks up the addresses that count as "me" for reply-all
+func loadIdentity(b MailBackend) tea.Cmd {
+	return func() tea.Msg {
+		var addresses []string
+		if profile, err := b.GetProfile(context.Background()); err == nil {
+			addresses = append(addresses, profile.EmailAddress)
+		}
+		if sendAs, err := b.ListSendAs(context.Background()); err == nil {
+			for _, s := range sendAs {
+				addresses = append(addresses, s.SendAsEmail)
+			}
+		}
+		return identityLoadedMsg{addresses: addresses}
 	}
+}
 
-	encoder := base64.NewEncoder(base64.StdEncoding, partWriter)
-	if _, err := io.Copy(encoder, file); err != nil {
-		return fmt.Errorf("failed to write attachment: %w", err)
+func deleteEmail(b MailBackend, msgID string) tea.Cmd {
+	return func() tea.Msg {
+		msg, err := b.TrashMessage(context.Background(), msgID)
+		if err != nil {
+			return emailLoadErrorMsg{err: fmt.Errorf("failed to move to trash: %w", err)}
+		}
+		return messagesModifiedMsg{
+			messages: []*gmail.Message{msg},
+			message:  "Email moved to trash",
+			undo:     &undoAction{note: "Moved to trash", ids: []string{msgID}, untrash: true},
+		}
 	}
+}
 
-	if err := encoder.Close(); err != nil {
-		return fmt.Errorf("failed to close encoder: %w", err)
+func toggleReadStatus(b MailBackend, msgID string, isUnread bool) tea.Cmd {
+	if isUnread {
+		return modifyMessage(b, msgID, nil, []string{"UNREAD"}, "Email marked as read")
 	}
+	return modifyMessage(b, msgID, []string{"UNREAD"}, nil, "Email marked as unread")
+}
 
-	return nil
+func performSearch(ctx context.Context, b MailBackend, query string) tea.Cmd {
+	return fetchMessagePage(ctx, b, query, nil, "", searchMaxResults, listReplace)
 }
 
-func downloadAttachment(srv *gmail.Service, msgID string, attachment *gmail.MessagePart) tea.Cmd {
+func loadLabels(b MailBackend) tea.Cmd {
 	return func() tea.Msg {
-		att, err := srv.Users.Messages.Attachments.Get("me", msgID, attachment.Body.AttachmentId).Do()
+		labels, err := b.ListLabels(context.Background())
 		if err != nil {
-			return notificationMsg{message: fmt.Sprintf("Download failed: %v", err)}
+			return emailLoadErrorMsg{err: err}
 		}
+		return labelsLoadedMsg{labels: labels}
+	}
+}
 
-		data, err := base64.RawURLEncoding.DecodeString(att.Data)
-		if err != nil {
-			return notificationMsg{message: fmt.Sprintf("Failed to decode: %v", err)}
+// saveLabel creates a label, or renames and recolors an existing one.
+// Renaming a parent label renames the labels nested under it too, since
+// Gmail only nests labels by name.
+func saveLabel(b MailBackend, labels []*gmail.Label, id, name string, color *gmail.LabelColor) tea.Cmd {
+	return func() tea.Msg {
+		ctx := context.Background()
+		if id == "" {
+			label := &gmail.Label{
+				Name:                  name,
+				Color:                 color,
+				LabelListVisibility:   "labelShow",
+				MessageListVisibility: "show",
+			}
+			if _, err := b.CreateLabel(ctx, label); err != nil {
+				return emailLoadErrorMsg{err: fmt.Errorf("failed to create label: %w", err)}
+			}
+			return refreshLabels(ctx, b, "Created label "+name)
 		}
 
-		if err := os.MkdirAll(downloadsDir, 0755); err != nil {
-			return notificationMsg{message: fmt.Sprintf("Couldn't create downloads directory: %v", err)}
+		oldName := labelName(labels, id)
+		if _, err := b.PatchLabel(ctx, id, &gmail.Label{Name: name, Color: color}); err != nil {
+			return emailLoadErrorMsg{err: fmt.Errorf("failed to update label: %w", err)}
+		}
+		if name != oldName {
+			for childID, childName := range renamedChildren(labels, oldName, name) {
+				if _, err := b.PatchLabel(ctx, childID, &gmail.Label{Name: childName}); err != nil {
+					return emailLoadErrorMsg{err: fmt.Errorf("failed to rename %s: %w", childName, err)}
+				}
+			}
 		}
+		return refreshLabels(ctx, b, "Updated label "+name)
+	}
+}
 
-		filename := filepath.Join(downloadsDir, sanitizeFilename(attachment.Filename))
-		if err := os.WriteFile(filename, data, 0644); err != nil {
-			return notificationMsg{message: fmt.Sprintf("Save failed: %v", err)}
+func deleteLabel(b MailBackend, label *gmail.Label) tea.Cmd {
+	return func() tea.Msg {
+		ctx := context.Background()
+		if err := b.DeleteLabel(ctx, label.Id); err != nil {
+			return emailLoadErrorMsg{err: fmt.Errorf("failed to delete label: %w", err)}
 		}
+		return refreshLabels(ctx, b, "Deleted label "+label.Name)
+	}
+}
 
-		return attachmentDownloadedMsg{filename: filename}
+// refreshLabels lists the labels again after a change
+func refreshLabels(ctx context.Context, b MailBackend, message string) tea.Msg {
+	labels, err := b.ListLabels(ctx)
+	if err != nil {
+		return emailLoadErrorMsg{err: err}
 	}
+	return labelsChangedMsg{labels: labels, message: message}
 }
 
-func deleteEmail(srv *gmail.Service, msgID string) tea.Cmd {
+// applyLabels adds and removes labels on each of the given messages
+func applyLabels(b MailBackend, msgIDs, add, remove []string) tea.Cmd {
 	return func() tea.Msg {
-		_, err := srv.Users.Messages.Trash("me", msgID).Do()
-		if err != nil {
-			return emailLoadErrorMsg{err: err}
+		req := &gmail.ModifyMessageRequest{AddLabelIds: add, RemoveLabelIds: remove}
+		var modified []*gmail.Message
+		for _, id := range msgIDs {
+			msg, err := b.ModifyMessage(context.Background(), id, req)
+			if err != nil {
+				return emailLoadErrorMsg{err: fmt.Errorf("failed to apply labels: %w", err)}
+			}
+			modified = append(modified, msg)
+		}
+		return messagesModifiedMsg{
+			messages: modified,
+			message:  "Labels updated",
+			undo:     &undoAction{note: "Labels updated", ids: msgIDs},
 		}
-		return notificationMsg{message: "Email moved to trash"}
 	}
 }
 
-func toggleReadStatus(srv *gmail.Service, msgID string, isUnread bool) tea.Cmd {
+// modifyMessage adds and removes labels on one message; note is shown once
+// the change is made
+func modifyMessage(b MailBackend, msgID string, add, remove []string, note string) tea.Cmd {
 	return func() tea.Msg {
-		mod := gmail.ModifyMessageRequest{}
-		if isUnread {
-			mod.RemoveLabelIds = []string{"UNREAD"}
-		} else {
-			mod.AddLabelIds = []string{"UNREAD"}
+		req := &gmail.ModifyMessageRequest{AddLabelIds: add, RemoveLabelIds: remove}
+		msg, err := b.ModifyMessage(context.Background(), msgID, req)
+		if err != nil {
+			return emailLoadErrorMsg{err: fmt.Errorf("failed to update message: %w", err)}
 		}
+		return messagesModifiedMsg{
+			messages: []*gmail.Message{msg},
+			message:  note,
+			undo:     &undoAction{note: note, ids: []string{msgID}},
+		}
+	}
+}
 
-		_, err := srv.Users.Messages.Modify("me", msgID, &mod).Do()
-		if err != nil {
-			return emailLoadErrorMsg{err: err}
+// modifyThread adds and removes labels on every message of a conversation
+func modifyThread(b MailBackend, threadID string, add, remove []string, note string) tea.Cmd {
+	return func() tea.Msg {
+		ctx := context.Background()
+		// Changes made without a note, like archiving new arrivals in a
+		// muted conversation, aren't the user's to undo
+		var undo *undoAction
+		if note != "" {
+			var err error
+			if undo, err = threadUndo(ctx, b, threadID, add, remove, note); err != nil {
+				return emailLoadErrorMsg{err: fmt.Errorf("failed to update conversation: %w", err)}
+			}
 		}
 
-		action := "marked as read"
-		if !isUnread {
-			action = "marked as unread"
+		req := &gmail.ModifyThreadRequest{AddLabelIds: add, RemoveLabelIds: remove}
+		if _, err := b.ModifyThread(ctx, threadID, req); err != nil {
+			return emailLoadErrorMsg{err: fmt.Errorf("failed to update conversation: %w", err)}
 		}
-		return notificationMsg{message: "Email " + action}
+		return threadModifiedMsg{threadID: threadID, add: add, remove: remove, message: note, undo: undo}
+	}
+}
+
+// threadUndo reads the labels of every message of a conversation, loaded
+// or not, and returns the undo for adding add and removing remove
+func threadUndo(ctx context.Context, b MailBackend, threadID string, add, remove []string, note string) (*undoAction, error) {
+	thread, err := b.GetThread(ctx, threadID, "minimal")
+	if err != nil {
+		return nil, err
 	}
+	before := make(map[string][]string, len(thread.Messages))
+	ids := make([]string, 0, len(thread.Messages))
+	for _, msg := range thread.Messages {
+		before[msg.Id] = msg.LabelIds
+		ids = append(ids, msg.Id)
+	}
+	undo := reverseLabels(note, before, ids, add, remove)
+	undo.threadID = threadID
+	return undo, nil
 }
 
-func performSearch(srv *gmail.Service, query string) tea.Cmd {
+// muteThread archives a conversation and tags it with the Muted label,
+// creating the label the first time
+func muteThread(b MailBackend, labels []*gmail.Label, threadID string) tea.Cmd {
 	return func() tea.Msg {
-		msgs, err := srv.Users.Messages.List("me").Q(query).MaxResults(30).Do()
+		ctx := context.Background()
+		var created *gmail.Label
+		muted := findLabelByName(labels, mutedLabelName)
+		if muted == nil {
+			label, err := b.CreateLabel(ctx, &gmail.Label{
+				Name:                  mutedLabelName,
+				LabelListVisibility:   "labelHide",
+				MessageListVisibility: "hide",
+			})
+			if err != nil {
+				return emailLoadErrorMsg{err: fmt.Errorf("failed to create %s label: %w", mutedLabelName, err)}
+			}
+			muted, created = label, label
+		}
+
+		add, remove := []string{muted.Id}, []string{"INBOX"}
+		undo, err := threadUndo(ctx, b, threadID, add, remove, "Conversation muted")
 		if err != nil {
-			return emailLoadErrorMsg{err: err}
+			return emailLoadErrorMsg{err: fmt.Errorf("failed to mute conversation: %w", err)}
+		}
+		req := &gmail.ModifyThreadRequest{AddLabelIds: add, RemoveLabelIds: remove}
+		if _, err := b.ModifyThread(ctx, threadID, req); err != nil {
+			return emailLoadErrorMsg{err: fmt.Errorf("failed to mute conversation: %w", err)}
+		}
+		return threadModifiedMsg{
+			threadID: threadID,
+			add:      add,
+			remove:   remove,
+			message:  "Conversation muted",
+			created:  created,
+			undo:     undo,
 		}
-		return searchResultMsg{messages: msgs.Messages}
 	}
 }
 
-func loadLabels(srv *gmail.Service) tea.Cmd {
+// loadMutedThreads finds all the conversations tagged with the Muted label
+func loadMutedThreads(b MailBackend, labels []*gmail.Label) tea.Cmd {
+	muted := findLabelByName(labels, mutedLabelName)
+	if muted == nil {
+		return nil
+	}
 	return func() tea.Msg {
-		labels, err := srv.Users.Labels.List("me").Do()
-		if err != nil {
-			return emailLoadErrorMsg{err: err}
+		var threadIDs []string
+		seen := make(map[string]bool)
+		pageToken := ""
+		for {
+			resp, err := b.ListMessages(context.Background(), "", []string{muted.Id}, pageToken, 500)
+			if err != nil {
+				return emailLoadErrorMsg{err: err}
+			}
+			for _, msg := range resp.Messages {
+				if !seen[msg.ThreadId] {
+					seen[msg.ThreadId] = true
+					threadIDs = append(threadIDs, msg.ThreadId)
+				}
+			}
+			if resp.NextPageToken == "" {
+				return mutedThreadsMsg{threadIDs: threadIDs}
+			}
+			pageToken = resp.NextPageToken
 		}
-		return labelsLoadedMsg{labels: labels.Labels}
 	}
 }
 
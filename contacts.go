@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/sahilm/fuzzy"
+)
+
+const (
+	contactsFile = "contacts.json"
+	// sentHarvestSize is how many recent Sent messages are read for contacts
+	sentHarvestSize = 100
+	// sentWeight makes people we write to outrank people who write to us
+	sentWeight = 3
+	// maxSuggestions is how many completions compose shows at once
+	maxSuggestions = 5
+	// maxSeenMessages caps the message IDs remembered; past it, those seen
+	// longest ago are forgotten
+	maxSeenMessages = 5000
+)
+
+// contact is an address book entry. Received and Sent count the messages
+// the address appeared on; LastSeen is the newest of them (ms since epoch).
+type contact struct {
+	Name     string `json:"name"`
+	Address  string `json:"address"`
+	Received int    `json:"received"`
+	Sent     int    `json:"sent"`
+	LastSeen int64  `json:"lastSeen"`
+}
+
+// score ranks contacts by how often and how recently we've seen them
+func (c contact) score(now time.Time) float64 {
+	ageDays := now.Sub(time.UnixMilli(c.LastSeen)).Hours() / 24
+	return float64(c.Received+sentWeight*c.Sent) / (1 + max(ageDays, 0)/30)
+}
+
+func (c contact) String() string {
+	return formatAddress(&mail.Address{Name: c.Name, Address: c.Address})
+}
+
+// addressBook collects contacts from message headers and persists them as
+// JSON. Messages are remembered by ID so that re-listing a folder doesn't
+// count the same message twice; only the most recent maxSeen are kept.
+type addressBook struct {
+	mu        sync.Mutex
+	path      string
+	contacts  map[string]*contact // keyed by lower-cased address
+	seen      map[string]bool
+	seenOrder []string // the keys of seen, oldest first
+	maxSeen   int
+	own       map[string]bool
+}
+
+type addressBookFile struct {
+	Contacts []*contact `json:"contacts"`
+	Seen     []string   `json:"seen"`
+}
+
+// newAddressBook returns an empty address book saved to path. With an
+// empty path the book lives only in memory.
+func newAddressBook(path string) *addressBook {
+	return &addressBook{
+		path:     path,
+		contacts: make(map[string]*contact),
+		seen:     make(map[string]bool),
+		maxSeen:  maxSeenMessages,
+		own:      make(map[string]bool),
+	}
+}
+
+// loadAddressBook reads the address book at path; a missing file is an
+// empty book
+func loadAddressBook(path string) (*addressBook, error) {
+	book := newAddressBook(path)
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return book, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read contacts: %w", err)
+	}
+
+	var file addressBookFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse contacts: %w", err)
+	}
+	for _, c := range file.Contacts {
+		book.contacts[strings.ToLower(c.Address)] = c
+	}
+	for _, id := range file.Seen {
+		if !book.seen[id] {
+			book.markSeen(id)
+		}
+	}
+	return book, nil
+}
+
+// Save writes the address book, creating its directory if needed
+func (a *addressBook) Save() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.path == "" {
+		return nil
+	}
+
+	file := addressBookFile{}
+	for _, c := range a.contacts {
+		file.Contacts = append(file.Contacts, c)
+	}
+	sort.Slice(file.Contacts, func(i, j int) bool { return file.Contacts[i].Address < file.Contacts[j].Address })
+	file.Seen = a.seenOrder
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode contacts: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(a.path), 0700); err != nil {
+		return fmt.Errorf("failed to create config directory: %w", err)
+	}
+	return writeFileAtomic(a.path, data, 0600)
+}
+
+// SetOwnAddresses records the user's own addresses, which are never
+// offered as contacts
+func (a *addressBook) SetOwnAddresses(addresses []string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, addr := range addresses {
+		a.own[strings.ToLower(addr)] = true
+	}
+}
+
+// Observe adds the sender and recipients of a received message. It
+// reports whether the message was new to the book.
+func (a *addressBook) Observe(item *emailItem) bool {
+	return a.observe(item, false, item.from, item.recipient, item.cc)
+}
+
+// ObserveSent adds the recipients of a message we sent
+func (a *addressBook) ObserveSent(item *emailItem) bool {
+	return a.observe(item, true, item.recipient, item.cc, item.bcc)
+}
+
+func (a *addressBook) observe(item *emailItem, sent bool, lists ...string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if item.id == "" || a.seen[item.id] {
+		return false
+	}
+	a.markSeen(item.id)
+
+	for _, list := range lists {
+		for _, addr := range splitAddresses(list) {
+			key := strings.ToLower(addr.Address)
+			if !strings.Contains(key, "@") {
+				continue
+			}
+			c, ok := a.contacts[key]
+			if !ok {
+				c = &contact{Address: addr.Address}
+				a.contacts[key] = c
+			}
+			if c.Name == "" {
+				c.Name = addr.Name
+			}
+			if sent {
+				c.Sent++
+			} else {
+				c.Received++
+			}
+			c.LastSeen = max(c.LastSeen, item.internalDate)
+		}
+	}
+	return true
+}
+
+// Contacts returns a copy of every contact, best ranked first
+func (a *addressBook) Contacts() []contact {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.ranked()
+}
+
+// ranked copies the contacts, so they can be used once a.mu is released.
+// It must be called with a.mu held.
+func (a *addressBook) ranked() []contact {
+	now := time.Now()
+	result := make([]contact, 0, len(a.contacts))
+	for key, c := range a.contacts {
+		if !a.own[key] {
+			result = append(result, *c)
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		si, sj := result[i].score(now), result[j].score(now)
+		if si != sj {
+			return si > sj
+		}
+		return result[i].Address < result[j].Address
+	})
+	return result
+}
+
+// contactSource adapts contacts for fuzzy matching on "Name <address>"
+type contactSource []contact
+
+func (s contactSource) String(i int) string { return s[i].Name + " " + s[i].Address }
+func (s contactSource) Len() int            { return len(s) }
+
+// Complete returns the contacts that fuzzily match query. Entries that
+// start with the query come first; otherwise better ranked contacts win.
+func (a *addressBook) Complete(query string) []contact {
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return nil
+	}
+
+	a.mu.Lock()
+	candidates := a.ranked()
+	a.mu.Unlock()
+
+	matches := fuzzy.FindFrom(query, contactSource(candidates))
+	sort.SliceStable(matches, func(i, j int) bool {
+		pi := hasPrefixFold(candidates[matches[i].Index], query)
+		pj := hasPrefixFold(candidates[matches[j].Index], query)
+		if pi != pj {
+			return pi
+		}
+		return matches[i].Index < matches[j].Index // ranked order
+	})
+
+	var result []contact
+	for _, match := range matches {
+		result = append(result, candidates[match.Index])
+		if len(result) == maxSuggestions {
+			break
+		}
+	}
+	return result
+}
+
+func hasPrefixFold(c contact, prefix string) bool {
+	prefix = strings.ToLower(prefix)
+	return strings.HasPrefix(strings.ToLower(c.Name), prefix) || strings.HasPrefix(strings.ToLower(c.Address), prefix)
+}
+
+// Update changes the name and address of the contact stored under
+// address. Changing the address onto an existing contact merges the two.
+func (a *addressBook) Update(address, name, newAddress string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	key, newKey := strings.ToLower(address), strings.ToLower(newAddress)
+	c, ok := a.contacts[key]
+	if !ok {
+		return fmt.Errorf("no contact %s", address)
+	}
+	if _, err := addressParser.Parse(newAddress); err != nil {
+		return fmt.Errorf("%q is not a valid address", newAddress)
+	}
+
+	c.Name = name
+	if newKey != key {
+		delete(a.contacts, key)
+		if existing, ok := a.contacts[newKey]; ok {
+			mergeContact(existing, c)
+			existing.Name = name
+			return nil
+		}
+		c.Address = newAddress
+		a.contacts[newKey] = c
+	}
+	return nil
+}
+
+// Merge folds the contact stored under from into the one under into,
+// keeping into's address and summing their counts
+func (a *addressBook) Merge(from, into string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	src, ok := a.contacts[strings.ToLower(from)]
+	if !ok {
+		return fmt.Errorf("no contact %s", from)
+	}
+	dst, ok := a.contacts[strings.ToLower(into)]
+	if !ok {
+		return fmt.Errorf("no contact %s", into)
+	}
+	if src == dst {
+		return nil
+	}
+	mergeContact(dst, src)
+	delete(a.contacts, strings.ToLower(from))
+	return nil
+}
+
+func mergeContact(dst, src *contact) {
+	dst.Received += src.Received
+	dst.Sent += src.Sent
+	dst.LastSeen = max(dst.LastSeen, src.LastSeen)
+	if dst.Name == "" {
+		dst.Name = src.Name
+	}
+}
+
+// Delete removes a contact. It comes back if it appears on new mail.
+func (a *addressBook) Delete(address string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.contacts, strings.ToLower(address))
+}
+
+func saveContacts(a *addressBook) tea.Cmd {
+	return func() tea.Msg {
+		return contactsSavedMsg{err: a.Save()}
+	}
+}
+
+// harvestSent adds the recipients of recent Sent mail to the address book
+func harvestSent(b MailBackend, a *addressBook) tea.Cmd {
+	return func() tea.Msg {
+		resp, err := b.ListMessages(context.Background(), "in:sent", nil, "", sentHarvestSize)
+		if err != nil {
+			return harvestFailedMsg{err: err}
+		}
+
+		for _, msg := range resp.Messages {
+			if a.isSeen(msg.Id) {
+				continue
+			}
+			// One that can't be read isn't marked seen, so it's tried again
+			// next time
+			if item, err := createEmailItem(context.Background(), b, msg.Id, "metadata"); err == nil && item != nil {
+				a.ObserveSent(item)
+			}
+		}
+		return contactsSavedMsg{err: a.Save()}
+	}
+}
+
+// markSeen remembers a message ID, forgetting the oldest tenth once there
+// are more than maxSeen. It must be called with a.mu held.
+func (a *addressBook) markSeen(id string) {
+	a.seen[id] = true
+	a.seenOrder = append(a.seenOrder, id)
+	if len(a.seenOrder) <= a.maxSeen {
+		return
+	}
+
+	drop := len(a.seenOrder) - a.maxSeen*9/10
+	for _, old := range a.seenOrder[:drop] {
+		delete(a.seen, old)
+	}
+	a.seenOrder = append([]string(nil), a.seenOrder[drop:]...)
+}
+
+func (a *addressBook) isSeen(id string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.seen[id]
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// TestCompleteWhileObserving runs completion against harvesting, which
+// `go test -race` catches if they share contacts
+func TestCompleteWhileObserving(t *testing.T) {
+	book := newAddressBook("")
+	book.Observe(&emailItem{id: "first", from: "Alice <alice@example.com>"})
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			book.Observe(&emailItem{id: fmt.Sprint(i), from: "Alicia <alice@example.com>", internalDate: int64(i)})
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		for _, c := range book.Complete("ali") {
+			_ = c.String()
+		}
+		_ = book.Contacts()
+	}
+	wg.Wait()
+
+	got := book.Complete("ali")
+	if len(got) != 1 || got[0].Received != 201 {
+		t.Errorf("Complete = %+v, want alice seen 201 times", got)
+	}
+}
+
+func TestSeenMessagesAreCapped(t *testing.T) {
+	path := filepath.Join(t.TempDir(), contactsFile)
+	book := newAddressBook(path)
+	book.maxSeen = 10
+	for i := 0; i < 25; i++ {
+		book.Observe(&emailItem{id: fmt.Sprint("m", i), from: "alice@example.com"})
+	}
+	if len(book.seen) > book.maxSeen {
+		t.Errorf("%d IDs remembered, want at most %d", len(book.seen), book.maxSeen)
+	}
+	if !book.isSeen("m24") || book.isSeen("m0") {
+		t.Error("the newest IDs should be kept and the oldest dropped")
+	}
+	if book.Observe(&emailItem{id: "m24", from: "alice@example.com"}) {
+		t.Error("a remembered message was counted again")
+	}
+
+	if err := book.Save(); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadAddressBook(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.seenOrder) != len(book.seenOrder) || loaded.seenOrder[len(loaded.seenOrder)-1] != "m24" {
+		t.Errorf("reloaded IDs %q, want %q", loaded.seenOrder, book.seenOrder)
+	}
+}
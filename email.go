@@ -1,69 +1,84 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
-	"log"
-	"regexp"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
 	"strings"
 	"time"
 
+	"github.com/charmbracelet/bubbles/list"
 	"google.golang.org/api/gmail/v1"
 )
 
-// createEmailItem fetches and converts a Gmail message to an emailItem
-func createEmailItem(srv *gmail.Service, msgID string, minimal bool) *emailItem {
-	if srv == nil {
-		log.Println("Gmail service is not initialized")
-		return nil
+// createEmailItem fetches a message in the given format and converts it to
+// an emailItem. A cancelled fetch returns neither an item nor an error.
+func createEmailItem(ctx context.Context, b MailBackend, msgID string, format string) (*emailItem, error) {
+	if b == nil {
+		return nil, errors.New("mail backend is not initialized")
 	}
 
-	format := "full"
-	if minimal {
-		format = "minimal"
+	msg, err := b.GetMessage(ctx, msgID, format)
+	if isCanceled(err) {
+		return nil, nil
 	}
-
-	msg, err := srv.Users.Messages.Get("me", msgID).Format(format).Do()
 	if err != nil {
-		log.Printf("Error fetching message %s: %v\n", msgID, err)
-		return nil
+		return nil, fmt.Errorf("failed to fetch message %s: %w", msgID, err)
 	}
 
 	if msg == nil {
-		log.Printf("Received nil message for ID %s\n", msgID)
-		return nil
+		return nil, fmt.Errorf("received nil message for ID %s", msgID)
 	}
 
+	return newEmailItem(msg), nil
+}
+
+// newEmailItem converts a Gmail message to an emailItem. The body and
+// attachments are only filled in when the message was fetched in full format.
+func newEmailItem(msg *gmail.Message) *emailItem {
 	item := &emailItem{
-		id:       msg.Id,
-		threadId: msg.ThreadId,
-		snippet:  msg.Snippet,
+		id:           msg.Id,
+		threadId:     msg.ThreadId,
+		snippet:      msg.Snippet,
+		internalDate: msg.InternalDate,
 	}
 
 	// Extract headers
 	if msg.Payload != nil {
 		for _, h := range msg.Payload.Headers {
-			switch h.Name {
+			switch textproto.CanonicalMIMEHeaderKey(h.Name) {
 			case "Subject":
-				item.subject = h.Value
+				item.subject = decodeHeader(h.Value)
 			case "From":
-				item.from = h.Value
+				item.from = decodeAddressHeader(h.Value)
 			case "Date":
 				item.date = formatDate(h.Value)
 			case "To":
-				item.recipient = h.Value
+				item.recipient = decodeAddressHeader(h.Value)
 			case "Cc":
-				item.cc = h.Value
+				item.cc = decodeAddressHeader(h.Value)
 			case "Bcc":
-				item.bcc = h.Value
+				item.bcc = decodeAddressHeader(h.Value)
+			case "Reply-To":
+				item.replyTo = decodeAddressHeader(h.Value)
+			case "Message-Id":
+				item.messageID = h.Value
+			case "References":
+				item.references = h.Value
 			}
 		}
 
-		// Extract body and attachments for full format
-		if !minimal {
-			item.body = extractPlainText(msg.Payload)
-			item.attachments = findAttachments(msg.Payload)
-		}
+		// Metadata responses carry headers only, so these stay empty for them
+		item.body = extractPlainText(msg.Payload)
+		item.attachments = findAttachments(msg.Payload)
 	}
 
 	// Process labels
@@ -82,6 +97,40 @@ func createEmailItem(srv *gmail.Service, msgID string, minimal bool) *emailItem
 	return item
 }
 
+// senderName returns the display name of an address, or the address itself
+func senderName(from string) string {
+	addr, err := addressParser.Parse(from)
+	if err != nil {
+		return from
+	}
+	if addr.Name != "" {
+		return addr.Name
+	}
+	return addr.Address
+}
+
+// groupThreads collapses message rows into one row per thread, ordered by
+// each thread's newest message
+func groupThreads(items []list.Item) []list.Item {
+	var threads []list.Item
+	index := make(map[string]int)
+	for _, item := range items {
+		e, ok := item.(emailItem)
+		if !ok {
+			continue
+		}
+		if i, seen := index[e.threadId]; seen {
+			t := threads[i].(threadItem)
+			t.messages = append(t.messages, e)
+			threads[i] = t
+			continue
+		}
+		index[e.threadId] = len(threads)
+		threads = append(threads, threadItem{threadId: e.threadId, messages: []emailItem{e}})
+	}
+	return threads
+}
+
 // findAttachments recursively finds all attachments in a message part
 func findAttachments(part *gmail.MessagePart) []*gmail.MessagePart {
 	var attachments []*gmail.MessagePart
@@ -97,38 +146,28 @@ func findAttachments(part *gmail.MessagePart) []*gmail.MessagePart {
 	return attachments
 }
 
-// fetchFullEmailBody retrieves the complete email content for viewing
-func fetchFullEmailBody(srv *gmail.Service, msgID string) (string, error) {
-	msg, err := srv.Users.Messages.Get("me", msgID).Format("full").Do()
+// fetchFullEmailBody retrieves the complete email for viewing, returning
+// the parsed item along with the text shown in the viewer
+func fetchFullEmailBody(ctx context.Context, b MailBackend, msgID string) (*emailItem, string, error) {
+	msg, err := b.GetMessage(ctx, msgID, "full")
 	if err != nil {
-		return "", fmt.Errorf("failed to fetch message: %w", err)
-	}
-
-	var from, subject, date string
-	for _, h := range msg.Payload.Headers {
-		switch h.Name {
-		case "From":
-			from = h.Value
-		case "Subject":
-			subject = h.Value
-		case "Date":
-			date = formatDate(h.Value)
-		}
+		return nil, "", fmt.Errorf("failed to fetch message: %w", err)
 	}
 
-	body := extractPlainText(msg.Payload)
+	item := newEmailItem(msg)
+	body := item.body
 	if body == "" {
 		body = "(no text content found)"
 	}
 
-	return fmt.Sprintf("From: %s\nSubject: %s\nDate: %s\n\n%s",
-		from, subject, date, body), nil
+	return item, fmt.Sprintf("From: %s\nSubject: %s\nDate: %s\n\n%s",
+		item.from, item.subject, item.date, body), nil
 }
 
 // extractPlainText recursively extracts plain text from a message part
 func extractPlainText(payload *gmail.MessagePart) string {
 	if payload.MimeType == "text/plain" && payload.Body != nil && payload.Body.Data != "" {
-		return decodeBody(payload.Body.Data)
+		return decodeBody(payload)
 	}
 
 	// Handle multipart messages
@@ -154,19 +193,24 @@ func extractPlainText(payload *gmail.MessagePart) string {
 
 	// Handle HTML content
 	if payload.MimeType == "text/html" && payload.Body != nil && payload.Body.Data != "" {
-		htmlContent := decodeBody(payload.Body.Data)
-		return stripHTML(htmlContent)
+		return renderHTML(decodeBody(payload))
 	}
 
 	return ""
 }
 
-// decodeBody decodes base64-encoded email body
-func decodeBody(body string) string {
-	// Add padding if needed
-	if len(body)%4 != 0 {
-		body += strings.Repeat("=", (4-len(body)%4)%4)
+// padBase64 adds the padding Gmail sometimes leaves off base64url data
+func padBase64(data string) string {
+	if len(data)%4 != 0 {
+		data += strings.Repeat("=", (4-len(data)%4)%4)
 	}
+	return data
+}
+
+// decodeBody decodes a part's base64-encoded body and converts it to UTF-8
+// from the charset in its Content-Type
+func decodeBody(part *gmail.MessagePart) string {
+	body := padBase64(part.Body.Data)
 
 	decoded, err := base64.URLEncoding.DecodeString(body)
 	if err != nil {
@@ -175,35 +219,18 @@ func decodeBody(body string) string {
 			return "Failed to decode body."
 		}
 	}
-	return string(decoded)
+	return toUTF8(decoded, partContentType(part))
 }
 
-// stripHTML removes HTML tags and decodes entities
-func stripHTML(input string) string {
-	// Remove HTML tags
-	re := regexp.MustCompile(`<[^>]*>`)
-	input = re.ReplaceAllString(input, "")
-
-	// Decode HTML entities
-	entities := map[string]string{
-		"&nbsp;":  " ",
-		"&lt;":    "<",
-		"&gt;":    ">",
-		"&amp;":   "&",
-		"&quot;":  "\"",
-		"&apos;":  "'",
-		"&#39;":   "'",
-		"&ndash;": "-",
-		"&mdash;": "—",
-	}
-
-	for entity, replacement := range entities {
-		input = strings.ReplaceAll(input, entity, replacement)
+// partContentType returns a part's full Content-Type header, parameters
+// included, falling back to its bare MIME type
+func partContentType(part *gmail.MessagePart) string {
+	for _, h := range part.Headers {
+		if strings.EqualFold(h.Name, "Content-Type") {
+			return h.Value
+		}
 	}
-
-	// Collapse whitespace
-	input = regexp.MustCompile(`\s+`).ReplaceAllString(input, " ")
-	return strings.TrimSpace(input)
+	return part.MimeType
 }
 
 // formatDate parses and formats email dates
@@ -227,6 +254,152 @@ func formatDate(dateStr string) string {
 	return dateStr
 }
 
+// replySubject prefixes subject with a single "Re: ", dropping any reply
+// prefixes it already carries
+func replySubject(subject string) string {
+	s := strings.TrimSpace(subject)
+	for {
+		prefix, rest, found := strings.Cut(s, ":")
+		if !found || !isReplyPrefix(prefix) {
+			break
+		}
+		s = strings.TrimSpace(rest)
+	}
+	return "Re: " + s
+}
+
+// isReplyPrefix matches "Re", "RE" and counted forms like "Re[2]"
+func isReplyPrefix(prefix string) bool {
+	p := strings.ToLower(strings.TrimSpace(prefix))
+	if i := strings.IndexByte(p, '['); i > 0 && strings.HasSuffix(p, "]") {
+		p = p[:i]
+	}
+	return p == "re"
+}
+
+// newReply builds a reply to original that threads correctly: it answers
+// Reply-To when present, chains Message-ID into References and quotes the
+// original body
+func newReply(original *emailItem, reply string, attachments []outgoingAttachment) outgoingEmail {
+	to := original.replyTo
+	if to == "" {
+		to = original.from
+	}
+
+	references := strings.TrimSpace(original.references + " " + original.messageID)
+
+	body := reply
+	if original.body != "" {
+		body += fmt.Sprintf("\n\nOn %s, %s wrote:\n%s",
+			original.date, original.from, indentText(strings.TrimRight(original.body, "\r\n")))
+	}
+
+	return outgoingEmail{
+		to:          to,
+		subject:     replySubject(original.subject),
+		body:        body,
+		attachments: attachments,
+		threadID:    original.threadId,
+		inReplyTo:   original.messageID,
+		references:  references,
+	}
+}
+
+// newReplyAll is newReply addressed to everyone on the original message
+// except the user's own addresses
+func newReplyAll(original *emailItem, own []string, reply string, attachments []outgoingAttachment) outgoingEmail {
+	email := newReply(original, reply, attachments)
+
+	seen := make(map[string]bool)
+	for _, addr := range own {
+		seen[strings.ToLower(addr)] = true
+	}
+	email.to = uniqueAddresses(email.to+", "+original.recipient, seen)
+	email.cc = uniqueAddresses(original.cc, seen)
+
+	// Replying to our own message: the original recipients become To
+	if email.to == "" {
+		email.to, email.cc = email.cc, ""
+	}
+	return email
+}
+
+// uniqueAddresses returns the addresses in list that aren't in seen,
+// adding each one to seen
+func uniqueAddresses(list string, seen map[string]bool) string {
+	var result []string
+	for _, addr := range splitAddresses(list) {
+		key := strings.ToLower(addr.Address)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		result = append(result, formatAddress(addr))
+	}
+	return strings.Join(result, ", ")
+}
+
+// splitAddresses parses an address list header, falling back to plain
+// comma splitting for headers that aren't RFC 5322 clean
+func splitAddresses(list string) []*mail.Address {
+	if strings.TrimSpace(strings.Trim(list, ", ")) == "" {
+		return nil
+	}
+	if addrs, err := addressParser.ParseList(list); err == nil {
+		return addrs
+	}
+
+	var addrs []*mail.Address
+	for _, part := range strings.Split(list, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			if addr, err := addressParser.Parse(part); err == nil {
+				addrs = append(addrs, addr)
+			} else {
+				addrs = append(addrs, &mail.Address{Address: part})
+			}
+		}
+	}
+	return addrs
+}
+
+// formatAddress renders an address for display and editing. Unlike
+// mail.Address.String it leaves non-ASCII names readable, quoting the name
+// only when it contains characters that would break address parsing.
+func formatAddress(addr *mail.Address) string {
+	if addr.Name == "" {
+		return addr.Address
+	}
+	name := addr.Name
+	if strings.ContainsAny(name, `"(),.:;<>@[\]`) {
+		name = quoteDisplayName(name)
+	}
+	return name + " <" + addr.Address + ">"
+}
+
+// forwardSubject prefixes subject with "Fwd: " unless it already has one
+func forwardSubject(subject string) string {
+	lower := strings.ToLower(strings.TrimSpace(subject))
+	if strings.HasPrefix(lower, "fwd:") || strings.HasPrefix(lower, "fw:") {
+		return subject
+	}
+	return "Fwd: " + subject
+}
+
+// forwardBody is the header block and text of a forwarded message
+func forwardBody(original *emailItem) string {
+	var b strings.Builder
+	b.WriteString("\n\n---------- Forwarded message ---------\n")
+	b.WriteString(fmt.Sprintf("From: %s\n", original.from))
+	b.WriteString(fmt.Sprintf("Date: %s\n", original.date))
+	b.WriteString(fmt.Sprintf("Subject: %s\n", original.subject))
+	b.WriteString(fmt.Sprintf("To: %s\n", original.recipient))
+	if original.cc != "" {
+		b.WriteString(fmt.Sprintf("Cc: %s\n", original.cc))
+	}
+	b.WriteString("\n" + original.body)
+	return b.String()
+}
+
 // indentText adds "> " prefix to each line for quoted text
 func indentText(text string) string {
 	lines := strings.Split(text, "\n")
@@ -235,3 +408,78 @@ func indentText(text string) string {
 	}
 	return strings.Join(lines, "\n")
 }
+
+// parseRawMessage reads a base64url encoded MIME message, as returned in
+// the "raw" format, back into an outgoingEmail
+func parseRawMessage(raw string) (outgoingEmail, error) {
+	data, err := base64.URLEncoding.DecodeString(padBase64(raw))
+	if err != nil {
+		return outgoingEmail{}, fmt.Errorf("failed to decode message: %w", err)
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return outgoingEmail{}, fmt.Errorf("failed to parse message: %w", err)
+	}
+
+	email := outgoingEmail{
+		to:         decodeAddressHeader(msg.Header.Get("To")),
+		cc:         decodeAddressHeader(msg.Header.Get("Cc")),
+		bcc:        decodeAddressHeader(msg.Header.Get("Bcc")),
+		subject:    decodeHeader(msg.Header.Get("Subject")),
+		inReplyTo:  msg.Header.Get("In-Reply-To"),
+		references: msg.Header.Get("References"),
+	}
+	if err := readMIMEPart(textproto.MIMEHeader(msg.Header), msg.Body, &email); err != nil {
+		return outgoingEmail{}, fmt.Errorf("failed to parse message body: %w", err)
+	}
+	return email, nil
+}
+
+// readMIMEPart walks a MIME tree, keeping the first plain text part as the
+// body and every named part as an attachment
+func readMIMEPart(header textproto.MIMEHeader, body io.Reader, email *outgoingEmail) error {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := reader.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := readMIMEPart(part.Header, part, email); err != nil {
+				return err
+			}
+		}
+	}
+
+	switch strings.ToLower(header.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+
+	_, disposition, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	name := disposition["filename"]
+	if name == "" {
+		name = params["name"]
+	}
+	if name != "" {
+		email.attachments = append(email.attachments, outgoingAttachment{name: name, mimeType: mediaType, data: data})
+	} else if mediaType == "text/plain" && email.body == "" {
+		email.body = strings.TrimSuffix(strings.ReplaceAll(toUTF8(data, header.Get("Content-Type")), "\r\n", "\n"), "\n")
+	}
+	return nil
+}
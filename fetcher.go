@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/charmbracelet/bubbles/list"
+	tea "github.com/charmbracelet/bubbletea"
+	"google.golang.org/api/gmail/v1"
+)
+
+// metadataWorkers bounds the number of concurrent Messages.Get calls
+const metadataWorkers = 8
+
+// itemStream carries list rows from the fetch workers to the UI goroutine
+type itemStream struct {
+	results chan fetchedItem
+	total   int
+	fetched int
+}
+
+// fetchedItem is one message's row, or why it couldn't be loaded. Both are
+// nil for a fetch that was cancelled.
+type fetchedItem struct {
+	item *emailItem
+	err  error
+}
+
+// itemsFetchedMsg delivers the rows that arrived since the previous message
+type itemsFetchedMsg struct {
+	stream *itemStream
+	items  []emailItem
+	errs   []error
+	count  int
+	done   bool
+}
+
+// startItemFetch fetches metadata for msgs on a bounded worker pool and
+// streams the resulting rows back to Update as they complete. Cancelling
+// ctx stops the workers and ends the stream early.
+func startItemFetch(ctx context.Context, b MailBackend, msgs []*gmail.Message) (*itemStream, tea.Cmd) {
+	stream := &itemStream{
+		results: make(chan fetchedItem, len(msgs)),
+		total:   len(msgs),
+	}
+
+	ids := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < min(metadataWorkers, len(msgs)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range ids {
+				item, err := createEmailItem(ctx, b, id, "metadata")
+				stream.results <- fetchedItem{item, err}
+			}
+		}()
+	}
+
+	go func() {
+	feed:
+		for _, msg := range msgs {
+			select {
+			case ids <- msg.Id:
+			case <-ctx.Done():
+				break feed
+			}
+		}
+		close(ids)
+		wg.Wait()
+		close(stream.results)
+	}()
+
+	return stream, waitForItems(stream)
+}
+
+// waitForItems blocks for the next result, then drains whatever else is
+// already available so the list is updated in batches rather than per row.
+func waitForItems(stream *itemStream) tea.Cmd {
+	return func() tea.Msg {
+		msg := itemsFetchedMsg{stream: stream}
+
+		item, ok := <-stream.results
+		if !ok {
+			msg.done = true
+			return msg
+		}
+		msg.add(item)
+
+		for {
+			select {
+			case item, ok := <-stream.results:
+				if !ok {
+					msg.done = true
+					return msg
+				}
+				msg.add(item)
+			default:
+				return msg
+			}
+		}
+	}
+}
+
+func (msg *itemsFetchedMsg) add(result fetchedItem) {
+	msg.count++
+	if result.item != nil {
+		msg.items = append(msg.items, *result.item)
+	}
+	if result.err != nil {
+		msg.errs = append(msg.errs, result.err)
+	}
+}
+
+// fetchEach calls fetch for every ID on up to metadataWorkers goroutines.
+// Results and errors come back in the order of ids; a failed fetch leaves the
+// zero value and its error at that index.
+func fetchEach[T any](ctx context.Context, ids []string, fetch func(context.Context, string) (T, error)) ([]T, []error) {
+	results := make([]T, len(ids))
+	errs := make([]error, len(ids))
+
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < min(metadataWorkers, len(ids)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				results[i], errs[i] = fetch(ctx, ids[i])
+			}
+		}()
+	}
+
+feed:
+	for i := range ids {
+		select {
+		case next <- i:
+		case <-ctx.Done():
+			for j := i; j < len(ids); j++ {
+				errs[j] = ctx.Err()
+			}
+			break feed
+		}
+	}
+	close(next)
+	wg.Wait()
+	return results, errs
+}
+
+// upsertItem replaces the row with the same ID, or inserts item by date
+func upsertItem(items []list.Item, item emailItem) []list.Item {
+	for i, existing := range items {
+		if e, ok := existing.(emailItem); ok && e.id == item.id {
+			items[i] = item
+			return items
+		}
+	}
+	return insertByDate(items, item)
+}
+
+// keepListedItems drops rows whose message is no longer part of msgs
+func keepListedItems(items []list.Item, msgs []*gmail.Message) []list.Item {
+	listed := make(map[string]bool, len(msgs))
+	for _, msg := range msgs {
+		listed[msg.Id] = true
+	}
+
+	kept := make([]list.Item, 0, len(items))
+	for _, item := range items {
+		if e, ok := item.(emailItem); ok && listed[e.id] {
+			kept = append(kept, item)
+		}
+	}
+	return kept
+}
+
+// insertByDate inserts item keeping the list ordered newest first
+func insertByDate(items []list.Item, item emailItem) []list.Item {
+	pos := len(items)
+	for i, existing := range items {
+		if e, ok := existing.(emailItem); ok && e.internalDate < item.internalDate {
+			pos = i
+			break
+		}
+	}
+	items = append(items, nil)
+	copy(items[pos+1:], items[pos:])
+	items[pos] = item
+	return items
+}
+
+// itemIndex returns the position of the row for msgID, or -1
+func itemIndex(items []list.Item, msgID string) int {
+	for i, item := range items {
+		if e, ok := item.(emailItem); ok && e.id == msgID {
+			return i
+		}
+	}
+	return -1
+}
+
+func removeItem(items []list.Item, msgID string) []list.Item {
+	if i := itemIndex(items, msgID); i >= 0 {
+		return append(items[:i], items[i+1:]...)
+	}
+	return items
+}
+
+// withLabels returns item with its label-derived fields replaced
+func withLabels(item emailItem, labelIDs []string) emailItem {
+	item.labels = append([]string(nil), labelIDs...)
+	item.isUnread = containsString(labelIDs, "UNREAD")
+	return item
+}
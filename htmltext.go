@@ -0,0 +1,425 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// maxTableCell is the widest a cell may be for a table to be laid out as
+// columns; anything wider is a layout table and is rendered as blocks
+const maxTableCell = 40
+
+// htmlRenderer turns an HTML document into readable plain text: blocks
+// become paragraphs, lists get markers, quotes get "> " and links are
+// collected as numbered footnotes.
+type htmlRenderer struct {
+	b       strings.Builder
+	prefix  string // written at the start of every line (quote markers, list indent)
+	started bool   // the current line has content
+	blank   bool   // a blank line is owed before the next line of text
+	opened  bool   // nothing but a quote or list marker since a block began
+	space   bool   // whitespace is pending before the next word
+	pre     int
+	lists   []int // item counters of the enclosing lists; -1 for unordered
+	links   *[]string
+}
+
+// renderHTML converts an HTML body to plain text for the viewer
+func renderHTML(input string) string {
+	doc, err := html.Parse(strings.NewReader(input))
+	if err != nil {
+		return input
+	}
+
+	var links []string
+	r := &htmlRenderer{links: &links}
+	r.render(doc)
+
+	text := strings.TrimSpace(r.b.String())
+	if len(links) > 0 {
+		text += "\n\n"
+		for i, link := range links {
+			text += fmt.Sprintf("[%d] %s\n", i+1, link)
+		}
+	}
+	return strings.TrimRight(text, "\n")
+}
+
+func (r *htmlRenderer) render(n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		r.text(n.Data)
+		return
+	case html.ElementNode:
+		r.element(n)
+		return
+	}
+	r.children(n)
+}
+
+func (r *htmlRenderer) children(n *html.Node) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		r.render(c)
+	}
+}
+
+func (r *htmlRenderer) element(n *html.Node) {
+	if isHidden(n) {
+		return
+	}
+
+	switch n.DataAtom {
+	case atom.Script, atom.Style, atom.Head, atom.Title, atom.Template, atom.Noscript:
+		return
+
+	case atom.Br:
+		r.newline()
+
+	case atom.P, atom.Dl, atom.Figure:
+		r.paragraph()
+		r.children(n)
+		r.paragraph()
+
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		r.paragraph()
+		r.write(strings.Repeat("#", int(n.Data[1]-'0')) + " ")
+		r.children(n)
+		r.paragraph()
+
+	case atom.Blockquote:
+		r.paragraph()
+		r.flushBlank()
+		r.opened = true
+		saved := r.prefix
+		r.prefix += "> "
+		r.children(n)
+		r.breakLine()
+		r.prefix = saved
+		r.paragraph()
+
+	case atom.Pre:
+		r.paragraph()
+		r.pre++
+		r.children(n)
+		r.pre--
+		r.paragraph()
+
+	case atom.Hr:
+		r.paragraph()
+		r.write(strings.Repeat("─", 20))
+		r.paragraph()
+
+	case atom.Ul, atom.Ol:
+		counter := -1
+		if n.DataAtom == atom.Ol {
+			counter = 0
+		}
+		if len(r.lists) == 0 {
+			r.paragraph()
+		} else {
+			r.breakLine()
+		}
+		r.lists = append(r.lists, counter)
+		r.children(n)
+		r.lists = r.lists[:len(r.lists)-1]
+		if len(r.lists) == 0 {
+			r.paragraph()
+		} else {
+			r.breakLine()
+		}
+
+	case atom.Li:
+		r.listItem(n)
+
+	case atom.Table:
+		r.table(n)
+
+	case atom.A:
+		r.children(n)
+		r.link(n)
+
+	case atom.Img:
+		if alt := strings.TrimSpace(attr(n, "alt")); alt != "" {
+			r.text("[" + alt + "]")
+		}
+
+	case atom.Div, atom.Section, atom.Article, atom.Header, atom.Footer, atom.Main,
+		atom.Nav, atom.Aside, atom.Address, atom.Center, atom.Form, atom.Fieldset,
+		atom.Tr, atom.Dt, atom.Dd, atom.Caption:
+		r.breakLine()
+		r.children(n)
+		r.breakLine()
+
+	case atom.Td, atom.Th:
+		// Cells of a layout table share a line; keep them apart
+		r.space = true
+		r.children(n)
+		r.space = true
+
+	default:
+		r.children(n)
+	}
+}
+
+func (r *htmlRenderer) listItem(n *html.Node) {
+	marker := "• "
+	if depth := len(r.lists); depth > 0 && r.lists[depth-1] >= 0 {
+		r.lists[depth-1]++
+		marker = fmt.Sprintf("%d. ", r.lists[depth-1])
+	}
+
+	r.breakLine()
+	r.write(marker)
+	r.opened = true
+	saved := r.prefix
+	r.prefix += strings.Repeat(" ", utf8.RuneCountInString(marker))
+	r.space = false
+	r.children(n)
+	r.breakLine()
+	r.prefix = saved
+}
+
+// link adds href as a footnote unless the link text already shows it
+func (r *htmlRenderer) link(n *html.Node) {
+	href := strings.TrimSpace(attr(n, "href"))
+	if !strings.HasPrefix(href, "http://") && !strings.HasPrefix(href, "https://") && !strings.HasPrefix(href, "mailto:") {
+		return
+	}
+	text := strings.TrimSpace(nodeText(n))
+	if text == href || "mailto:"+text == href {
+		return
+	}
+
+	*r.links = append(*r.links, href)
+	r.text(fmt.Sprintf("[%d]", len(*r.links)))
+}
+
+// table lays simple data tables out in aligned columns. Tables used for
+// page layout, with long or nested content, are rendered cell by cell.
+func (r *htmlRenderer) table(n *html.Node) {
+	if isLayoutTable(n) {
+		r.breakLine()
+		r.children(n)
+		r.breakLine()
+		return
+	}
+
+	var rows [][]string
+	for _, row := range tableRows(n) {
+		var cells []string
+		for _, c := range rowCells(row) {
+			cell := &htmlRenderer{links: r.links}
+			cell.children(c)
+			cells = append(cells, strings.TrimSpace(cell.b.String()))
+		}
+		if len(cells) > 0 {
+			rows = append(rows, cells)
+		}
+	}
+
+	var widths []int
+	for _, cells := range rows {
+		for i, cell := range cells {
+			if i >= len(widths) {
+				widths = append(widths, 0)
+			}
+			widths[i] = max(widths[i], utf8.RuneCountInString(cell))
+		}
+	}
+
+	r.paragraph()
+	for _, cells := range rows {
+		var line strings.Builder
+		for i, cell := range cells {
+			if i > 0 {
+				line.WriteString(" | ")
+			}
+			line.WriteString(cell)
+			if i < len(cells)-1 {
+				line.WriteString(strings.Repeat(" ", widths[i]-utf8.RuneCountInString(cell)))
+			}
+		}
+		r.write(line.String())
+		r.newline()
+	}
+	r.paragraph()
+}
+
+// text writes character data, collapsing whitespace outside <pre>
+func (r *htmlRenderer) text(s string) {
+	if r.pre > 0 {
+		for i, line := range strings.Split(s, "\n") {
+			if i > 0 {
+				r.newline()
+			}
+			if line != "" {
+				r.write(line)
+			}
+		}
+		return
+	}
+
+	words := strings.Fields(s)
+	if len(words) == 0 {
+		if s != "" {
+			r.space = true
+		}
+		return
+	}
+	if first, _ := utf8.DecodeRuneInString(s); unicode.IsSpace(first) {
+		r.space = true
+	}
+	for i, word := range words {
+		if i > 0 || (r.space && r.started) {
+			r.write(" ")
+		}
+		r.write(word)
+	}
+	last, _ := utf8.DecodeLastRuneInString(s)
+	r.space = unicode.IsSpace(last)
+}
+
+// write appends s to the current line, starting it with the prefix
+func (r *htmlRenderer) write(s string) {
+	if !r.started {
+		r.flushBlank()
+		r.b.WriteString(r.prefix)
+		r.started = true
+	}
+	r.b.WriteString(s)
+	r.space = false
+	r.opened = false
+}
+
+func (r *htmlRenderer) newline() {
+	if !r.started {
+		r.b.WriteString(strings.TrimRight(r.prefix, " "))
+	}
+	r.b.WriteString("\n")
+	r.started = false
+	r.space = false
+}
+
+// flushBlank writes the blank line owed by the last paragraph
+func (r *htmlRenderer) flushBlank() {
+	if r.blank && r.b.Len() > 0 {
+		r.b.WriteString(strings.TrimRight(r.prefix, " ") + "\n")
+	}
+	r.blank = false
+}
+
+// breakLine ends the current line, if anything is on it
+func (r *htmlRenderer) breakLine() {
+	if r.started && !r.opened {
+		r.newline()
+	}
+}
+
+// paragraph ends the current line and asks for a blank line before the
+// next one. The blank line is written lazily so it picks up the prefix of
+// whatever comes next, rather than that of the block just closed.
+func (r *htmlRenderer) paragraph() {
+	if r.opened {
+		return
+	}
+	r.breakLine()
+	r.blank = true
+}
+
+// isHidden reports elements marked invisible, such as the preview text
+// many newsletters put at the top of the body
+func isHidden(n *html.Node) bool {
+	if _, ok := findAttr(n, "hidden"); ok {
+		return true
+	}
+	style := strings.ReplaceAll(strings.ToLower(attr(n, "style")), " ", "")
+	return strings.Contains(style, "display:none")
+}
+
+func attr(n *html.Node, name string) string {
+	value, _ := findAttr(n, name)
+	return value
+}
+
+func findAttr(n *html.Node, name string) (string, bool) {
+	for _, a := range n.Attr {
+		if a.Key == name {
+			return a.Val, true
+		}
+	}
+	return "", false
+}
+
+// nodeText returns the text content of n and its descendants
+func nodeText(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+	var b strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		b.WriteString(nodeText(c))
+	}
+	return b.String()
+}
+
+// isLayoutTable reports whether a table is used for page layout rather
+// than data: a cell holds a nested table, block content or more text than
+// fits a column. It looks only at the DOM, so the table is rendered once.
+func isLayoutTable(table *html.Node) bool {
+	for _, row := range tableRows(table) {
+		for _, c := range rowCells(row) {
+			if hasBlock(c) || utf8.RuneCountInString(strings.Join(strings.Fields(nodeText(c)), " ")) > maxTableCell {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// blockElements are the elements that break a table cell over lines
+var blockElements = map[atom.Atom]bool{
+	atom.Table: true, atom.P: true, atom.Div: true, atom.Br: true, atom.Ul: true, atom.Ol: true,
+	atom.Li: true, atom.Blockquote: true, atom.Pre: true, atom.Hr: true, atom.Dl: true,
+	atom.H1: true, atom.H2: true, atom.H3: true, atom.H4: true, atom.H5: true, atom.H6: true,
+}
+
+// hasBlock reports whether n contains a block element
+func hasBlock(n *html.Node) bool {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if blockElements[c.DataAtom] || hasBlock(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// rowCells returns the td and th elements of a row
+func rowCells(row *html.Node) []*html.Node {
+	var cells []*html.Node
+	for c := row.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode && (c.DataAtom == atom.Td || c.DataAtom == atom.Th) {
+			cells = append(cells, c)
+		}
+	}
+	return cells
+}
+
+// tableRows returns the rows of a table, looking through thead/tbody/tfoot
+// but not into nested tables
+func tableRows(table *html.Node) []*html.Node {
+	var rows []*html.Node
+	for c := table.FirstChild; c != nil; c = c.NextSibling {
+		switch c.DataAtom {
+		case atom.Tr:
+			rows = append(rows, c)
+		case atom.Thead, atom.Tbody, atom.Tfoot:
+			rows = append(rows, tableRows(c)...)
+		}
+	}
+	return rows
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderHTML(t *testing.T) {
+	tests := []struct {
+		name, html, want string
+	}{
+		{
+			name: "paragraphs",
+			html: "<p>One</p><p>Two\n   words</p>",
+			want: "One\n\nTwo words",
+		},
+		{
+			name: "line breaks",
+			html: "<div>first<br>second<br/>third</div>",
+			want: "first\nsecond\nthird",
+		},
+		{
+			name: "unordered list",
+			html: "<p>Items:</p><ul><li>apples</li><li>pears</li></ul>",
+			want: "Items:\n\n• apples\n• pears",
+		},
+		{
+			name: "ordered list with nested list",
+			html: "<ol><li>one<ul><li>sub</li></ul></li><li>two</li></ol>",
+			want: "1. one\n   • sub\n2. two",
+		},
+		{
+			name: "headings",
+			html: "<h1>Title</h1><p>Body</p><h3>Part</h3>",
+			want: "# Title\n\nBody\n\n### Part",
+		},
+		{
+			name: "blockquote",
+			html: "<p>She wrote:</p><blockquote><p>Hello</p><p>Bye</p></blockquote><p>Reply</p>",
+			want: "She wrote:\n\n> Hello\n>\n> Bye\n\nReply",
+		},
+		{
+			name: "entities",
+			html: "<p>Tom &amp; Jerry &lt;3 &quot;caf&eacute;&quot;&nbsp;&#8212; &#x263A;</p>",
+			want: "Tom & Jerry <3 \"café\" — ☺", // a non-breaking space is just a space in plain text,
+		},
+		{
+			name: "script, style and head dropped",
+			html: "<html><head><title>Mail</title><style>p{color:red}</style></head><body><script>alert(1)</script><p>Visible</p></body></html>",
+			want: "Visible",
+		},
+		{
+			name: "link footnotes numbered in order",
+			html: `<p><a href="https://a.example">first</a> and <a href="mailto:b@example.com">write</a></p><p><a href="https://c.example">third</a></p>`,
+			want: "first[1] and write[2]\n\nthird[3]\n\n[1] https://a.example\n[2] mailto:b@example.com\n[3] https://c.example",
+		},
+		{
+			name: "link showing its URL gets no footnote",
+			html: `<a href="https://a.example">https://a.example</a> <a href="/relative">here</a>`,
+			want: "https://a.example here",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := renderHTML(tt.html); got != tt.want {
+				t.Errorf("got\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderHTMLTables(t *testing.T) {
+	tests := []struct {
+		name, html, want string
+	}{
+		{
+			name: "data table in columns",
+			html: "<table><tr><th>Item</th><th>Qty</th></tr><tr><td>Apples</td><td>3</td></tr></table>",
+			want: "Item   | Qty\nApples | 3",
+		},
+		{
+			name: "layout cells kept apart",
+			html: "<table><tr><td><p>Your order</p></td></tr><tr><td>Name:</td><td>Bob</td></tr></table>",
+			want: "Your order\n\nName: Bob",
+		},
+		{
+			name: "long cell makes a layout table",
+			html: "<table><tr><td>" + strings.Repeat("word ", 10) + "</td><td>x</td></tr></table>",
+			want: strings.Repeat("word ", 10) + "x",
+		},
+		{
+			name: "footnotes in reading order",
+			html: `<table><tr><td><div><a href="https://a.example">a</a></div></td><td><a href="https://b.example">b</a></td></tr></table>`,
+			want: "a[1]\nb[2]\n\n[1] https://a.example\n[2] https://b.example",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := renderHTML(tt.html); got != tt.want {
+				t.Errorf("got\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+}
+
+// Each nested table is rendered once; were cells rendered again to decide
+// the layout, the work would double with every level and this would never
+// finish. The output must not pick up a blank line or space per level either.
+func TestRenderHTMLDeeplyNestedTables(t *testing.T) {
+	const depth = 100
+	doc := strings.Repeat("<table><tr><td>", depth) + "inner" + strings.Repeat("</td></tr></table>", depth)
+
+	if got := renderHTML(doc); got != "inner" {
+		t.Errorf("got %q", got)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/charmbracelet/lipgloss"
+	"google.golang.org/api/gmail/v1"
+)
+
+// mutedLabelName is the user label that marks muted conversations. The API
+// has no mute, so muting archives the thread and tags it with this label,
+// and new arrivals in a tagged thread are archived as they're listed. The
+// name is our own so that a "Muted" label the user made for something else
+// doesn't start archiving their mail.
+const mutedLabelName = "Muted (gmail-tui)"
+
+// labelPalette is the choice of label colors. Gmail only accepts colors
+// from its own palette, so these are picked from it.
+var labelPalette = []struct {
+	name  string
+	color gmail.LabelColor
+}{
+	{"red", gmail.LabelColor{BackgroundColor: "#fb4c2f", TextColor: "#ffffff"}},
+	{"orange", gmail.LabelColor{BackgroundColor: "#ffad47", TextColor: "#ffffff"}},
+	{"yellow", gmail.LabelColor{BackgroundColor: "#fad165", TextColor: "#000000"}},
+	{"green", gmail.LabelColor{BackgroundColor: "#16a766", TextColor: "#ffffff"}},
+	{"teal", gmail.LabelColor{BackgroundColor: "#43d692", TextColor: "#ffffff"}},
+	{"blue", gmail.LabelColor{BackgroundColor: "#4a86e8", TextColor: "#ffffff"}},
+	{"purple", gmail.LabelColor{BackgroundColor: "#a479e2", TextColor: "#ffffff"}},
+	{"pink", gmail.LabelColor{BackgroundColor: "#f691b3", TextColor: "#ffffff"}},
+	{"gray", gmail.LabelColor{BackgroundColor: "#cccccc", TextColor: "#000000"}},
+	{"black", gmail.LabelColor{BackgroundColor: "#000000", TextColor: "#ffffff"}},
+}
+
+// paletteIndex returns the palette entry matching color, or -1
+func paletteIndex(color *gmail.LabelColor) int {
+	if color == nil {
+		return -1
+	}
+	for i, p := range labelPalette {
+		if strings.EqualFold(p.color.BackgroundColor, color.BackgroundColor) {
+			return i
+		}
+	}
+	return -1
+}
+
+// paletteName describes a palette index for the label form
+func paletteName(i int) string {
+	if i < 0 {
+		return "default"
+	}
+	return labelPalette[i].name
+}
+
+// labelSwatch renders a small block in the label's color
+func labelSwatch(color *gmail.LabelColor) string {
+	if color == nil || color.BackgroundColor == "" {
+		return "  "
+	}
+	return lipgloss.NewStyle().Background(lipgloss.Color(color.BackgroundColor)).Render("  ")
+}
+
+func isUserLabel(label *gmail.Label) bool {
+	return label.Type == "user"
+}
+
+// sortLabels orders labels the way Gmail shows them: system labels in the
+// order the API returns them, then user labels by name with each nested
+// label under its parent
+func sortLabels(labels []*gmail.Label) []*gmail.Label {
+	sorted := append([]*gmail.Label(nil), labels...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		ui, uj := isUserLabel(sorted[i]), isUserLabel(sorted[j])
+		if ui != uj {
+			return uj
+		}
+		if !ui {
+			return false
+		}
+		return labelPathLess(sorted[i].Name, sorted[j].Name)
+	})
+	return sorted
+}
+
+// labelPathLess compares label names segment by segment, so "Work/Tax"
+// stays under "Work" rather than after "Work travel"
+func labelPathLess(a, b string) bool {
+	as, bs := strings.Split(strings.ToLower(a), "/"), strings.Split(strings.ToLower(b), "/")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if as[i] != bs[i] {
+			return as[i] < bs[i]
+		}
+	}
+	return len(as) < len(bs)
+}
+
+// splitLabelName returns the parent path and leaf of a nested label name
+func splitLabelName(name string) (parent, leaf string) {
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		return name[:i], name[i+1:]
+	}
+	return "", name
+}
+
+// joinLabelName builds a label name from the parent and leaf typed into
+// the label form
+func joinLabelName(parent, leaf string) (string, error) {
+	parent = strings.Trim(strings.TrimSpace(parent), "/")
+	leaf = strings.TrimSpace(leaf)
+	if leaf == "" {
+		return "", errors.New("the label needs a name")
+	}
+	if strings.Contains(leaf, "/") {
+		return "", errors.New("use the parent field to nest a label")
+	}
+	if parent == "" {
+		return leaf, nil
+	}
+	return parent + "/" + leaf, nil
+}
+
+// findLabelByName returns the label called name, or nil
+func findLabelByName(labels []*gmail.Label, name string) *gmail.Label {
+	for _, l := range labels {
+		if strings.EqualFold(l.Name, name) {
+			return l
+		}
+	}
+	return nil
+}
+
+// labelName returns the display name of a label ID
+func labelName(labels []*gmail.Label, id string) string {
+	for _, l := range labels {
+		if l.Id == id {
+			return l.Name
+		}
+	}
+	return id
+}
+
+// renamedChildren returns the new names of the labels nested under a label
+// being renamed from oldName to newName, keyed by label ID
+func renamedChildren(labels []*gmail.Label, oldName, newName string) map[string]string {
+	renames := make(map[string]string)
+	for _, l := range labels {
+		if strings.HasPrefix(l.Name, oldName+"/") {
+			renames[l.Id] = newName + strings.TrimPrefix(l.Name, oldName)
+		}
+	}
+	return renames
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"log"
 
+	"github.com/charmbracelet/bubbles/list"
 	tea "github.com/charmbracelet/bubbletea"
 	"google.golang.org/api/gmail/v1"
 )
@@ -14,32 +17,68 @@ const (
 )
 
 func main() {
-	if err := run(); err != nil {
+	var paths appPaths
+	paths.registerFlags(flag.CommandLine)
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "%s\n\nFlags:\n", usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	var err error
+	if flag.NArg() > 0 {
+		err = runCommand(flag.Args(), paths)
+	} else {
+		err = run(paths)
+	}
+	if err != nil {
 		log.Fatalf("Application error: %v", err)
 	}
 }
 
-func run() error {
-	srv, err := getGmailService()
+func run(paths appPaths) error {
+	cache, err := loadCache(paths)
 	if err != nil {
-		return fmt.Errorf("failed to initialize Gmail service: %w", err)
+		log.Printf("Warning: message cache disabled: %v", err)
 	}
 
-	messages, err := fetchInboxMessages(srv)
+	backend, retrier, err := newBackend(cache, paths)
 	if err != nil {
-		return fmt.Errorf("failed to fetch inbox messages: %w", err)
+		return err
 	}
 
-	labels, err := fetchLabels(srv)
+	contacts, err := loadContacts(paths)
 	if err != nil {
-		log.Printf("Warning: could not fetch labels: %v", err)
-		labels = []*gmail.Label{} // Continue with empty labels
+		log.Printf("Warning: address book will not be saved: %v", err)
+		contacts = newAddressBook("")
 	}
 
-	p := tea.NewProgram(
-		initialModel(messages, srv, labels),
-		tea.WithAltScreen(),
-	)
+	var m model
+	if cached := cachedInboxItems(cache); len(cached) > 0 {
+		// Render what we have immediately; Init refreshes it from the server
+		m = initialModel(&gmail.ListMessagesResponse{}, backend, cache.Labels()).withCachedItems(cached)
+	} else {
+		page, err := fetchInboxMessages(backend)
+		if err != nil {
+			return fmt.Errorf("failed to fetch inbox messages: %w", err)
+		}
+
+		labels, err := fetchLabels(backend)
+		if err != nil {
+			log.Printf("Warning: could not fetch labels: %v", err)
+			labels = []*gmail.Label{} // Continue with empty labels
+		}
+
+		m = initialModel(page, backend, labels)
+	}
+
+	p := tea.NewProgram(m.withAddressBook(contacts).withPaths(paths), tea.WithAltScreen())
+	if retrier != nil {
+		retrier.OnRetry(func(n retryNotice) { p.Send(n) })
+	}
+	if cached, ok := backend.(*cachingBackend); ok {
+		cached.OnNotice(func(n cacheNotice) { p.Send(n) })
+	}
 
 	if _, err := p.Run(); err != nil {
 		return fmt.Errorf("TUI error: %w", err)
@@ -48,35 +87,83 @@ func run() error {
 	return nil
 }
 
-// fetchInboxMessages retrieves messages from the primary inbox
-func fetchInboxMessages(srv *gmail.Service) ([]*gmail.Message, error) {
-	resp, err := srv.Users.Messages.
-		List("me").
-		Q(inboxQuery).
-		MaxResults(defaultMaxResults).
-		Do()
+// loadCache opens the on-disk message cache
+func loadCache(paths appPaths) (*cacheStore, error) {
+	dir, err := paths.cachePath()
+	if err != nil {
+		return nil, err
+	}
+	return openCache(dir)
+}
+
+// loadContacts opens the address book used for recipient completion
+func loadContacts(paths appPaths) (*addressBook, error) {
+	path, err := paths.contactsPath()
+	if err != nil {
+		return nil, err
+	}
+	return loadAddressBook(path)
+}
+
+// newBackend connects to Gmail through the cache, falling back to
+// read-only offline mode when the API can't be reached. The retrying layer
+// is returned too so the UI can report retries; it's nil when offline.
+func newBackend(cache *cacheStore, paths appPaths) (MailBackend, *retryingBackend, error) {
+	srv, err := getGmailService(paths)
+	if err != nil {
+		if cache != nil && isOfflineError(err) {
+			log.Printf("Gmail is unreachable, starting in offline mode: %v", err)
+			return newCachingBackend(nil, cache), nil, nil
+		}
+		return nil, nil, fmt.Errorf("failed to initialize Gmail service: %w", err)
+	}
+
+	retrier := newRetryingBackend(newGmailBackend(srv))
+	if cache == nil {
+		return retrier, retrier, nil
+	}
+	return newCachingBackend(retrier, cache), retrier, nil
+}
+
+// cachedInboxItems returns the first page of the inbox as last seen
+func cachedInboxItems(cache *cacheStore) []list.Item {
+	if cache == nil {
+		return nil
+	}
+
+	msgs := cache.Messages(inboxQuery, nil)
+	items := make([]list.Item, 0, defaultMaxResults)
+	for _, msg := range msgs[:min(len(msgs), defaultMaxResults)] {
+		items = append(items, *newEmailItem(msg))
+	}
+	return items
+}
+
+// fetchInboxMessages retrieves the first page of the primary inbox
+func fetchInboxMessages(b MailBackend) (*gmail.ListMessagesResponse, error) {
+	resp, err := b.ListMessages(context.Background(), inboxQuery, nil, "", defaultMaxResults)
 	if err != nil {
 		return nil, err
 	}
 
 	if resp == nil || len(resp.Messages) == 0 {
 		fmt.Println("No messages found in inbox")
-		return []*gmail.Message{}, nil
+		return &gmail.ListMessagesResponse{}, nil
 	}
 
-	return resp.Messages, nil
+	return resp, nil
 }
 
 // fetchLabels retrieves all Gmail labels for the user
-func fetchLabels(srv *gmail.Service) ([]*gmail.Label, error) {
-	resp, err := srv.Users.Labels.List("me").Do()
+func fetchLabels(b MailBackend) ([]*gmail.Label, error) {
+	labels, err := b.ListLabels(context.Background())
 	if err != nil {
 		return nil, err
 	}
 
-	if resp == nil {
+	if labels == nil {
 		return []*gmail.Label{}, nil
 	}
 
-	return resp.Labels, nil
+	return labels, nil
 }
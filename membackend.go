@@ -0,0 +1,577 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"sync"
+
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// memAddress is the mailbox owner reported by memBackend.GetProfile
+const memAddress = "me@example.com"
+
+// memBackend is an in-memory MailBackend. Messages are kept in insertion
+// order (newest first, like the Gmail API) and queries support the small
+// subset of Gmail search syntax the TUI issues itself.
+type memBackend struct {
+	mu          sync.Mutex
+	messages    map[string]*gmail.Message
+	order       []string
+	labels      []*gmail.Label
+	attachments map[string]*gmail.MessagePartBody
+	sent        []*gmail.Message
+	nextID      int
+	historyID   uint64
+	history     []*gmail.History
+	drafts      map[string]*gmail.Draft
+	draftOrder  []string
+	failModify  func(id string) error
+}
+
+func newMemBackend(messages []*gmail.Message, labels []*gmail.Label) *memBackend {
+	b := &memBackend{
+		messages:    make(map[string]*gmail.Message),
+		labels:      labels,
+		attachments: make(map[string]*gmail.MessagePartBody),
+		historyID:   1,
+		drafts:      make(map[string]*gmail.Draft),
+	}
+	for _, msg := range messages {
+		b.messages[msg.Id] = msg
+		b.order = append(b.order, msg.Id)
+	}
+	return b
+}
+
+// AddAttachment registers attachment data returned by GetAttachment
+func (b *memBackend) AddAttachment(attachmentID string, body *gmail.MessagePartBody) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.attachments[attachmentID] = body
+}
+
+// FailModify makes label changes fail for the messages f returns an error
+// for, as the API does when a call is rejected. Trashing and batch changes
+// are label changes too.
+func (b *memBackend) FailModify(f func(id string) error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failModify = f
+}
+
+// Sent returns the messages passed to SendMessage, oldest first
+func (b *memBackend) Sent() []*gmail.Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]*gmail.Message(nil), b.sent...)
+}
+
+func (b *memBackend) ListMessages(_ context.Context, query string, labelIDs []string, pageToken string, maxResults int64) (*gmail.ListMessagesResponse, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var matched []*gmail.Message
+	for _, id := range b.order {
+		msg := b.messages[id]
+		if hasAllLabels(msg, labelIDs) && matchesQuery(msg, query) {
+			matched = append(matched, &gmail.Message{Id: msg.Id, ThreadId: msg.ThreadId})
+		}
+	}
+
+	start := 0
+	if pageToken != "" {
+		n, err := strconv.Atoi(pageToken)
+		if err != nil || n < 0 || n > len(matched) {
+			return nil, fmt.Errorf("invalid page token %q", pageToken)
+		}
+		start = n
+	}
+	end := len(matched)
+	if maxResults > 0 && int64(end-start) > maxResults {
+		end = start + int(maxResults)
+	}
+
+	resp := &gmail.ListMessagesResponse{
+		Messages:           matched[start:end],
+		ResultSizeEstimate: int64(len(matched)),
+	}
+	if end < len(matched) {
+		resp.NextPageToken = strconv.Itoa(end)
+	}
+	return resp, nil
+}
+
+func (b *memBackend) GetMessage(_ context.Context, id, _ string) (*gmail.Message, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	msg, ok := b.messages[id]
+	if !ok {
+		return nil, fmt.Errorf("message %s not found", id)
+	}
+	return msg, nil
+}
+
+func (b *memBackend) SendMessage(_ context.Context, msg *gmail.Message) (*gmail.Message, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.send(msg), nil
+}
+
+// send records msg as sent; callers must hold b.mu
+func (b *memBackend) send(msg *gmail.Message) *gmail.Message {
+	b.nextID++
+	sent := &gmail.Message{
+		Id:       fmt.Sprintf("sent-%d", b.nextID),
+		ThreadId: msg.ThreadId,
+		Raw:      msg.Raw,
+		LabelIds: []string{"SENT"},
+	}
+	if sent.ThreadId == "" {
+		sent.ThreadId = sent.Id
+	}
+	b.sent = append(b.sent, sent)
+	b.messages[sent.Id] = sent
+	b.order = append([]string{sent.Id}, b.order...)
+	b.record(&gmail.History{MessagesAdded: []*gmail.HistoryMessageAdded{{Message: sent}}})
+	return sent
+}
+
+func (b *memBackend) ModifyMessage(_ context.Context, id string, req *gmail.ModifyMessageRequest) (*gmail.Message, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failModify != nil {
+		if err := b.failModify(id); err != nil {
+			return nil, err
+		}
+	}
+	msg, ok := b.messages[id]
+	if !ok {
+		return nil, fmt.Errorf("message %s not found", id)
+	}
+	msg.LabelIds = applyLabelChanges(msg.LabelIds, req.AddLabelIds, req.RemoveLabelIds)
+
+	h := &gmail.History{}
+	if len(req.AddLabelIds) > 0 {
+		h.LabelsAdded = []*gmail.HistoryLabelAdded{{Message: msg, LabelIds: req.AddLabelIds}}
+	}
+	if len(req.RemoveLabelIds) > 0 {
+		h.LabelsRemoved = []*gmail.HistoryLabelRemoved{{Message: msg, LabelIds: req.RemoveLabelIds}}
+	}
+	b.record(h)
+	return msg, nil
+}
+
+// record appends a history entry; callers must hold b.mu
+func (b *memBackend) record(h *gmail.History) {
+	b.historyID++
+	h.Id = b.historyID
+	b.history = append(b.history, h)
+}
+
+// ExpireHistory forgets all recorded changes, so the next ListHistory call
+// fails the way the API does for a stale startHistoryId
+func (b *memBackend) ExpireHistory() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.history = nil
+}
+
+func (b *memBackend) TrashMessage(ctx context.Context, id string) (*gmail.Message, error) {
+	return b.ModifyMessage(ctx, id, &gmail.ModifyMessageRequest{
+		AddLabelIds:    []string{"TRASH"},
+		RemoveLabelIds: []string{"INBOX"},
+	})
+}
+
+func (b *memBackend) UntrashMessage(ctx context.Context, id string) (*gmail.Message, error) {
+	return b.ModifyMessage(ctx, id, &gmail.ModifyMessageRequest{
+		AddLabelIds:    []string{"INBOX"},
+		RemoveLabelIds: []string{"TRASH"},
+	})
+}
+
+// BatchModify changes all of req.Ids or, like the API, none of them
+func (b *memBackend) BatchModify(ctx context.Context, req *gmail.BatchModifyMessagesRequest) error {
+	b.mu.Lock()
+	fail := b.failModify
+	b.mu.Unlock()
+	if fail != nil {
+		for _, id := range req.Ids {
+			if err := fail(id); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, id := range req.Ids {
+		if _, err := b.ModifyMessage(ctx, id, &gmail.ModifyMessageRequest{
+			AddLabelIds:    req.AddLabelIds,
+			RemoveLabelIds: req.RemoveLabelIds,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *memBackend) BatchDelete(_ context.Context, ids []string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, id := range ids {
+		if _, ok := b.messages[id]; !ok {
+			continue
+		}
+		delete(b.messages, id)
+		for i, existing := range b.order {
+			if existing == id {
+				b.order = append(b.order[:i], b.order[i+1:]...)
+				break
+			}
+		}
+		b.record(&gmail.History{MessagesDeleted: []*gmail.HistoryMessageDeleted{{Message: &gmail.Message{Id: id}}}})
+	}
+	return nil
+}
+
+func (b *memBackend) ListLabels(_ context.Context) ([]*gmail.Label, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]*gmail.Label(nil), b.labels...), nil
+}
+
+func (b *memBackend) CreateLabel(_ context.Context, label *gmail.Label) (*gmail.Label, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, l := range b.labels {
+		if strings.EqualFold(l.Name, label.Name) {
+			return nil, &googleapi.Error{Code: http.StatusConflict, Message: "Label name exists or conflicts"}
+		}
+	}
+	b.nextID++
+	created := *label
+	created.Id = fmt.Sprintf("Label_%d", b.nextID)
+	created.Type = "user"
+	b.labels = append(b.labels, &created)
+	return &created, nil
+}
+
+func (b *memBackend) PatchLabel(_ context.Context, id string, label *gmail.Label) (*gmail.Label, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	existing := b.findLabel(id)
+	if existing == nil {
+		return nil, &googleapi.Error{Code: http.StatusNotFound, Message: "Label not found"}
+	}
+	if label.Name != "" {
+		existing.Name = label.Name
+	}
+	if label.Color != nil {
+		existing.Color = label.Color
+	}
+	return existing, nil
+}
+
+func (b *memBackend) DeleteLabel(_ context.Context, id string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.findLabel(id) == nil {
+		return &googleapi.Error{Code: http.StatusNotFound, Message: "Label not found"}
+	}
+	for i, l := range b.labels {
+		if l.Id == id {
+			b.labels = append(b.labels[:i:i], b.labels[i+1:]...)
+			break
+		}
+	}
+	for _, msg := range b.messages {
+		msg.LabelIds = applyLabelChanges(msg.LabelIds, nil, []string{id})
+	}
+	return nil
+}
+
+// findLabel must be called with b.mu held
+func (b *memBackend) findLabel(id string) *gmail.Label {
+	for _, l := range b.labels {
+		if l.Id == id {
+			return l
+		}
+	}
+	return nil
+}
+
+func (b *memBackend) GetAttachment(_ context.Context, _, attachmentID string) (*gmail.MessagePartBody, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	body, ok := b.attachments[attachmentID]
+	if !ok {
+		return nil, fmt.Errorf("attachment %s not found", attachmentID)
+	}
+	return body, nil
+}
+
+func (b *memBackend) GetThread(_ context.Context, id, _ string) (*gmail.Thread, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	thread := &gmail.Thread{Id: id}
+	// order is newest first; threads list their messages oldest first
+	for i := len(b.order) - 1; i >= 0; i-- {
+		if msg := b.messages[b.order[i]]; msg.ThreadId == id {
+			thread.Messages = append(thread.Messages, msg)
+		}
+	}
+	if len(thread.Messages) == 0 {
+		return nil, fmt.Errorf("thread %s not found", id)
+	}
+	return thread, nil
+}
+
+func (b *memBackend) ModifyThread(ctx context.Context, id string, req *gmail.ModifyThreadRequest) (*gmail.Thread, error) {
+	thread, err := b.GetThread(ctx, id, "minimal")
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range thread.Messages {
+		if _, err := b.ModifyMessage(ctx, msg.Id, &gmail.ModifyMessageRequest{
+			AddLabelIds:    req.AddLabelIds,
+			RemoveLabelIds: req.RemoveLabelIds,
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return thread, nil
+}
+
+func (b *memBackend) GetProfile(_ context.Context) (*gmail.Profile, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return &gmail.Profile{
+		EmailAddress:  memAddress,
+		HistoryId:     b.historyID,
+		MessagesTotal: int64(len(b.messages)),
+	}, nil
+}
+
+func (b *memBackend) ListSendAs(_ context.Context) ([]*gmail.SendAs, error) {
+	return []*gmail.SendAs{{SendAsEmail: memAddress, IsPrimary: true}}, nil
+}
+
+func (b *memBackend) ListHistory(_ context.Context, startHistoryID uint64, _ string) (*gmail.ListHistoryResponse, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if startHistoryID < b.historyID && (len(b.history) == 0 || b.history[0].Id > startHistoryID+1) {
+		return nil, &googleapi.Error{Code: http.StatusNotFound, Message: "Requested entity was not found."}
+	}
+
+	resp := &gmail.ListHistoryResponse{HistoryId: b.historyID}
+	for _, h := range b.history {
+		if h.Id > startHistoryID {
+			resp.History = append(resp.History, h)
+		}
+	}
+	return resp, nil
+}
+
+func (b *memBackend) ListDrafts(_ context.Context) ([]*gmail.Draft, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	drafts := make([]*gmail.Draft, 0, len(b.draftOrder))
+	for _, id := range b.draftOrder {
+		msg := b.drafts[id].Message
+		drafts = append(drafts, &gmail.Draft{Id: id, Message: &gmail.Message{Id: msg.Id, ThreadId: msg.ThreadId}})
+	}
+	return drafts, nil
+}
+
+func (b *memBackend) GetDraft(_ context.Context, id, _ string) (*gmail.Draft, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	draft, ok := b.drafts[id]
+	if !ok {
+		return nil, fmt.Errorf("draft %s not found", id)
+	}
+	return draft, nil
+}
+
+func (b *memBackend) CreateDraft(_ context.Context, draft *gmail.Draft) (*gmail.Draft, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.nextID++
+	id := fmt.Sprintf("draft-%d", b.nextID)
+	b.drafts[id] = &gmail.Draft{Id: id, Message: draftMessage(id, draft.Message)}
+	b.draftOrder = append([]string{id}, b.draftOrder...)
+	return b.drafts[id], nil
+}
+
+func (b *memBackend) UpdateDraft(_ context.Context, id string, draft *gmail.Draft) (*gmail.Draft, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.drafts[id]; !ok {
+		return nil, fmt.Errorf("draft %s not found", id)
+	}
+	b.drafts[id] = &gmail.Draft{Id: id, Message: draftMessage(id, draft.Message)}
+	return b.drafts[id], nil
+}
+
+func (b *memBackend) SendDraft(_ context.Context, draft *gmail.Draft) (*gmail.Message, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stored, ok := b.drafts[draft.Id]
+	if !ok {
+		return nil, fmt.Errorf("draft %s not found", draft.Id)
+	}
+	msg := stored.Message
+	if draft.Message != nil {
+		msg = draft.Message
+	}
+	b.removeDraft(draft.Id)
+	return b.send(msg), nil
+}
+
+func (b *memBackend) DeleteDraft(_ context.Context, id string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.drafts[id]; !ok {
+		return fmt.Errorf("draft %s not found", id)
+	}
+	b.removeDraft(id)
+	return nil
+}
+
+// removeDraft must be called with b.mu held
+func (b *memBackend) removeDraft(id string) {
+	delete(b.drafts, id)
+	for i, did := range b.draftOrder {
+		if did == id {
+			b.draftOrder = append(b.draftOrder[:i:i], b.draftOrder[i+1:]...)
+			break
+		}
+	}
+}
+
+// draftMessage stores a draft's raw message along with its parsed headers,
+// so metadata requests see the same fields the API would return
+func draftMessage(draftID string, msg *gmail.Message) *gmail.Message {
+	stored := &gmail.Message{
+		Id:       "msg-" + draftID,
+		ThreadId: msg.ThreadId,
+		Raw:      msg.Raw,
+		LabelIds: []string{"DRAFT"},
+		Payload:  &gmail.MessagePart{},
+	}
+	if raw, err := base64.URLEncoding.DecodeString(padBase64(msg.Raw)); err == nil {
+		if parsed, err := mail.ReadMessage(bytes.NewReader(raw)); err == nil {
+			for name, values := range parsed.Header {
+				for _, v := range values {
+					stored.Payload.Headers = append(stored.Payload.Headers, &gmail.MessagePartHeader{Name: name, Value: v})
+				}
+			}
+		}
+	}
+	return stored
+}
+
+// applyLabelChanges returns labels with add appended and remove filtered out
+func applyLabelChanges(labels, add, remove []string) []string {
+	result := make([]string, 0, len(labels)+len(add))
+	for _, l := range labels {
+		if !containsString(remove, l) {
+			result = append(result, l)
+		}
+	}
+	for _, l := range add {
+		if !containsString(result, l) {
+			result = append(result, l)
+		}
+	}
+	return result
+}
+
+func hasAllLabels(msg *gmail.Message, labelIDs []string) bool {
+	for _, id := range labelIDs {
+		if !containsString(msg.LabelIds, id) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesQuery understands in:/label:/is: terms and plain words matched
+// against the subject, sender and snippet.
+func matchesQuery(msg *gmail.Message, query string) bool {
+	for _, term := range strings.Fields(strings.ToLower(query)) {
+		name, value, found := strings.Cut(term, ":")
+		if !found {
+			if !strings.Contains(strings.ToLower(messageSearchText(msg)), term) {
+				return false
+			}
+			continue
+		}
+
+		var labelID string
+		switch name {
+		case "in", "label", "is":
+			labelID = strings.ToUpper(value)
+			if value == "read" {
+				if containsString(msg.LabelIds, "UNREAD") {
+					return false
+				}
+				continue
+			}
+		case "category":
+			labelID = "CATEGORY_" + strings.ToUpper(value)
+			if value == "primary" {
+				labelID = "CATEGORY_PERSONAL"
+			}
+		default:
+			continue
+		}
+		if !containsString(msg.LabelIds, labelID) {
+			return false
+		}
+	}
+	return true
+}
+
+func messageSearchText(msg *gmail.Message) string {
+	text := msg.Snippet
+	if msg.Payload != nil {
+		for _, h := range msg.Payload.Headers {
+			if h.Name == "Subject" || h.Name == "From" {
+				text += " " + h.Value
+			}
+		}
+	}
+	return text
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// maxHeaderLine is the length RFC 5322 recommends folding header lines at
+const maxHeaderLine = 78
+
+// base64LineLength is the longest encoded line RFC 2045 allows
+const base64LineLength = 76
+
+// buildRawMessage renders email as a MIME message, base64url encoded the
+// way the API expects in Message.Raw
+func buildRawMessage(email outgoingEmail) (string, error) {
+	date := time.Now()
+	messageID, err := newMessageID(date)
+	if err != nil {
+		return "", err
+	}
+	msg, err := buildMessage(email, date, messageID)
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(msg), nil
+}
+
+// buildMessage renders email as an RFC 5322 message. The text is sent as
+// quoted-printable UTF-8, on its own or as the first part of a
+// multipart/mixed message when there are attachments.
+func buildMessage(email outgoingEmail, date time.Time, messageID string) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := writeHeaders(&buf, email, date, messageID); err != nil {
+		return nil, err
+	}
+
+	if len(email.attachments) == 0 {
+		buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+		buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+		if err := writeQuotedPrintable(&buf, email.body); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	writer := multipart.NewWriter(&buf)
+	buf.WriteString("Content-Type: " + mime.FormatMediaType("multipart/mixed", map[string]string{"boundary": writer.Boundary()}) + "\r\n\r\n")
+
+	textPart, err := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/plain; charset=utf-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create text part: %w", err)
+	}
+	if err := writeQuotedPrintable(textPart, email.body); err != nil {
+		return nil, err
+	}
+
+	for _, att := range email.attachments {
+		if err := addAttachment(writer, att); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close writer: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// writeHeaders writes the message headers, refusing any field that would
+// smuggle in a line break
+func writeHeaders(w io.Writer, email outgoingEmail, date time.Time, messageID string) error {
+	fields := []struct{ name, value string }{
+		{"To", email.to},
+		{"Cc", email.cc},
+		{"Bcc", email.bcc},
+		{"Subject", email.subject},
+		{"In-Reply-To", email.inReplyTo},
+		{"References", email.references},
+	}
+	for _, f := range fields {
+		if strings.ContainsAny(f.value, "\r\n") {
+			return fmt.Errorf("%s must not contain line breaks", f.name)
+		}
+	}
+
+	var headers strings.Builder
+	headers.WriteString(foldHeader("Date", date.Format(time.RFC1123Z)))
+	headers.WriteString(foldHeader("Message-ID", messageID))
+	for _, f := range fields {
+		if strings.TrimSpace(f.value) == "" {
+			continue
+		}
+
+		value := f.value
+		switch f.name {
+		case "To", "Cc", "Bcc":
+			// A list that doesn't parse is kept as typed, so a half-written
+			// draft can still be saved; Gmail rejects it if it is sent
+			if encoded, err := encodeAddressList(value); err == nil {
+				value = encoded
+			}
+		case "Subject":
+			value = mime.QEncoding.Encode("utf-8", value)
+		}
+		headers.WriteString(foldHeader(f.name, value))
+	}
+	headers.WriteString("MIME-Version: 1.0\r\n")
+
+	_, err := io.WriteString(w, headers.String())
+	return err
+}
+
+// encodeAddressList re-renders an address list with non-ASCII display
+// names as encoded words and special characters quoted
+func encodeAddressList(list string) (string, error) {
+	recipients := parseRecipients(list)
+	encoded := make([]string, len(recipients))
+	for i, r := range recipients {
+		if r.err != nil {
+			return "", r.err
+		}
+		encoded[i] = r.addr.String()
+	}
+	return strings.Join(encoded, ", "), nil
+}
+
+// foldHeader renders a header line, folding it at spaces so that lines
+// stay within maxHeaderLine where the value allows
+func foldHeader(name, value string) string {
+	var b strings.Builder
+	b.WriteString(name + ":")
+	lineLen := len(name) + 1
+	for _, word := range strings.Split(value, " ") {
+		if lineLen+1+len(word) > maxHeaderLine && lineLen > len(name)+1 {
+			b.WriteString("\r\n")
+			lineLen = 0
+		}
+		b.WriteString(" " + word)
+		lineLen += 1 + len(word)
+	}
+	b.WriteString("\r\n")
+	return b.String()
+}
+
+// newMessageID returns a random, globally unique Message-ID
+func newMessageID(date time.Time) (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("failed to generate Message-ID: %w", err)
+	}
+	return fmt.Sprintf("<%d.%s@gmail-tui>", date.UnixNano(), hex.EncodeToString(id)), nil
+}
+
+func writeQuotedPrintable(w io.Writer, text string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := io.WriteString(qp, text); err != nil {
+		return fmt.Errorf("failed to write body: %w", err)
+	}
+	if err := qp.Close(); err != nil {
+		return fmt.Errorf("failed to write body: %w", err)
+	}
+	return nil
+}
+
+func addAttachment(writer *multipart.Writer, att outgoingAttachment) error {
+	if strings.ContainsAny(att.name, "\r\n") {
+		return fmt.Errorf("attachment name must not contain line breaks: %q", att.name)
+	}
+
+	data := att.data
+	if data == nil {
+		fileInfo, err := os.Stat(att.path)
+		if err != nil {
+			return fmt.Errorf("failed to get file info: %w", err)
+		}
+		if fileInfo.Size() > maxAttachmentSize {
+			return fmt.Errorf("attachment too large: %s (max 25MB)", att.name)
+		}
+		if data, err = os.ReadFile(att.path); err != nil {
+			return fmt.Errorf("failed to open attachment: %w", err)
+		}
+	}
+	if len(data) > maxAttachmentSize {
+		return fmt.Errorf("attachment too large: %s (max 25MB)", att.name)
+	}
+
+	mimeType := att.mimeType
+	if mimeType == "" {
+		mimeType = mime.TypeByExtension(filepath.Ext(att.name))
+	}
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+	// Drop any parameters (a charset from TypeByExtension) so the name
+	// parameter can be added cleanly
+	if mediaType, _, err := mime.ParseMediaType(mimeType); err == nil {
+		mimeType = mediaType
+	}
+
+	contentType := mime.FormatMediaType(mimeType, map[string]string{"name": att.name})
+	if contentType == "" {
+		contentType = mime.FormatMediaType("application/octet-stream", map[string]string{"name": att.name})
+	}
+
+	partWriter, err := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {contentType},
+		"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": att.name})},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create attachment part: %w", err)
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(data)
+	var lines []string
+	for len(encoded) > base64LineLength {
+		lines = append(lines, encoded[:base64LineLength])
+		encoded = encoded[base64LineLength:]
+	}
+	lines = append(lines, encoded)
+
+	if _, err := io.WriteString(partWriter, strings.Join(lines, "\r\n")); err != nil {
+		return fmt.Errorf("failed to write attachment: %w", err)
+	}
+	return nil
+}
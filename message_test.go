@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite golden files in testdata")
+
+var (
+	testDate      = time.Date(2024, time.March, 5, 14, 30, 0, 0, time.FixedZone("", 3600))
+	testMessageID = "<1709645400000000000.00112233445566778899aabbccddeeff@gmail-tui>"
+)
+
+// golden compares got with testdata/name, or rewrites it with -update
+func golden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.MkdirAll("testdata", 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading golden file (run with -update to create it): %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s mismatch\n--- got ---\n%s\n--- want ---\n%s", name, got, want)
+	}
+}
+
+func TestBuildMessageGolden(t *testing.T) {
+	tests := []struct {
+		name  string
+		email outgoingEmail
+	}{
+		{
+			name: "plain.eml",
+			email: outgoingEmail{
+				to:      "bob@example.com",
+				subject: "Lunch",
+				body:    "See you at noon.\n",
+			},
+		},
+		{
+			name: "encoded_words.eml",
+			email: outgoingEmail{
+				to:      "Zoë Müller <zoe@example.com>, \"Smith, John\" <john@example.com>",
+				subject: "Café menu für Dienstag",
+				body:    "Grüße\n",
+			},
+		},
+		{
+			name: "folded_headers.eml",
+			email: outgoingEmail{
+				to:         "alice@example.com, bob@example.com, carol@example.com, dave@example.com, erin@example.com",
+				subject:    "Re: planning notes",
+				inReplyTo:  "<a1@mail.example.com>",
+				references: "<a1@mail.example.com> <b2@mail.example.com> <c3@mail.example.com> <d4@mail.example.com>",
+				body:       "ok\n",
+			},
+		},
+		{
+			name: "quoted_printable.eml",
+			email: outgoingEmail{
+				to:      "bob@example.com",
+				subject: "Long line",
+				body:    "naïve = café " + strings.Repeat("a very long line of text ", 5) + "\n",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := buildMessage(tt.email, testDate, testMessageID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			golden(t, tt.name, got)
+		})
+	}
+}
+
+func TestBuildMessageHeaders(t *testing.T) {
+	got, err := buildMessage(outgoingEmail{to: "bob@example.com", subject: "Hi", body: "Hello\n"}, testDate, testMessageID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := string(got)
+
+	for _, want := range []string{
+		"Date: Tue, 05 Mar 2024 14:30:00 +0100\r\n",
+		"Message-ID: " + testMessageID + "\r\n",
+		"Content-Type: text/plain; charset=utf-8\r\n",
+	} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("message lacks %q:\n%s", want, msg)
+		}
+	}
+	if strings.Contains(msg, "multipart/mixed") {
+		t.Errorf("message without attachments is multipart:\n%s", msg)
+	}
+
+	headers, _, _ := strings.Cut(msg, "\r\n\r\n")
+	for _, line := range strings.Split(headers, "\r\n") {
+		if len(line) > maxHeaderLine {
+			t.Errorf("header line longer than %d: %q", maxHeaderLine, line)
+		}
+	}
+}
+
+func TestBuildMessageRejectsLineBreaks(t *testing.T) {
+	for _, subject := range []string{"Hi\r\nBcc: eve@example.com", "Hi\nBcc: eve@example.com", "Hi\r"} {
+		_, err := buildMessage(outgoingEmail{to: "bob@example.com", subject: subject}, testDate, testMessageID)
+		if err == nil {
+			t.Errorf("subject %q was accepted", subject)
+		}
+	}
+}
+
+func TestFoldHeader(t *testing.T) {
+	value := strings.TrimSpace(strings.Repeat("word ", 40))
+	folded := foldHeader("Subject", value)
+	lines := strings.Split(strings.TrimSuffix(folded, "\r\n"), "\r\n")
+	if len(lines) < 3 {
+		t.Fatalf("expected folding, got %q", folded)
+	}
+	for i, line := range lines {
+		if len(line) > maxHeaderLine {
+			t.Errorf("line %d is %d long: %q", i, len(line), line)
+		}
+		if i > 0 && !strings.HasPrefix(line, " ") {
+			t.Errorf("continuation line %d doesn't start with whitespace: %q", i, line)
+		}
+	}
+	if unfolded := strings.ReplaceAll(folded, "\r\n", ""); unfolded != "Subject: "+value {
+		t.Errorf("unfolding changed the value: %q", unfolded)
+	}
+}
@@ -13,24 +13,35 @@ import (
 	"google.golang.org/api/gmail/v1"
 )
 
-func initialModel(emails []*gmail.Message, srv *gmail.Service, labels []*gmail.Label) model {
-	items := make([]list.Item, 0, len(emails))
-	for _, msg := range emails {
-		if item := createEmailItem(srv, msg.Id, false); item != nil {
-			items = append(items, *item)
-		}
+func initialModel(page *gmail.ListMessagesResponse, backend MailBackend, labels []*gmail.Label) model {
+	selected := make(map[string]bool)
+	delegate := selectionDelegate{DefaultDelegate: createListDelegate(), selected: selected}
+	emailList := createEmailList([]list.Item{}, delegate)
+	labelsList := createLabelsList()
+
+	initialState := stateInbox
+	if len(page.Messages) > 0 {
+		initialState = stateLoading
 	}
 
-	delegate := createListDelegate()
-	emailList := createEmailList(items, delegate)
-	labelsList := createLabelsList()
+	offline := false
+	var sync *syncEngine
+	if cb, ok := backend.(*cachingBackend); ok {
+		if cb.Offline() {
+			offline = true
+			emailList.Title = "Inbox (offline)"
+		} else {
+			sync = newSyncEngine(cb)
+		}
+	}
 
-	return model{
-		state:              stateInbox,
+	m := model{
+		state:              initialState,
 		list:               emailList,
-		srv:                srv,
+		backend:            backend,
 		loading:            createSpinner(),
 		viewport:           createViewport(),
+		logViewport:        createViewport(),
 		help:               createHelp(),
 		composeFrom:        createTextInput("From", 100),
 		composeTo:          createTextInput("To", 100),
@@ -43,14 +54,92 @@ func initialModel(emails []*gmail.Message, srv *gmail.Service, labels []*gmail.L
 		attachmentInput:    createTextInput("Path to attachment...", 300),
 		labels:             labels,
 		labelsList:         labelsList,
-		composeAttachments: []string{},
-		replyAttachments:   []string{},
+		composeAttachments: []outgoingAttachment{},
+		replyAttachments:   []outgoingAttachment{},
 		focused:            0,
+		listQuery:          inboxQuery,
+		nextPageToken:      page.NextPageToken,
+		resultEstimate:     page.ResultSizeEstimate,
+		listLoading:        len(page.Messages) > 0,
+		offline:            offline,
+		sync:               sync,
+		threadList:         createEmailList([]list.Item{}, delegate),
+		draftsList:         createDraftsList(),
+		contacts:           newAddressBook(""),
+		contactsList:       createContactsList(),
+		contactName:        createTextInput("Name", 100),
+		contactAddress:     createTextInput("Address", 100),
+		labelNameInput:     createTextInput("Name", 100),
+		labelParentInput:   createTextInput("Parent label (optional)", 200),
+		labelColor:         -1,
+		labelPicker:        createLabelPicker(),
+		mutedThreads:       make(map[string]bool),
+		draftCreates:       make(map[int]*draftOp),
+		selected:           selected,
+	}
+	m.fetch, _ = startItemFetch(m.startRequest(&m.listRequest), backend, page.Messages)
+	return m
+}
+
+// setItems replaces the message rows, regrouping them when threads are shown
+func (m *model) setItems(items []list.Item) tea.Cmd {
+	cmd := m.list.SetItems(items)
+	if m.threadMode {
+		m.threadList.SetItems(groupThreads(items))
 	}
+	return cmd
+}
+
+// activeList is the list the inbox currently displays
+func (m *model) activeList() *list.Model {
+	if m.threadMode {
+		return &m.threadList
+	}
+	return &m.list
+}
+
+// selectedEmail returns the highlighted message, or the newest message of
+// the highlighted thread
+func (m model) selectedEmail() (emailItem, bool) {
+	switch selected := m.activeList().SelectedItem().(type) {
+	case emailItem:
+		return selected, true
+	case threadItem:
+		return selected.latest(), true
+	}
+	return emailItem{}, false
+}
+
+// withCachedItems shows rows from the local cache right away; Init's sync
+// then brings them up to date
+func (m model) withCachedItems(items []list.Item) model {
+	m.setItems(items)
+	m.state = stateInbox
+	m.listLoading = false
+	return m
+}
+
+// withPaths keeps files where paths says
+func (m model) withPaths(paths appPaths) model {
+	m.paths = paths
+	return m
+}
+
+// withAddressBook uses book for recipient completion and the contacts screen
+func (m model) withAddressBook(book *addressBook) model {
+	m.contacts = book
+	return m
 }
 
 func (m model) Init() tea.Cmd {
-	return m.loading.Tick
+	cmds := []tea.Cmd{m.loading.Tick, waitForItems(m.fetch)}
+	if m.sync != nil {
+		cmds = append(cmds, runSync(m.sync))
+	}
+	if !m.offline {
+		cmds = append(cmds, loadIdentity(m.backend), harvestSent(m.backend, m.contacts), loadMutedThreads(m.backend, m.labels))
+	}
+	return tea.Batch(cmds...)
 }
 
 // UI component factories
@@ -64,7 +153,7 @@ func createListDelegate() list.DefaultDelegate {
 	return delegate
 }
 
-func createEmailList(items []list.Item, delegate list.DefaultDelegate) list.Model {
+func createEmailList(items []list.Item, delegate list.ItemDelegate) list.Model {
 	l := list.New(items, delegate, 0, 0)
 	l.Title = "Inbox"
 	l.Styles.Title = lipgloss.NewStyle().MarginLeft(2)
@@ -89,6 +178,38 @@ func createLabelsList() list.Model {
 	return l
 }
 
+func createLabelPicker() list.Model {
+	delegate := createListDelegate()
+	delegate.ShowDescription = false
+	delegate.SetSpacing(0)
+	l := list.New([]list.Item{}, delegate, 0, 0)
+	l.Title = "Apply Labels"
+	l.Styles.Title = lipgloss.NewStyle().MarginLeft(2)
+	l.SetShowHelp(false)
+	l.DisableQuitKeybindings()
+	return l
+}
+
+func createDraftsList() list.Model {
+	l := list.New([]list.Item{}, createListDelegate(), 0, 0)
+	l.Title = "Drafts"
+	l.Styles.Title = lipgloss.NewStyle().MarginLeft(2)
+	l.SetShowHelp(false)
+	l.DisableQuitKeybindings()
+	l.KeyMap.Quit = key.NewBinding(key.WithKeys("q"))
+	return l
+}
+
+func createContactsList() list.Model {
+	l := list.New([]list.Item{}, createListDelegate(), 0, 0)
+	l.Title = "Contacts"
+	l.Styles.Title = lipgloss.NewStyle().MarginLeft(2)
+	l.SetShowHelp(false)
+	l.DisableQuitKeybindings()
+	l.KeyMap.Quit = key.NewBinding(key.WithKeys("q"))
+	return l
+}
+
 func createSpinner() spinner.Model {
 	s := spinner.New()
 	s.Spinner = spinner.Dot
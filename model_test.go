@@ -0,0 +1,496 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/charmbracelet/bubbles/spinner"
+	tea "github.com/charmbracelet/bubbletea"
+	"google.golang.org/api/gmail/v1"
+)
+
+// testInbox returns a backend holding n unread inbox messages, newest
+// first, paired into conversations
+func testInbox(n int) *memBackend {
+	var msgs []*gmail.Message
+	for i := 0; i < n; i++ {
+		msgs = append(msgs, &gmail.Message{
+			Id:           fmt.Sprint("m", i),
+			ThreadId:     fmt.Sprint("t", i/2),
+			InternalDate: int64(1000 - i),
+			LabelIds:     []string{"INBOX", "CATEGORY_PERSONAL", "UNREAD"},
+			Payload: &gmail.MessagePart{
+				MimeType: "text/plain",
+				Headers: []*gmail.MessagePartHeader{
+					{Name: "Subject", Value: fmt.Sprint("Subject ", i)},
+					{Name: "From", Value: "Alice <alice@example.com>"},
+				},
+				Body: &gmail.MessagePartBody{Data: "aGVsbG8gdGhlcmU"}, // "hello there"
+			},
+		})
+	}
+	return newMemBackend(msgs, nil)
+}
+
+// loadInbox builds the model the way main does and waits for the first
+// page to arrive
+func loadInbox(t *testing.T, b MailBackend) model {
+	t.Helper()
+	page, err := fetchInboxMessages(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m tea.Model = initialModel(page, b, nil)
+	m, _ = m.Update(tea.WindowSizeMsg{Width: 120, Height: 40})
+	m = runCmd(m, waitForItems(m.(model).fetch))
+	return m.(model)
+}
+
+// Toasts expire at once, so their timers don't hold tests up
+func init() {
+	noticeTimeout, errorTimeout = 0, 0
+}
+
+// runCmd executes cmd and everything it leads to, feeding each message back
+// into Update. Timers are told apart by what they deliver: spinner frames
+// would animate forever, and a toast's expiry would take it down before the
+// test sees it, so both are dropped.
+func runCmd(m tea.Model, cmd tea.Cmd) tea.Model {
+	if cmd == nil {
+		return m
+	}
+	switch msg := cmd().(type) {
+	case nil, spinner.TickMsg, toastExpiredMsg:
+		return m
+	case tea.BatchMsg:
+		for _, c := range msg {
+			m = runCmd(m, c)
+		}
+		return m
+	default:
+		m, cmd = m.Update(msg)
+		return runCmd(m, cmd)
+	}
+}
+
+// press sends each key in keys and runs what follows
+func press(m model, keys ...string) model {
+	var next tea.Model = m
+	for _, k := range keys {
+		var cmd tea.Cmd
+		next, cmd = next.Update(keyMsg(k))
+		next = runCmd(next, cmd)
+	}
+	return next.(model)
+}
+
+// hold sends key but returns what follows instead of running it, so a
+// test can decide when the backend answers
+func hold(m model, k string) (model, tea.Cmd) {
+	next, cmd := m.Update(keyMsg(k))
+	return next.(model), cmd
+}
+
+func keyMsg(k string) tea.KeyMsg {
+	switch k {
+	case "enter":
+		return tea.KeyMsg{Type: tea.KeyEnter}
+	case "esc":
+		return tea.KeyMsg{Type: tea.KeyEsc}
+	case "ctrl+o":
+		return tea.KeyMsg{Type: tea.KeyCtrlO}
+	case "ctrl+s":
+		return tea.KeyMsg{Type: tea.KeyCtrlS}
+	}
+	return tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune(k)}
+}
+
+// listed reports whether the message is a row of the list
+func listed(m model, id string) bool {
+	for _, item := range m.list.Items() {
+		if email, ok := item.(emailItem); ok && email.id == id {
+			return true
+		}
+	}
+	return false
+}
+
+func labelsOf(t *testing.T, b *memBackend, id string) []string {
+	t.Helper()
+	msg, err := b.GetMessage(context.Background(), id, "minimal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg.LabelIds
+}
+
+func TestInboxLoads(t *testing.T) {
+	m := loadInbox(t, testInbox(3))
+
+	if m.state != stateInbox {
+		t.Fatalf("state = %v, want inbox", m.state)
+	}
+	if got := len(m.list.Items()); got != 3 {
+		t.Fatalf("%d rows, want 3", got)
+	}
+	view := m.View()
+	for i := 0; i < 3; i++ {
+		if !strings.Contains(view, fmt.Sprint("Subject ", i)) {
+			t.Errorf("view lacks Subject %d:\n%s", i, view)
+		}
+	}
+}
+
+// failingGet fails to fetch one message, in any format or only in format
+type failingGet struct {
+	MailBackend
+	id     string
+	format string
+}
+
+func (b failingGet) GetMessage(ctx context.Context, id, format string) (*gmail.Message, error) {
+	if id == b.id && (b.format == "" || format == b.format) {
+		return nil, errors.New("backend error")
+	}
+	return b.MailBackend.GetMessage(ctx, id, format)
+}
+
+func TestRowThatFailsToLoadIsReported(t *testing.T) {
+	m := loadInbox(t, failingGet{testInbox(3), "m1", ""})
+
+	if !listed(m, "m0") || !listed(m, "m2") || listed(m, "m1") {
+		t.Error("want the rows that loaded, and only those")
+	}
+	if m.toast == nil || !m.toast.isError || !strings.Contains(m.toast.text, "m1") {
+		t.Errorf("toast = %+v, want an error naming m1", m.toast)
+	}
+}
+
+func TestTrashRemovesRow(t *testing.T) {
+	b := testInbox(3)
+	m := press(loadInbox(t, b), "d")
+
+	if listed(m, "m0") {
+		t.Error("trashed row is still listed")
+	}
+	if got := len(m.list.Items()); got != 2 {
+		t.Errorf("%d rows, want 2", got)
+	}
+	if strings.Contains(m.View(), "Subject 0") {
+		t.Error("trashed message is still shown")
+	}
+	labels := labelsOf(t, b, "m0")
+	if !containsString(labels, "TRASH") || containsString(labels, "INBOX") {
+		t.Errorf("labels = %v, want TRASH and no INBOX", labels)
+	}
+}
+
+func TestUndoTrash(t *testing.T) {
+	b := testInbox(3)
+	m := press(loadInbox(t, b), "d", "u")
+
+	if !listed(m, "m0") {
+		t.Error("undone row wasn't put back")
+	}
+	labels := labelsOf(t, b, "m0")
+	if containsString(labels, "TRASH") || !containsString(labels, "INBOX") {
+		t.Errorf("labels = %v, want INBOX and no TRASH", labels)
+	}
+}
+
+func TestOpenEmail(t *testing.T) {
+	m := press(loadInbox(t, testInbox(3)), "enter")
+
+	if m.currentMsg == nil || m.currentMsg.id != "m0" {
+		t.Fatalf("opened %v, want m0", m.currentMsg)
+	}
+	if !strings.Contains(m.View(), "hello there") {
+		t.Errorf("body not shown:\n%s", m.View())
+	}
+	m = press(m, "esc")
+	if m.state != stateInbox {
+		t.Errorf("state = %v after esc, want inbox", m.state)
+	}
+}
+
+func TestSupersededLoadFailureIsIgnored(t *testing.T) {
+	m := loadInbox(t, failingGet{testInbox(3), "m0", "full"})
+	m, stale := hold(m, "enter") // m0 fails to open, but only later
+	m = press(m, "esc", "j")
+	want, _ := m.selectedEmail()
+	m, load := hold(m, "enter")
+
+	m = runCmd(m, stale).(model)
+	if m.state != stateLoading {
+		t.Errorf("state = %v after an abandoned load failed, want still loading", m.state)
+	}
+	if m.toast != nil && m.toast.isError {
+		t.Errorf("abandoned load reported %q", m.toast.text)
+	}
+
+	m = runCmd(m, load).(model)
+	if m.currentMsg == nil || m.currentMsg.id != want.id {
+		t.Errorf("opened %v, want %s", m.currentMsg, want.id)
+	}
+}
+
+func TestArchiveAndToggleRead(t *testing.T) {
+	b := testInbox(3)
+	m := press(loadInbox(t, b), "m")
+	if containsString(labelsOf(t, b, "m0"), "UNREAD") {
+		t.Error("m didn't mark the message read")
+	}
+
+	m = press(m, "e")
+	if containsString(labelsOf(t, b, "m0"), "INBOX") {
+		t.Error("e didn't archive the message")
+	}
+	if listed(m, "m0") {
+		t.Error("archived row is still listed in the inbox")
+	}
+}
+
+func TestRejectedChangeIsRolledBack(t *testing.T) {
+	tests := []struct {
+		name string
+		open bool // act on the open message instead of the row
+		key  string
+	}{
+		{"trash", false, "d"},
+		{"archive", false, "e"},
+		{"toggle read", false, "m"},
+		{"trash open message", true, "d"},
+		{"archive open message", true, "e"},
+		{"toggle read of open message", true, "m"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := testInbox(3)
+			m := loadInbox(t, b)
+			if tt.open {
+				m = press(m, "enter")
+			}
+			before, _ := m.selectedEmail()
+			var current emailItem
+			if tt.open {
+				current = *m.currentMsg
+			}
+
+			b.FailModify(func(string) error { return errors.New("backend error") })
+			m = press(m, tt.key)
+
+			i := itemIndex(m.list.Items(), "m0")
+			if i < 0 {
+				t.Fatal("rejected change left the row out")
+			}
+			if got := m.list.Items()[i].(emailItem); !reflect.DeepEqual(got.labels, before.labels) {
+				t.Errorf("row labels = %v, want %v", got.labels, before.labels)
+			}
+			if tt.open && !reflect.DeepEqual(m.currentMsg.labels, current.labels) {
+				t.Errorf("open message labels = %v, want %v", m.currentMsg.labels, current.labels)
+			}
+			if m.toast == nil || !m.toast.isError || !strings.Contains(m.toast.text, "backend error") {
+				t.Errorf("toast = %+v, want the error", m.toast)
+			}
+		})
+	}
+}
+
+func TestUndoBulkMarkReadRestoresEachMessage(t *testing.T) {
+	b := testInbox(3)
+	b.messages["m1"].LabelIds = []string{"INBOX", "CATEGORY_PERSONAL"} // already read
+	m := press(loadInbox(t, b), "*", "m")
+	for _, id := range []string{"m0", "m1", "m2"} {
+		if containsString(labelsOf(t, b, id), "UNREAD") {
+			t.Fatalf("%s wasn't marked read", id)
+		}
+	}
+
+	press(m, "u")
+	for id, wantUnread := range map[string]bool{"m0": true, "m1": false, "m2": true} {
+		if got := containsString(labelsOf(t, b, id), "UNREAD"); got != wantUnread {
+			t.Errorf("%s unread = %v after undo, want %v", id, got, wantUnread)
+		}
+	}
+}
+
+func TestFailedUndoKeepsTheRest(t *testing.T) {
+	b := testInbox(3)
+	m := loadInbox(t, b)
+	ids := []string{"m0", "m1", "m2"}
+	rows := undoRows(m.list.Items(), ids)
+	m = press(m, "*", "d")
+	if listed(m, "m0") || listed(m, "m1") || listed(m, "m2") {
+		t.Fatal("trashed rows are still listed")
+	}
+	// Undo message by message, so that one can fail partway
+	m.undo = []*undoAction{{note: "Moved 3 messages to trash", ids: ids, untrash: true, rows: rows}}
+
+	b.FailModify(func(id string) error {
+		if id == "m1" {
+			return errors.New("backend error")
+		}
+		return nil
+	})
+	m = press(m, "u")
+	if !listed(m, "m0") || listed(m, "m1") {
+		t.Error("only the rows undone before the failure should be back")
+	}
+	if m.toast == nil || !m.toast.isError || !strings.Contains(m.toast.text, "undid 1 of 3 messages") {
+		t.Errorf("toast = %+v, want an error saying 1 of 3 was undone", m.toast)
+	}
+
+	b.FailModify(nil)
+	m = press(m, "u")
+	for _, id := range []string{"m0", "m1", "m2"} {
+		if !listed(m, id) || containsString(labelsOf(t, b, id), "TRASH") {
+			t.Errorf("%s wasn't restored by undoing again", id)
+		}
+	}
+	if len(m.undo) != 0 {
+		t.Errorf("%d actions left to undo, want none", len(m.undo))
+	}
+}
+
+func TestReverseLabels(t *testing.T) {
+	tests := []struct {
+		name        string
+		before      map[string][]string
+		add, remove []string
+		want        []labelChange
+	}{
+		{
+			name:   "archive over inbox and archived mail",
+			before: map[string][]string{"a": {"INBOX"}, "b": {"Label_1"}},
+			remove: []string{"INBOX"},
+			want:   []labelChange{{ids: []string{"a"}, add: []string{"INBOX"}}},
+		},
+		{
+			name:   "mark read over read and unread mail",
+			before: map[string][]string{"a": {"UNREAD"}, "b": nil, "c": {"UNREAD", "INBOX"}},
+			remove: []string{"UNREAD"},
+			want:   []labelChange{{ids: []string{"a", "c"}, add: []string{"UNREAD"}}},
+		},
+		{
+			name:   "spam on an archived message",
+			before: map[string][]string{"a": {"Label_1"}},
+			add:    []string{"SPAM"},
+			remove: []string{"INBOX"},
+			want:   []labelChange{{ids: []string{"a"}, remove: []string{"SPAM"}}},
+		},
+		{
+			name:   "trash over mixed mail groups by reversal",
+			before: map[string][]string{"a": {"INBOX"}, "b": nil, "c": {"INBOX", "STARRED"}},
+			add:    []string{"TRASH"},
+			remove: []string{"INBOX"},
+			want: []labelChange{
+				{ids: []string{"a", "c"}, add: []string{"INBOX"}, remove: []string{"TRASH"}},
+				{ids: []string{"b"}, remove: []string{"TRASH"}},
+			},
+		},
+		{
+			name:   "unknown messages are left alone",
+			before: map[string][]string{},
+			add:    []string{"STARRED"},
+			want:   nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ids := []string{"a", "b", "c"}
+			got := reverseLabels("note", tt.before, ids, tt.add, tt.remove).changes
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("changes = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadMutedThreadsPagesAndIgnoresOtherLabels(t *testing.T) {
+	labels := []*gmail.Label{
+		{Id: "Label_user", Name: "Muted", Type: "user"},
+		{Id: "Label_app", Name: mutedLabelName, Type: "user"},
+	}
+	var msgs []*gmail.Message
+	for i := 0; i < 1200; i++ {
+		label := "Label_app"
+		if i%2 == 1 {
+			label = "Label_user"
+		}
+		msgs = append(msgs, &gmail.Message{Id: fmt.Sprint("m", i), ThreadId: fmt.Sprint("t", i), LabelIds: []string{label}})
+	}
+
+	msg := loadMutedThreads(newMemBackend(msgs, labels), labels)()
+	muted, ok := msg.(mutedThreadsMsg)
+	if !ok {
+		t.Fatalf("got %#v", msg)
+	}
+	if len(muted.threadIDs) != 600 {
+		t.Errorf("%d muted threads, want 600", len(muted.threadIDs))
+	}
+	for _, id := range muted.threadIDs {
+		if id == "t1" {
+			t.Error("a thread with the user's own Muted label counts as muted")
+			break
+		}
+	}
+}
+
+// composing opens the compose form with a message typed in
+func composing(t *testing.T, b *memBackend) model {
+	t.Helper()
+	m := press(loadInbox(t, b), "c")
+	m.composeTo.SetValue("bob@example.com")
+	m.composeSubj.SetValue("Lunch")
+	m.composeBody.SetValue("See you at noon")
+	return m
+}
+
+func draftCount(t *testing.T, b *memBackend) int {
+	t.Helper()
+	drafts, err := b.ListDrafts(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(drafts)
+}
+
+func TestSendWhileDraftIsCreated(t *testing.T) {
+	b := testInbox(1)
+	m, create := hold(composing(t, b), "ctrl+o")
+	m, send := hold(m, "ctrl+s")
+	runCmd(m, tea.Batch(create, send))
+
+	if n := draftCount(t, b); n != 0 {
+		t.Errorf("%d drafts left behind, want 0", n)
+	}
+	if n := len(b.Sent()); n != 1 {
+		t.Errorf("%d messages sent, want 1", n)
+	}
+}
+
+func TestLateDraftSaveKeepsToItsForm(t *testing.T) {
+	b := testInbox(1)
+	m, create := hold(composing(t, b), "ctrl+o")
+	m, save := hold(m, "esc")
+	if save != nil {
+		// The save on leaving waits for the create rather than making a
+		// second draft
+		m = runCmd(m, save).(model)
+	}
+	m = press(m, "c")
+	m = runCmd(m, create).(model)
+
+	if m.draftID != "" {
+		t.Errorf("new compose form took draft %q from the old one", m.draftID)
+	}
+	if n := draftCount(t, b); n != 1 {
+		t.Errorf("%d drafts, want 1", n)
+	}
+}
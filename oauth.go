@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// authTimeout is how long to wait for Google to redirect back once the
+// browser has been opened
+const authTimeout = 5 * time.Minute
+
+const authDonePage = `<!DOCTYPE html>
+<html><head><title>gmail-tui</title></head>
+<body><p>gmail-tui is authorized. You can close this tab and go back to the terminal.</p></body></html>
+`
+
+// authResult is the authorization code, or why there isn't one
+type authResult struct {
+	code string
+	err  error
+}
+
+// performOAuthFlow runs the installed-app authorization code flow. Google
+// redirects back to a listener on 127.0.0.1, so nothing has to be copied
+// out of the browser; where no browser can be opened, or it runs on
+// another machine, the redirected URL can be pasted into the terminal
+// instead. A random state ties the redirect to this attempt and PKCE ties
+// the code to this process, so neither a forged redirect nor an
+// intercepted code can be used to sign in.
+func performOAuthFlow(ctx context.Context, config *oauth2.Config) (*oauth2.Token, error) {
+	return runOAuthFlow(ctx, config, os.Stdin, os.Stdout, openBrowser)
+}
+
+func runOAuthFlow(ctx context.Context, config *oauth2.Config, in io.Reader, out io.Writer, open func(string) error) (*oauth2.Token, error) {
+	state, err := randomState()
+	if err != nil {
+		return nil, err
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	cfg := *config
+	results := make(chan authResult, 1)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fmt.Fprintf(out, "Could not listen for the redirect (%v); you'll need to paste it.\n", err)
+	} else {
+		cfg.RedirectURL = "http://" + listener.Addr().String() + "/"
+		srv := &http.Server{Handler: callbackHandler(state, results), ReadHeaderTimeout: 10 * time.Second}
+		go srv.Serve(listener)
+		defer srv.Close()
+	}
+
+	// Request offline access and force consent so Google returns a refresh token.
+	authURL := cfg.AuthCodeURL(state,
+		oauth2.AccessTypeOffline,
+		oauth2.SetAuthURLParam("prompt", "consent"),
+		oauth2.S256ChallengeOption(verifier),
+	)
+
+	var code string
+	if listener != nil && open(authURL) == nil {
+		fmt.Fprintf(out, "\nAuthorization required. Your browser has been opened; if nothing appeared, visit:\n%s\n\nWaiting for authorization...\n", authURL)
+		code, err = awaitCallback(ctx, results)
+	} else {
+		fmt.Fprintf(out, "\nAuthorization required. Please visit:\n%s\n\n", authURL)
+		fmt.Fprint(out, "After approving, paste the address the browser was sent to (or just the code): ")
+		code, err = awaitPaste(ctx, results, in, out, state)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := cfg.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return nil, fmt.Errorf("failed to exchange authorization code: %w", err)
+	}
+	return token, nil
+}
+
+// callbackHandler receives Google's redirect, passing on the code when the
+// state matches. Anything else is answered with an error and ignored, so a
+// stray or forged request can't end the wait.
+func callbackHandler(state string, results chan<- authResult) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+
+		code, err := codeFromQuery(r.URL.Query(), state)
+		if err != nil && !errors.Is(err, errAuthDenied) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error()+". You can close this tab.", http.StatusForbidden)
+		} else {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			io.WriteString(w, authDonePage)
+		}
+		select {
+		case results <- authResult{code: code, err: err}:
+		default:
+		}
+	})
+}
+
+var errAuthDenied = errors.New("authorization was denied")
+
+// codeFromQuery returns the code from the query of a redirect, checking it
+// answers the request made with state
+func codeFromQuery(query url.Values, state string) (string, error) {
+	if subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(state)) != 1 {
+		return "", errors.New("authorization state doesn't match; start again from the link in the terminal")
+	}
+	if e := query.Get("error"); e != "" {
+		return "", fmt.Errorf("%w: %s", errAuthDenied, e)
+	}
+	code := query.Get("code")
+	if code == "" {
+		return "", errors.New("the redirect carried no authorization code")
+	}
+	return code, nil
+}
+
+func awaitCallback(ctx context.Context, results <-chan authResult) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, authTimeout)
+	defer cancel()
+
+	select {
+	case result := <-results:
+		return result.code, result.err
+	case <-ctx.Done():
+		return "", fmt.Errorf("gave up waiting for authorization: %w", ctx.Err())
+	}
+}
+
+// awaitPaste reads the code from the terminal, still taking the redirect
+// if it arrives first
+func awaitPaste(ctx context.Context, results <-chan authResult, in io.Reader, out io.Writer, state string) (string, error) {
+	lines := make(chan authResult, 1)
+	go func() {
+		line, err := bufio.NewReader(in).ReadString('\n')
+		if err != nil && line == "" {
+			lines <- authResult{err: fmt.Errorf("failed to read authorization code: %w", err)}
+			return
+		}
+		code, err := parsePastedCode(line, state)
+		lines <- authResult{code: code, err: err}
+	}()
+
+	select {
+	case result := <-lines:
+		return result.code, result.err
+	case result := <-results:
+		// The terminal read can't be abandoned, and left running it would
+		// take the first keystrokes meant for the UI
+		fmt.Fprint(out, "\nAuthorized in the browser. Press Enter to continue.")
+		<-lines
+		return result.code, result.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// parsePastedCode accepts the address the browser was redirected to, whose
+// state must match, or the bare code copied out of it
+func parsePastedCode(line, state string) (string, error) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return "", errors.New("no authorization code entered")
+	}
+	if !strings.Contains(line, "://") {
+		return line, nil
+	}
+
+	u, err := url.Parse(line)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse pasted address: %w", err)
+	}
+	return codeFromQuery(u.Query(), state)
+}
+
+// randomState returns an unguessable value for the state parameter
+func randomState() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate state: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// openBrowser opens url in the desktop's browser. It fails where there is
+// no desktop, rather than starting a text browser over the terminal.
+func openBrowser(url string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", url)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	default:
+		if os.Getenv("DISPLAY") == "" && os.Getenv("WAYLAND_DISPLAY") == "" {
+			return errors.New("no display")
+		}
+		cmd = exec.Command("xdg-open", url)
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go cmd.Wait()
+	return nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+// fakeAuthServer is a token endpoint that issues a token for code "good"
+// when the PKCE verifier matches the challenge the flow sent the browser to
+type fakeAuthServer struct {
+	*httptest.Server
+	mu        sync.Mutex
+	challenge string
+	verifier  string
+}
+
+func newFakeAuthServer(t *testing.T) *fakeAuthServer {
+	s := &fakeAuthServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/token" {
+			http.NotFound(w, r)
+			return
+		}
+		r.ParseForm()
+		s.mu.Lock()
+		s.verifier = r.Form.Get("code_verifier")
+		sum := sha256.Sum256([]byte(s.verifier))
+		matches := base64.RawURLEncoding.EncodeToString(sum[:]) == s.challenge
+		s.mu.Unlock()
+
+		if r.Form.Get("code") != "good" || !matches {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `{"error":"invalid_grant"}`)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"access_token":"access","token_type":"Bearer","refresh_token":"refresh","expires_in":3600,"scope":"https://mail.google.com/"}`)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *fakeAuthServer) config() *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:    "client",
+		RedirectURL: "http://localhost",
+		Endpoint:    oauth2.Endpoint{AuthURL: s.URL + "/auth", TokenURL: s.URL + "/token"},
+	}
+}
+
+// authorizeURL checks the URL the flow sends the browser to and returns
+// its query, remembering the challenge for the token endpoint
+func (s *fakeAuthServer) authorizeURL(t *testing.T, authURL string) url.Values {
+	t.Helper()
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		t.Errorf("auth URL has no S256 challenge: %s", authURL)
+	}
+	if q.Get("state") == "" {
+		t.Errorf("auth URL has no state: %s", authURL)
+	}
+	s.mu.Lock()
+	s.challenge = q.Get("code_challenge")
+	s.mu.Unlock()
+	return q
+}
+
+// redirect plays the browser following Google's redirect back to us
+func redirect(t *testing.T, redirectURI string, params url.Values) int {
+	t.Helper()
+	resp, err := http.Get(redirectURI + "?" + params.Encode())
+	if err != nil {
+		t.Errorf("redirect: %v", err)
+		return 0
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestOAuthFlowBrowser(t *testing.T) {
+	server := newFakeAuthServer(t)
+	open := func(authURL string) error {
+		q := server.authorizeURL(t, authURL)
+		redirectURI := q.Get("redirect_uri")
+		if !strings.HasPrefix(redirectURI, "http://127.0.0.1:") {
+			t.Errorf("redirect URI isn't loopback: %s", redirectURI)
+		}
+		go func() {
+			// A forged redirect is refused and doesn't end the wait
+			if status := redirect(t, redirectURI, url.Values{"state": {"forged"}, "code": {"evil"}}); status != http.StatusBadRequest {
+				t.Errorf("forged state answered %d, want 400", status)
+			}
+			if status := redirect(t, redirectURI, url.Values{"state": {q.Get("state")}, "code": {"good"}}); status != http.StatusOK {
+				t.Errorf("redirect answered %d, want 200", status)
+			}
+		}()
+		return nil
+	}
+
+	token, err := runOAuthFlow(context.Background(), server.config(), strings.NewReader(""), io.Discard, open)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.AccessToken != "access" || token.RefreshToken != "refresh" {
+		t.Errorf("token = %+v", token)
+	}
+	if server.verifier == "" {
+		t.Error("no code_verifier was sent to the token endpoint")
+	}
+}
+
+func TestOAuthFlowDenied(t *testing.T) {
+	server := newFakeAuthServer(t)
+	open := func(authURL string) error {
+		q := server.authorizeURL(t, authURL)
+		go func() {
+			if status := redirect(t, q.Get("redirect_uri"), url.Values{"state": {q.Get("state")}, "error": {"access_denied"}}); status != http.StatusForbidden {
+				t.Errorf("denied redirect answered %d, want 403", status)
+			}
+		}()
+		return nil
+	}
+
+	_, err := runOAuthFlow(context.Background(), server.config(), strings.NewReader(""), io.Discard, open)
+	if !errors.Is(err, errAuthDenied) || !strings.Contains(err.Error(), "access_denied") {
+		t.Errorf("err = %v, want access_denied", err)
+	}
+}
+
+func TestOAuthFlowPaste(t *testing.T) {
+	tests := []struct {
+		name    string
+		paste   func(state string) string
+		wantErr bool
+	}{
+		{"redirected URL", func(state string) string { return "http://127.0.0.1:1/?state=" + state + "&code=good" }, false},
+		{"bare code", func(string) string { return "  good  " }, false},
+		{"URL with wrong state", func(string) string { return "http://127.0.0.1:1/?state=forged&code=good" }, true},
+		{"nothing", func(string) string { return "" }, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeAuthServer(t)
+			in, typed := io.Pipe()
+			noBrowser := func(authURL string) error {
+				q := server.authorizeURL(t, authURL)
+				go io.WriteString(typed, tt.paste(q.Get("state"))+"\n")
+				return errors.New("no display")
+			}
+
+			token, err := runOAuthFlow(context.Background(), server.config(), in, io.Discard, noBrowser)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("accepted, got token %+v", token)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if token.AccessToken != "access" {
+				t.Errorf("token = %+v", token)
+			}
+		})
+	}
+}
+
+func TestParsePastedCode(t *testing.T) {
+	tests := []struct {
+		line, want string
+		wantErr    bool
+	}{
+		{"abc\n", "abc", false},
+		{"http://127.0.0.1:5555/?state=s&code=abc&scope=x", "abc", false},
+		{"http://127.0.0.1:5555/?state=other&code=abc", "", true},
+		{"http://127.0.0.1:5555/?state=s&error=access_denied", "", true},
+		{"http://127.0.0.1:5555/?state=s", "", true},
+		{"\n", "", true},
+	}
+	for _, tt := range tests {
+		got, err := parsePastedCode(tt.line, "s")
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parsePastedCode(%q) = %q, %v; want %q, error %v", tt.line, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
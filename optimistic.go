@@ -0,0 +1,112 @@
+package main
+
+import (
+	tea "github.com/charmbracelet/bubbletea"
+	"google.golang.org/api/gmail/v1"
+)
+
+// actionFailedMsg reports that a change already shown on the rows was
+// rejected, carrying the rows as they were so it can be rolled back
+type actionFailedMsg struct {
+	rows    []emailItem
+	current *emailItem // the open message, if the change touched it
+	err     error
+}
+
+// optimistic applies a label change to the loaded rows of ids straight
+// away instead of waiting for the server, then runs cmd. If cmd fails the
+// rows are put back; if it succeeds its undo remembers them as they were
+// and reverses the change from the labels they had.
+func (m *model) optimistic(cmd tea.Cmd, ids, add, remove []string) tea.Cmd {
+	rows := undoRows(m.list.Items(), ids)
+	var current *emailItem
+	if m.currentMsg != nil && containsString(ids, m.currentMsg.id) {
+		saved := *m.currentMsg
+		current = &saved
+	}
+
+	var modified []*gmail.Message
+	for _, row := range rows {
+		modified = append(modified, &gmail.Message{Id: row.id, LabelIds: applyLabelChanges(row.labels, add, remove)})
+	}
+	if current != nil && itemIndex(m.list.Items(), current.id) < 0 {
+		modified = append(modified, &gmail.Message{Id: current.id, LabelIds: applyLabelChanges(current.labels, add, remove)})
+	}
+	setCmd := m.relabelRows(modified)
+
+	before := labelsBefore(rows)
+	if current != nil {
+		before[current.id] = current.labels
+	}
+
+	return tea.Batch(setCmd, func() tea.Msg {
+		switch msg := cmd().(type) {
+		case emailLoadErrorMsg:
+			return actionFailedMsg{rows: rows, current: current, err: msg.err}
+		case messagesModifiedMsg:
+			if msg.undo != nil && !msg.undo.untrash {
+				msg.undo = reverseLabels(msg.undo.note, before, msg.undo.ids, add, remove)
+			}
+			if msg.undo != nil {
+				msg.undo.rows = rows
+			}
+			return msg
+		case threadModifiedMsg:
+			if msg.undo != nil {
+				msg.undo.rows = rows
+			}
+			return msg
+		default:
+			return msg
+		}
+	})
+}
+
+// rowsOf returns the rows among rows whose ID is one of ids
+func rowsOf(rows []emailItem, ids []string) []emailItem {
+	var result []emailItem
+	for _, row := range rows {
+		if containsString(ids, row.id) {
+			result = append(result, row)
+		}
+	}
+	return result
+}
+
+// threadMessageIDs returns the IDs of the loaded messages of a conversation
+func (m model) threadMessageIDs(threadID string) []string {
+	var ids []string
+	for _, item := range m.list.Items() {
+		if e, ok := item.(emailItem); ok && e.threadId == threadID {
+			ids = append(ids, e.id)
+		}
+	}
+	return ids
+}
+
+// restoreRows puts rows back as they were, keeping only those that belong
+// in the current listing
+func (m *model) restoreRows(rows []emailItem) tea.Cmd {
+	items := m.list.Items()
+	for _, row := range rows {
+		if m.belongsInList(row.labels) {
+			items = upsertItem(items, row)
+		} else {
+			items = removeItem(items, row.id)
+		}
+		if m.currentMsg != nil && m.currentMsg.id == row.id {
+			current := withLabels(*m.currentMsg, row.labels)
+			m.currentMsg = &current
+		}
+	}
+	return m.setItems(items)
+}
+
+// handleActionFailed rolls back a change the server rejected
+func (m model) handleActionFailed(msg actionFailedMsg) (tea.Model, tea.Cmd) {
+	cmd := m.restoreRows(msg.rows)
+	if msg.current != nil && m.currentMsg != nil && m.currentMsg.id == msg.current.id {
+		m.currentMsg = msg.current
+	}
+	return m, tea.Batch(cmd, m.notifyError(msg.err))
+}
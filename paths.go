@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Environment variables that override where files are kept. A flag beats
+// its variable, and the variable beats the XDG default.
+const (
+	credentialsEnv = "GMAIL_TUI_CREDENTIALS"
+	tokenEnv       = "GMAIL_TUI_TOKEN"
+	configDirEnv   = "GMAIL_TUI_CONFIG_DIR"
+	cacheDirEnv    = "GMAIL_TUI_CACHE_DIR"
+	downloadDirEnv = "GMAIL_TUI_DOWNLOAD_DIR"
+)
+
+// appPaths finds the files gmail-tui reads and writes. Each is resolved
+// when it's needed, so that one that can't be found only stops what uses it.
+type appPaths struct {
+	credentials string
+	token       string
+	configDir   string
+	cacheDir    string
+	downloadDir string
+}
+
+// registerFlags adds the path flags to flags
+func (p *appPaths) registerFlags(flags *flag.FlagSet) {
+	flags.StringVar(&p.credentials, "credentials", "", "OAuth client `file` downloaded from Google Cloud (env "+credentialsEnv+")")
+	flags.StringVar(&p.token, "token", "", "`file` the sign-in token is kept in (env "+tokenEnv+")")
+	flags.StringVar(&p.configDir, "config-dir", "", "`directory` for the token, credentials and contacts (env "+configDirEnv+")")
+	flags.StringVar(&p.cacheDir, "cache-dir", "", "`directory` for the offline message cache (env "+cacheDirEnv+")")
+	flags.StringVar(&p.downloadDir, "download-dir", "", "`directory` attachments are saved to (env "+downloadDirEnv+")")
+}
+
+// override returns the flag value if set, else the environment variable
+func override(flagValue, env string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	return os.Getenv(env)
+}
+
+// configPath returns the config directory: $XDG_CONFIG_HOME/gmail-tui or
+// the platform equivalent
+func (p appPaths) configPath() (string, error) {
+	if dir := override(p.configDir, configDirEnv); dir != "" {
+		return dir, nil
+	}
+	base, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to determine config directory (set --config-dir or %s): %w", configDirEnv, err)
+	}
+	return filepath.Join(base, cacheDirName), nil
+}
+
+// cachePath returns the cache directory: $XDG_CACHE_HOME/gmail-tui or the
+// platform equivalent
+func (p appPaths) cachePath() (string, error) {
+	if dir := override(p.cacheDir, cacheDirEnv); dir != "" {
+		return dir, nil
+	}
+	base, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to determine cache directory (set --cache-dir or %s): %w", cacheDirEnv, err)
+	}
+	return filepath.Join(base, cacheDirName), nil
+}
+
+// tokenPath returns the token file, by default token.json in the config
+// directory. A token left in the home directory by older versions is
+// moved there first.
+func (p appPaths) tokenPath() (string, error) {
+	if path := override(p.token, tokenEnv); path != "" {
+		return path, nil
+	}
+	dir, err := p.configPath()
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, tokenFile)
+
+	if err := migrateLegacyToken(path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// contactsPath returns the address book file in the config directory
+func (p appPaths) contactsPath() (string, error) {
+	dir, err := p.configPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, contactsFile), nil
+}
+
+// downloadPath returns where attachments are saved: $XDG_DOWNLOAD_DIR, as
+// set in the environment or by xdg-user-dirs, or Downloads in the home
+// directory
+func (p appPaths) downloadPath() (string, error) {
+	if dir := override(p.downloadDir, downloadDirEnv); dir != "" {
+		return dir, nil
+	}
+	if dir := os.Getenv("XDG_DOWNLOAD_DIR"); dir != "" {
+		return dir, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to determine download directory (set --download-dir or %s): %w", downloadDirEnv, err)
+	}
+	if base, err := os.UserConfigDir(); err == nil {
+		if data, err := os.ReadFile(filepath.Join(base, "user-dirs.dirs")); err == nil {
+			if dir := userDir(string(data), "XDG_DOWNLOAD_DIR", home); dir != "" {
+				return dir, nil
+			}
+		}
+	}
+	return filepath.Join(home, "Downloads"), nil
+}
+
+// userDir reads a directory from the user-dirs.dirs file xdg-user-dirs
+// writes, where each is a shell assignment such as
+// XDG_DOWNLOAD_DIR="$HOME/Downloads". Only an absolute path or one under
+// $HOME is allowed there.
+func userDir(dirs, name, home string) string {
+	for _, line := range strings.Split(dirs, "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok || key != name {
+			continue
+		}
+		value = strings.Trim(value, `"`)
+		switch {
+		case value == "$HOME":
+			return home
+		case strings.HasPrefix(value, "$HOME/"):
+			return filepath.Join(home, strings.TrimPrefix(value, "$HOME/"))
+		case filepath.IsAbs(value):
+			return value
+		}
+	}
+	return ""
+}
+
+// credentialsPath finds the OAuth client file. A file named by flag or
+// environment must exist; otherwise the config directory is searched,
+// then the current directory, where older versions expected it.
+func (p appPaths) credentialsPath() (string, error) {
+	if path := p.credentials; path != "" {
+		return findFile(credentialsFile, []searchedPath{{path: path, source: "--credentials"}})
+	}
+	if path := os.Getenv(credentialsEnv); path != "" {
+		return findFile(credentialsFile, []searchedPath{{path: path, source: credentialsEnv}})
+	}
+
+	var candidates []searchedPath
+	if dir, err := p.configPath(); err == nil {
+		candidates = append(candidates, searchedPath{path: filepath.Join(dir, credentialsFile), source: "config directory"})
+	} else {
+		candidates = append(candidates, searchedPath{source: "config directory", err: err})
+	}
+	candidates = append(candidates, searchedPath{path: credentialsFile, source: "current directory"})
+
+	path, err := findFile(credentialsFile, candidates)
+	if err != nil {
+		return "", fmt.Errorf("%w\nDownload an OAuth client for a desktop app from Google Cloud and save it to the first of these, or name it with --credentials or %s", err, credentialsEnv)
+	}
+	return path, nil
+}
+
+// searchedPath is a place a file was looked for, and why. err is set when
+// the place itself couldn't be worked out.
+type searchedPath struct {
+	path   string
+	source string
+	err    error
+}
+
+// findFile returns the first of candidates that exists, or an error
+// listing all of them
+func findFile(name string, candidates []searchedPath) (string, error) {
+	var tried []string
+	for _, c := range candidates {
+		if c.err != nil {
+			tried = append(tried, fmt.Sprintf("  (%s): %v", c.source, c.err))
+			continue
+		}
+		info, err := os.Stat(c.path)
+		if err == nil && !info.IsDir() {
+			return c.path, nil
+		}
+
+		reason := "not found"
+		switch {
+		case err == nil:
+			reason = "is a directory"
+		case !errors.Is(err, fs.ErrNotExist):
+			reason = err.Error()
+		}
+		path := c.path
+		if abs, err := filepath.Abs(path); err == nil {
+			path = abs
+		}
+		tried = append(tried, fmt.Sprintf("  %s (%s): %s", path, c.source, reason))
+	}
+	return "", fmt.Errorf("%s not found; searched:\n%s", name, strings.Join(tried, "\n"))
+}
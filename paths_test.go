@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUserDir(t *testing.T) {
+	dirs := `# This file is written by xdg-user-dirs-update
+XDG_DESKTOP_DIR="$HOME/Desktop"
+XDG_DOWNLOAD_DIR="$HOME/Stuff/Downloads"
+XDG_MUSIC_DIR="/srv/music"
+XDG_VIDEOS_DIR="$HOME"
+`
+	tests := []struct{ name, want string }{
+		{"XDG_DOWNLOAD_DIR", "/home/ann/Stuff/Downloads"},
+		{"XDG_MUSIC_DIR", "/srv/music"},
+		{"XDG_VIDEOS_DIR", "/home/ann"},
+		{"XDG_PICTURES_DIR", ""},
+	}
+	for _, tt := range tests {
+		if got := userDir(dirs, tt.name, "/home/ann"); got != tt.want {
+			t.Errorf("userDir(%s) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDownloadPathReadsUserDirs(t *testing.T) {
+	home, config := t.TempDir(), t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", config)
+	t.Setenv("XDG_DOWNLOAD_DIR", "")
+	t.Setenv(downloadDirEnv, "")
+	if err := os.WriteFile(filepath.Join(config, "user-dirs.dirs"), []byte(`XDG_DOWNLOAD_DIR="$HOME/Téléchargements"`+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := appPaths{}.downloadPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(home, "Téléchargements"); got != want {
+		t.Errorf("downloadPath = %q, want %q", got, want)
+	}
+}
+
+func TestCredentialsPathListsUnknownConfigDir(t *testing.T) {
+	t.Setenv("HOME", "")
+	t.Setenv("XDG_CONFIG_HOME", "")
+	t.Setenv(configDirEnv, "")
+	t.Setenv(credentialsEnv, "")
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	_, err = appPaths{}.credentialsPath()
+	if err == nil {
+		t.Fatal("found credentials in an empty directory")
+	}
+	if !strings.Contains(err.Error(), "(config directory): failed to determine config directory") {
+		t.Errorf("error doesn't say why the config directory wasn't searched:\n%v", err)
+	}
+}
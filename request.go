@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// request is an in-flight load a screen is waiting on: a listing, or the
+// message, conversation or draft being opened. Starting a new request in
+// the same slot cancels the old one, and its ID travels with the result so
+// that anything overtaken or abandoned with esc is dropped on arrival.
+// Changes to mail (trash, labels, sending) aren't requests; leaving the
+// screen shouldn't abandon them half done.
+type request struct {
+	id     int
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+type requestIDKey struct{}
+
+// startRequest cancels the request in slot, if any, and starts a new one
+// in its place, returning its context
+func (m *model) startRequest(slot *request) context.Context {
+	slot.stop()
+	m.requestSeq++
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), requestIDKey{}, m.requestSeq))
+	*slot = request{id: m.requestSeq, ctx: ctx, cancel: cancel}
+	return ctx
+}
+
+// stop cancels the request so its result is ignored
+func (r *request) stop() {
+	if r.cancel != nil {
+		r.cancel()
+	}
+	*r = request{}
+}
+
+// current reports whether a result with this ID is what the slot waits on
+func (r request) current(id int) bool {
+	return id != 0 && id == r.id
+}
+
+// cancelLoading abandons whatever the loading screen is waiting for and
+// goes back to the inbox
+func (m model) cancelLoading() (tea.Model, tea.Cmd) {
+	m.screenRequest.stop()
+	if m.listLoading {
+		m.listRequest.stop()
+		m.fetch = nil
+		m.listLoading = false
+	}
+	m.state = stateInbox
+	return m, showNotification("Cancelled")
+}
+
+// requestID returns the ID of the request ctx belongs to, or 0
+func requestID(ctx context.Context) int {
+	id, _ := ctx.Value(requestIDKey{}).(int)
+	return id
+}
+
+// isCanceled reports whether err is only a request being abandoned
+func isCanceled(err error) bool {
+	return errors.Is(err, context.Canceled)
+}
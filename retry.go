@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	// maxAttempts is how many times a call is tried before giving up
+	maxAttempts = 5
+	// retryBaseDelay doubles on each retry, up to retryMaxDelay
+	retryBaseDelay = 500 * time.Millisecond
+	retryMaxDelay  = 30 * time.Second
+	// quotaUnitsPerSecond is Gmail's per-user rate limit
+	quotaUnitsPerSecond = 250
+)
+
+// gmailOp describes an API method: its cost in quota units and whether
+// repeating it is harmless. Calls that aren't idempotent, like sending,
+// are only retried when Gmail rejected them outright for rate limiting.
+type gmailOp struct {
+	name       string
+	units      int
+	idempotent bool
+}
+
+var (
+	opListMessages  = gmailOp{"messages.list", 5, true}
+	opGetMessage    = gmailOp{"messages.get", 5, true}
+	opSendMessage   = gmailOp{"messages.send", 100, false}
+	opModifyMessage = gmailOp{"messages.modify", 5, true}
+	opTrashMessage  = gmailOp{"messages.trash", 5, true}
+	opUntrash       = gmailOp{"messages.untrash", 5, true}
+	opBatchModify   = gmailOp{"messages.batchModify", 50, true}
+	opBatchDelete   = gmailOp{"messages.batchDelete", 50, true}
+	opListLabels    = gmailOp{"labels.list", 1, true}
+	opCreateLabel   = gmailOp{"labels.create", 5, false}
+	opPatchLabel    = gmailOp{"labels.patch", 5, true}
+	opDeleteLabel   = gmailOp{"labels.delete", 5, true}
+	opGetAttachment = gmailOp{"attachments.get", 5, true}
+	opGetThread     = gmailOp{"threads.get", 10, true}
+	opModifyThread  = gmailOp{"threads.modify", 10, true}
+	opGetProfile    = gmailOp{"getProfile", 1, true}
+	opListSendAs    = gmailOp{"sendAs.list", 1, true}
+	opListHistory   = gmailOp{"history.list", 2, true}
+	opListDrafts    = gmailOp{"drafts.list", 5, true}
+	opGetDraft      = gmailOp{"drafts.get", 5, true}
+	opCreateDraft   = gmailOp{"drafts.create", 10, false}
+	opUpdateDraft   = gmailOp{"drafts.update", 15, true}
+	opSendDraft     = gmailOp{"drafts.send", 100, false}
+	opDeleteDraft   = gmailOp{"drafts.delete", 10, true}
+)
+
+// retryNotice describes a call that failed and is about to be tried again
+type retryNotice struct {
+	op      string
+	attempt int // the attempt that failed, from 1
+	wait    time.Duration
+	err     error
+}
+
+// retryingBackend wraps the Gmail API, spacing calls to stay inside the
+// per-user quota and retrying those that fail with a rate limit or server
+// error after a jittered, exponentially growing delay
+type retryingBackend struct {
+	next  MailBackend
+	quota *quotaLimiter
+	sleep func(context.Context, time.Duration) error // waits out the backoff
+
+	mu      sync.Mutex
+	onRetry func(retryNotice)
+}
+
+func newRetryingBackend(next MailBackend) *retryingBackend {
+	return &retryingBackend{next: next, quota: newQuotaLimiter(quotaUnitsPerSecond), sleep: sleepContext}
+}
+
+// OnRetry sets a function told about each retry, so the UI can say it's
+// waiting on Gmail
+func (r *retryingBackend) OnRetry(f func(retryNotice)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onRetry = f
+}
+
+func (r *retryingBackend) notifyRetry(n retryNotice) {
+	r.mu.Lock()
+	f := r.onRetry
+	r.mu.Unlock()
+	if f != nil {
+		f(n)
+	}
+}
+
+// withRetry runs call under the quota, retrying it as op allows
+func withRetry[T any](ctx context.Context, r *retryingBackend, op gmailOp, call func() (T, error)) (T, error) {
+	for attempt := 1; ; attempt++ {
+		var zero T
+		if err := r.quota.Wait(ctx, op.units); err != nil {
+			return zero, err
+		}
+		result, err := call()
+		if err == nil || attempt == maxAttempts || !shouldRetry(op, err) {
+			return result, err
+		}
+
+		wait := retryDelay(attempt, err)
+		r.notifyRetry(retryNotice{op: op.name, attempt: attempt, wait: wait, err: err})
+		if err := r.sleep(ctx, wait); err != nil {
+			return zero, err
+		}
+	}
+}
+
+// withRetryErr is withRetry for calls that return only an error
+func withRetryErr(ctx context.Context, r *retryingBackend, op gmailOp, call func() error) error {
+	_, err := withRetry(ctx, r, op, func() (struct{}, error) {
+		return struct{}{}, call()
+	})
+	return err
+}
+
+// shouldRetry reports whether err is worth another attempt of op
+func shouldRetry(op gmailOp, err error) bool {
+	if isRateLimited(err) {
+		return true
+	}
+	if !op.idempotent {
+		return false
+	}
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Code >= 500
+	}
+	return false
+}
+
+// isRateLimited reports whether Gmail turned a call away for exceeding a
+// rate limit, in which case it did nothing
+func isRateLimited(err error) bool {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	if apiErr.Code == http.StatusTooManyRequests {
+		return true
+	}
+	if apiErr.Code != http.StatusForbidden {
+		return false
+	}
+	for _, item := range apiErr.Errors {
+		if item.Reason == "rateLimitExceeded" || item.Reason == "userRateLimitExceeded" {
+			return true
+		}
+	}
+	return false
+}
+
+// retryDelay is how long to wait after a failed attempt: what the server
+// asked for in Retry-After, otherwise an exponential delay with jitter
+func retryDelay(attempt int, err error) time.Duration {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Header != nil {
+		if secs, err := strconv.Atoi(apiErr.Header.Get("Retry-After")); err == nil && secs > 0 {
+			return min(time.Duration(secs)*time.Second, retryMaxDelay)
+		}
+	}
+	delay := min(retryBaseDelay<<(attempt-1), retryMaxDelay)
+	return delay/2 + rand.N(delay/2+1)
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// quotaLimiter is a token bucket of quota units. Calls reserve their cost
+// up front and wait for the bucket to refill when it runs dry, so bulk
+// work slows down instead of tripping the limit.
+type quotaLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // units per second, also the bucket size
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+	sleep  func(context.Context, time.Duration) error
+}
+
+func newQuotaLimiter(unitsPerSecond int) *quotaLimiter {
+	return &quotaLimiter{
+		rate:   float64(unitsPerSecond),
+		tokens: float64(unitsPerSecond),
+		last:   time.Now(),
+		now:    time.Now,
+		sleep:  sleepContext,
+	}
+}
+
+// Wait blocks until units can be spent, or ctx is done
+func (q *quotaLimiter) Wait(ctx context.Context, units int) error {
+	q.mu.Lock()
+	now := q.now()
+	q.tokens = min(q.rate, q.tokens+now.Sub(q.last).Seconds()*q.rate)
+	q.last = now
+	q.tokens -= float64(units)
+	var wait time.Duration
+	if q.tokens < 0 {
+		wait = time.Duration(-q.tokens / q.rate * float64(time.Second))
+	}
+	q.mu.Unlock()
+
+	if wait == 0 {
+		return nil
+	}
+	return q.sleep(ctx, wait)
+}
+
+func (r *retryingBackend) ListMessages(ctx context.Context, query string, labelIDs []string, pageToken string, maxResults int64) (*gmail.ListMessagesResponse, error) {
+	return withRetry(ctx, r, opListMessages, func() (*gmail.ListMessagesResponse, error) {
+		return r.next.ListMessages(ctx, query, labelIDs, pageToken, maxResults)
+	})
+}
+
+func (r *retryingBackend) GetMessage(ctx context.Context, id, format string) (*gmail.Message, error) {
+	return withRetry(ctx, r, opGetMessage, func() (*gmail.Message, error) {
+		return r.next.GetMessage(ctx, id, format)
+	})
+}
+
+func (r *retryingBackend) SendMessage(ctx context.Context, msg *gmail.Message) (*gmail.Message, error) {
+	return withRetry(ctx, r, opSendMessage, func() (*gmail.Message, error) {
+		return r.next.SendMessage(ctx, msg)
+	})
+}
+
+func (r *retryingBackend) ModifyMessage(ctx context.Context, id string, req *gmail.ModifyMessageRequest) (*gmail.Message, error) {
+	return withRetry(ctx, r, opModifyMessage, func() (*gmail.Message, error) {
+		return r.next.ModifyMessage(ctx, id, req)
+	})
+}
+
+func (r *retryingBackend) TrashMessage(ctx context.Context, id string) (*gmail.Message, error) {
+	return withRetry(ctx, r, opTrashMessage, func() (*gmail.Message, error) {
+		return r.next.TrashMessage(ctx, id)
+	})
+}
+
+func (r *retryingBackend) UntrashMessage(ctx context.Context, id string) (*gmail.Message, error) {
+	return withRetry(ctx, r, opUntrash, func() (*gmail.Message, error) {
+		return r.next.UntrashMessage(ctx, id)
+	})
+}
+
+func (r *retryingBackend) BatchModify(ctx context.Context, req *gmail.BatchModifyMessagesRequest) error {
+	return withRetryErr(ctx, r, opBatchModify, func() error {
+		return r.next.BatchModify(ctx, req)
+	})
+}
+
+func (r *retryingBackend) BatchDelete(ctx context.Context, ids []string) error {
+	return withRetryErr(ctx, r, opBatchDelete, func() error {
+		return r.next.BatchDelete(ctx, ids)
+	})
+}
+
+func (r *retryingBackend) ListLabels(ctx context.Context) ([]*gmail.Label, error) {
+	return withRetry(ctx, r, opListLabels, func() ([]*gmail.Label, error) {
+		return r.next.ListLabels(ctx)
+	})
+}
+
+func (r *retryingBackend) CreateLabel(ctx context.Context, label *gmail.Label) (*gmail.Label, error) {
+	return withRetry(ctx, r, opCreateLabel, func() (*gmail.Label, error) {
+		return r.next.CreateLabel(ctx, label)
+	})
+}
+
+func (r *retryingBackend) PatchLabel(ctx context.Context, id string, label *gmail.Label) (*gmail.Label, error) {
+	return withRetry(ctx, r, opPatchLabel, func() (*gmail.Label, error) {
+		return r.next.PatchLabel(ctx, id, label)
+	})
+}
+
+func (r *retryingBackend) DeleteLabel(ctx context.Context, id string) error {
+	return withRetryErr(ctx, r, opDeleteLabel, func() error {
+		return r.next.DeleteLabel(ctx, id)
+	})
+}
+
+func (r *retryingBackend) GetAttachment(ctx context.Context, msgID, attachmentID string) (*gmail.MessagePartBody, error) {
+	return withRetry(ctx, r, opGetAttachment, func() (*gmail.MessagePartBody, error) {
+		return r.next.GetAttachment(ctx, msgID, attachmentID)
+	})
+}
+
+func (r *retryingBackend) GetThread(ctx context.Context, id, format string) (*gmail.Thread, error) {
+	return withRetry(ctx, r, opGetThread, func() (*gmail.Thread, error) {
+		return r.next.GetThread(ctx, id, format)
+	})
+}
+
+func (r *retryingBackend) ModifyThread(ctx context.Context, id string, req *gmail.ModifyThreadRequest) (*gmail.Thread, error) {
+	return withRetry(ctx, r, opModifyThread, func() (*gmail.Thread, error) {
+		return r.next.ModifyThread(ctx, id, req)
+	})
+}
+
+func (r *retryingBackend) GetProfile(ctx context.Context) (*gmail.Profile, error) {
+	return withRetry(ctx, r, opGetProfile, func() (*gmail.Profile, error) {
+		return r.next.GetProfile(ctx)
+	})
+}
+
+func (r *retryingBackend) ListSendAs(ctx context.Context) ([]*gmail.SendAs, error) {
+	return withRetry(ctx, r, opListSendAs, func() ([]*gmail.SendAs, error) {
+		return r.next.ListSendAs(ctx)
+	})
+}
+
+func (r *retryingBackend) ListHistory(ctx context.Context, startHistoryID uint64, pageToken string) (*gmail.ListHistoryResponse, error) {
+	return withRetry(ctx, r, opListHistory, func() (*gmail.ListHistoryResponse, error) {
+		return r.next.ListHistory(ctx, startHistoryID, pageToken)
+	})
+}
+
+func (r *retryingBackend) ListDrafts(ctx context.Context) ([]*gmail.Draft, error) {
+	return withRetry(ctx, r, opListDrafts, func() ([]*gmail.Draft, error) {
+		return r.next.ListDrafts(ctx)
+	})
+}
+
+func (r *retryingBackend) GetDraft(ctx context.Context, id, format string) (*gmail.Draft, error) {
+	return withRetry(ctx, r, opGetDraft, func() (*gmail.Draft, error) {
+		return r.next.GetDraft(ctx, id, format)
+	})
+}
+
+func (r *retryingBackend) CreateDraft(ctx context.Context, draft *gmail.Draft) (*gmail.Draft, error) {
+	return withRetry(ctx, r, opCreateDraft, func() (*gmail.Draft, error) {
+		return r.next.CreateDraft(ctx, draft)
+	})
+}
+
+func (r *retryingBackend) UpdateDraft(ctx context.Context, id string, draft *gmail.Draft) (*gmail.Draft, error) {
+	return withRetry(ctx, r, opUpdateDraft, func() (*gmail.Draft, error) {
+		return r.next.UpdateDraft(ctx, id, draft)
+	})
+}
+
+func (r *retryingBackend) SendDraft(ctx context.Context, draft *gmail.Draft) (*gmail.Message, error) {
+	return withRetry(ctx, r, opSendDraft, func() (*gmail.Message, error) {
+		return r.next.SendDraft(ctx, draft)
+	})
+}
+
+func (r *retryingBackend) DeleteDraft(ctx context.Context, id string) error {
+	return withRetryErr(ctx, r, opDeleteDraft, func() error {
+		return r.next.DeleteDraft(ctx, id)
+	})
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+func apiError(code int, reason string) *googleapi.Error {
+	err := &googleapi.Error{Code: code}
+	if reason != "" {
+		err.Errors = []googleapi.ErrorItem{{Reason: reason}}
+	}
+	return err
+}
+
+func TestShouldRetry(t *testing.T) {
+	tests := []struct {
+		name        string
+		op          gmailOp
+		err         error
+		rateLimited bool
+		retry       bool
+	}{
+		{"429", opGetMessage, apiError(http.StatusTooManyRequests, ""), true, true},
+		{"403 rateLimitExceeded", opGetMessage, apiError(http.StatusForbidden, "rateLimitExceeded"), true, true},
+		{"403 userRateLimitExceeded", opGetMessage, apiError(http.StatusForbidden, "userRateLimitExceeded"), true, true},
+		{"403 for anything else", opGetMessage, apiError(http.StatusForbidden, "insufficientPermissions"), false, false},
+		{"500", opGetMessage, apiError(http.StatusInternalServerError, ""), false, true},
+		{"503", opBatchModify, apiError(http.StatusServiceUnavailable, ""), false, true},
+		{"400", opGetMessage, apiError(http.StatusBadRequest, ""), false, false},
+		{"404", opGetMessage, apiError(http.StatusNotFound, ""), false, false},
+		{"wrapped 429", opGetMessage, errors.Join(errors.New("listing"), apiError(http.StatusTooManyRequests, "")), true, true},
+		{"not an API error", opGetMessage, errors.New("connection reset"), false, false},
+		{"5xx on send", opSendMessage, apiError(http.StatusInternalServerError, ""), false, false},
+		{"5xx on draft create", opCreateDraft, apiError(http.StatusBadGateway, ""), false, false},
+		{"5xx on draft send", opSendDraft, apiError(http.StatusServiceUnavailable, ""), false, false},
+		{"rate limited send", opSendMessage, apiError(http.StatusTooManyRequests, ""), true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isRateLimited(tt.err); got != tt.rateLimited {
+				t.Errorf("isRateLimited = %v, want %v", got, tt.rateLimited)
+			}
+			if got := shouldRetry(tt.op, tt.err); got != tt.retry {
+				t.Errorf("shouldRetry = %v, want %v", got, tt.retry)
+			}
+		})
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	retryAfter := func(value string) error {
+		err := apiError(http.StatusTooManyRequests, "")
+		err.Header = http.Header{"Retry-After": []string{value}}
+		return err
+	}
+
+	tests := []struct {
+		name     string
+		attempt  int
+		err      error
+		min, max time.Duration
+	}{
+		{"Retry-After", 1, retryAfter("3"), 3 * time.Second, 3 * time.Second},
+		{"Retry-After is capped", 1, retryAfter("600"), retryMaxDelay, retryMaxDelay},
+		{"Retry-After as a date is ignored", 1, retryAfter("Wed, 21 Oct 2015 07:28:00 GMT"), retryBaseDelay / 2, retryBaseDelay},
+		{"first backoff", 1, apiError(http.StatusInternalServerError, ""), retryBaseDelay / 2, retryBaseDelay},
+		{"third backoff", 3, apiError(http.StatusInternalServerError, ""), 2 * retryBaseDelay, 4 * retryBaseDelay},
+		{"backoff is capped", 20, apiError(http.StatusInternalServerError, ""), retryMaxDelay / 2, retryMaxDelay},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 50; i++ { // the jitter is random
+				if got := retryDelay(tt.attempt, tt.err); got < tt.min || got > tt.max {
+					t.Fatalf("retryDelay = %v, want %v to %v", got, tt.min, tt.max)
+				}
+			}
+		})
+	}
+}
+
+// flakyBackend fails the first calls to GetMessage, SendMessage and
+// CreateDraft with errs, one error per call
+type flakyBackend struct {
+	MailBackend
+	errs  []error
+	calls int
+}
+
+func (b *flakyBackend) fail() error {
+	b.calls++
+	if b.calls <= len(b.errs) {
+		return b.errs[b.calls-1]
+	}
+	return nil
+}
+
+func (b *flakyBackend) GetMessage(ctx context.Context, id, format string) (*gmail.Message, error) {
+	if err := b.fail(); err != nil {
+		return nil, err
+	}
+	return b.MailBackend.GetMessage(ctx, id, format)
+}
+
+func (b *flakyBackend) SendMessage(ctx context.Context, msg *gmail.Message) (*gmail.Message, error) {
+	if err := b.fail(); err != nil {
+		return nil, err
+	}
+	return b.MailBackend.SendMessage(ctx, msg)
+}
+
+func (b *flakyBackend) CreateDraft(ctx context.Context, draft *gmail.Draft) (*gmail.Draft, error) {
+	if err := b.fail(); err != nil {
+		return nil, err
+	}
+	return b.MailBackend.CreateDraft(ctx, draft)
+}
+
+// newTestRetrier retries over b without waiting, recording the waits
+func newTestRetrier(b MailBackend) (*retryingBackend, *[]time.Duration) {
+	r := newRetryingBackend(b)
+	r.quota = newQuotaLimiter(1 << 20)
+	var waits []time.Duration
+	r.sleep = func(ctx context.Context, d time.Duration) error {
+		waits = append(waits, d)
+		return ctx.Err()
+	}
+	return r, &waits
+}
+
+func TestRetryingBackend(t *testing.T) {
+	serverError := apiError(http.StatusServiceUnavailable, "")
+	rateLimit := apiError(http.StatusTooManyRequests, "")
+
+	tests := []struct {
+		name    string
+		call    func(context.Context, MailBackend) error
+		errs    []error
+		calls   int
+		wantErr bool
+	}{
+		{"get retried after 5xx", getM0, []error{serverError, serverError}, 3, false},
+		{"get gives up", getM0, []error{serverError, serverError, serverError, serverError, serverError}, maxAttempts, true},
+		{"get not retried after 404", getM0, []error{apiError(http.StatusNotFound, "")}, 1, true},
+		{"send not retried after 5xx", send, []error{serverError}, 1, true},
+		{"send retried when rate limited", send, []error{rateLimit}, 2, false},
+		{"draft create not retried after 5xx", createDraft, []error{serverError}, 1, true},
+		{"draft create retried when rate limited", createDraft, []error{rateLimit, rateLimit}, 3, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flaky := &flakyBackend{MailBackend: testInbox(1), errs: tt.errs}
+			r, waits := newTestRetrier(flaky)
+			var notices []retryNotice
+			r.OnRetry(func(n retryNotice) { notices = append(notices, n) })
+
+			err := tt.call(context.Background(), r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error: %v", err, tt.wantErr)
+			}
+			if flaky.calls != tt.calls {
+				t.Errorf("%d calls, want %d", flaky.calls, tt.calls)
+			}
+			if len(*waits) != tt.calls-1 || len(notices) != tt.calls-1 {
+				t.Errorf("%d waits and %d notices, want %d", len(*waits), len(notices), tt.calls-1)
+			}
+		})
+	}
+}
+
+func getM0(ctx context.Context, b MailBackend) error {
+	_, err := b.GetMessage(ctx, "m0", "metadata")
+	return err
+}
+
+func send(ctx context.Context, b MailBackend) error {
+	_, err := b.SendMessage(ctx, &gmail.Message{Raw: "VG86IGFAeA"})
+	return err
+}
+
+func createDraft(ctx context.Context, b MailBackend) error {
+	_, err := b.CreateDraft(ctx, &gmail.Draft{Message: &gmail.Message{Raw: "VG86IGFAeA"}})
+	return err
+}
+
+func TestRetryStopsWhenCancelledDuringBackoff(t *testing.T) {
+	flaky := &flakyBackend{MailBackend: testInbox(1), errs: []error{apiError(http.StatusServiceUnavailable, "")}}
+	r := newRetryingBackend(flaky)
+	ctx, cancel := context.WithCancel(context.Background())
+	// Cancel as the backoff starts; the real sleep must return at once
+	r.OnRetry(func(retryNotice) { cancel() })
+
+	_, err := r.GetMessage(ctx, "m0", "metadata")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+	if flaky.calls != 1 {
+		t.Errorf("%d calls, want 1", flaky.calls)
+	}
+}
+
+func TestQuotaLimiterPaces(t *testing.T) {
+	clock := time.Unix(0, 0)
+	var waits []time.Duration
+	q := newQuotaLimiter(10)
+	q.last, q.now = clock, func() time.Time { return clock }
+	q.sleep = func(_ context.Context, d time.Duration) error {
+		waits = append(waits, d)
+		clock = clock.Add(d)
+		return nil
+	}
+	ctx := context.Background()
+
+	steps := []struct {
+		idle  time.Duration // time passing before the call
+		units int
+		wait  time.Duration
+	}{
+		{0, 10, 0},                                          // a full bucket
+		{0, 5, 500 * time.Millisecond},                      // empty: wait for 5 units
+		{0, 5, 500 * time.Millisecond},                      // and again
+		{200 * time.Millisecond, 5, 300 * time.Millisecond}, // partly refilled
+		{time.Hour, 10, 0},                                  // refills only up to the bucket size
+		{0, 1, 100 * time.Millisecond},
+	}
+	for i, step := range steps {
+		clock = clock.Add(step.idle)
+		waits = nil
+		if err := q.Wait(ctx, step.units); err != nil {
+			t.Fatal(err)
+		}
+		var got time.Duration
+		for _, w := range waits {
+			got += w
+		}
+		if got.Round(time.Millisecond) != step.wait {
+			t.Errorf("step %d waited %v, want %v", i, got, step.wait)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// syncEngine keeps the cache current by replaying the Gmail History API
+// from the last historyId it saw, instead of re-listing the mailbox
+type syncEngine struct {
+	backend *cachingBackend
+}
+
+func newSyncEngine(backend *cachingBackend) *syncEngine {
+	return &syncEngine{backend: backend}
+}
+
+// syncResult lists the messages touched since the previous sync
+type syncResult struct {
+	added   []string
+	deleted []string
+	changed []string // label changes
+	// resync is set when the stored historyId had expired, so the caller
+	// must re-list whatever it is showing. The cached messages are dropped
+	// by then, since they may have changed unseen.
+	resync bool
+	// errs are the changes that couldn't be applied; the rest still were
+	errs []error
+}
+
+type syncDoneMsg struct{ result *syncResult }
+
+func runSync(s *syncEngine) tea.Cmd {
+	return func() tea.Msg {
+		result, err := s.Sync(context.Background())
+		if err != nil {
+			return emailLoadErrorMsg{err: fmt.Errorf("sync failed: %w", err)}
+		}
+		return syncDoneMsg{result: result}
+	}
+}
+
+// Sync applies all mailbox changes since the stored historyId to the cache
+func (s *syncEngine) Sync(ctx context.Context) (*syncResult, error) {
+	cache := s.backend.cache
+	start := cache.HistoryID()
+	if start == 0 {
+		// First sync: whatever is cached was just fetched, so only record
+		// where history starts from
+		return &syncResult{}, s.resetHistoryID(ctx)
+	}
+
+	var history []*gmail.History
+	var latest uint64
+	pageToken := ""
+	for {
+		resp, err := s.backend.ListHistory(ctx, start, pageToken)
+		if isHistoryExpired(err) {
+			return s.resync(ctx)
+		}
+		if err != nil {
+			return nil, err
+		}
+		history = append(history, resp.History...)
+		latest = resp.HistoryId
+		if resp.NextPageToken == "" {
+			break
+		}
+		pageToken = resp.NextPageToken
+	}
+
+	result := s.apply(ctx, history)
+	if err := cache.SetHistoryID(latest); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// apply mirrors history records into the cache. Records are applied in
+// order, so a message added and then deleted ends up deleted. Messages whose
+// labels changed but which aren't cached yet are fetched afterwards, so one
+// moved into a listing elsewhere can be shown.
+func (s *syncEngine) apply(ctx context.Context, history []*gmail.History) *syncResult {
+	cache := s.backend.cache
+	result := &syncResult{}
+	var missing []string
+	isMissing := make(map[string]bool)
+	relabel := func(msg *gmail.Message, add, remove []string) {
+		cached, err := s.applyLabels(msg, add, remove)
+		if err != nil {
+			result.errs = append(result.errs, err)
+		}
+		if !cached {
+			if _, seen := isMissing[msg.Id]; !seen {
+				missing = append(missing, msg.Id)
+			}
+			isMissing[msg.Id] = true
+		}
+		result.changed = append(result.changed, msg.Id)
+	}
+
+	for _, h := range history {
+		for _, added := range h.MessagesAdded {
+			// Fetching through the caching backend stores the metadata
+			if _, err := s.backend.GetMessage(ctx, added.Message.Id, "metadata"); err != nil {
+				result.errs = append(result.errs, fmt.Errorf("could not fetch message %s: %w", added.Message.Id, err))
+				continue
+			}
+			result.added = append(result.added, added.Message.Id)
+		}
+
+		for _, deleted := range h.MessagesDeleted {
+			if err := cache.DeleteMessage(deleted.Message.Id); err != nil {
+				result.errs = append(result.errs, err)
+			}
+			isMissing[deleted.Message.Id] = false
+			result.deleted = append(result.deleted, deleted.Message.Id)
+		}
+
+		for _, change := range h.LabelsAdded {
+			relabel(change.Message, change.LabelIds, nil)
+		}
+		for _, change := range h.LabelsRemoved {
+			relabel(change.Message, nil, change.LabelIds)
+		}
+	}
+
+	fetch := make([]string, 0, len(missing))
+	for _, id := range missing {
+		if isMissing[id] {
+			fetch = append(fetch, id)
+		}
+	}
+	_, errs := fetchEach(ctx, fetch, func(ctx context.Context, id string) (*gmail.Message, error) {
+		return s.backend.GetMessage(ctx, id, "metadata")
+	})
+	for i, err := range errs {
+		if err != nil {
+			result.errs = append(result.errs, fmt.Errorf("could not fetch message %s: %w", fetch[i], err))
+		}
+	}
+
+	return result
+}
+
+// applyLabels prefers the label set reported with the change and falls
+// back to applying the delta to the cached labels. It reports whether the
+// message was cached; one that isn't is left to be fetched.
+func (s *syncEngine) applyLabels(msg *gmail.Message, add, remove []string) (bool, error) {
+	cache := s.backend.cache
+	cached, ok := cache.Message(msg.Id, false)
+	if !ok {
+		return false, nil
+	}
+
+	labelIDs := msg.LabelIds
+	if labelIDs == nil {
+		labelIDs = applyLabelChanges(cached.LabelIds, add, remove)
+	}
+	return true, cache.SetLabelIDs(msg.Id, labelIDs)
+}
+
+// resync starts over when history has expired. The changes since the cache
+// was last current are lost, so the cached messages can't be trusted and are
+// dropped; the caller re-lists and the cache refills from that.
+func (s *syncEngine) resync(ctx context.Context) (*syncResult, error) {
+	profile, err := s.backend.GetProfile(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.backend.cache.Clear(); err != nil {
+		return nil, err
+	}
+	if err := s.backend.cache.SetHistoryID(profile.HistoryId); err != nil {
+		return nil, err
+	}
+	return &syncResult{resync: true}, nil
+}
+
+func (s *syncEngine) resetHistoryID(ctx context.Context) error {
+	profile, err := s.backend.GetProfile(ctx)
+	if err != nil {
+		return err
+	}
+	return s.backend.cache.SetHistoryID(profile.HistoryId)
+}
+
+// isHistoryExpired reports the 404 Gmail returns for a startHistoryId that
+// is too old to replay from
+func isHistoryExpired(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestResyncDropsStaleCache(t *testing.T) {
+	ctx := context.Background()
+	remote := testInbox(3)
+	cache, err := openCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := newCachingBackend(remote, cache)
+	s := newSyncEngine(backend)
+
+	for _, id := range []string{"m0", "m1"} {
+		if _, err := backend.GetMessage(ctx, id, "metadata"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// m1 goes while we aren't looking, and the history of it is lost
+	if err := remote.BatchDelete(ctx, []string{"m1"}); err != nil {
+		t.Fatal(err)
+	}
+	remote.ExpireHistory()
+
+	result, err := s.Sync(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.resync {
+		t.Fatal("expired history didn't ask for a resync")
+	}
+	if _, ok := cache.Message("m1", false); ok {
+		t.Error("deleted message is still cached")
+	}
+	if cache.HistoryID() == 0 {
+		t.Error("history ID wasn't reset")
+	}
+
+	offline, err := newCachingBackend(nil, cache).ListMessages(ctx, inboxQuery, nil, "", 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range offline.Messages {
+		if msg.Id == "m1" {
+			t.Error("deleted message is listed offline")
+		}
+	}
+}
+
+func TestSyncShowsMessageMovedIntoListing(t *testing.T) {
+	ctx := context.Background()
+	remote := testInbox(3)
+	// m2 is archived, so it's never listed or cached
+	if _, err := remote.ModifyMessage(ctx, "m2", &gmail.ModifyMessageRequest{RemoveLabelIds: []string{"INBOX"}}); err != nil {
+		t.Fatal(err)
+	}
+	cache, err := openCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := loadInbox(t, newCachingBackend(remote, cache))
+	m = runCmd(m, runSync(m.sync)).(model)
+	if listed(m, "m2") {
+		t.Fatal("archived message is listed")
+	}
+
+	// Moved back to the inbox from another client
+	if _, err := remote.ModifyMessage(ctx, "m2", &gmail.ModifyMessageRequest{AddLabelIds: []string{"INBOX"}}); err != nil {
+		t.Fatal(err)
+	}
+	m = runCmd(m, runSync(m.sync)).(model)
+	if !listed(m, "m2") {
+		t.Error("message moved into the inbox isn't listed after sync")
+	}
+	if m.toast != nil && m.toast.isError {
+		t.Errorf("sync reported an error: %s", m.toast.text)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/bubbles/key"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+// noticeTimeout and errorTimeout are how long a toast stays up. Errors stay
+// longer, and every one is kept in the log.
+var (
+	noticeTimeout = 4 * time.Second
+	errorTimeout  = 12 * time.Second
+)
+
+// maxLogEntries is how many notices and errors the log screen keeps
+const maxLogEntries = 200
+
+var (
+	noticeStyle     = lipgloss.NewStyle().Foreground(lipgloss.Color("230")).Background(lipgloss.Color("62")).Padding(0, 1)
+	errorToastStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("231")).Background(lipgloss.Color("160")).Bold(true).Padding(0, 1)
+	logTimeStyle    = lipgloss.NewStyle().Foreground(lipgloss.Color("241"))
+)
+
+// logEntry is a notice or error, shown as a toast and kept in the log
+type logEntry struct {
+	at      time.Time
+	text    string
+	isError bool
+}
+
+// toastExpiredMsg takes down the toast with the given sequence number,
+// unless a newer one has replaced it
+type toastExpiredMsg struct{ seq int }
+
+// notify shows text as a toast and adds it to the log
+func (m *model) notify(text string, isError bool) tea.Cmd {
+	entry := logEntry{at: time.Now(), text: text, isError: isError}
+	m.messageLog = append(m.messageLog, entry)
+	if len(m.messageLog) > maxLogEntries {
+		m.messageLog = m.messageLog[len(m.messageLog)-maxLogEntries:]
+	}
+	if m.state == stateLog {
+		m.renderLog()
+	}
+
+	m.toast = &entry
+	m.toastSeq++
+	seq := m.toastSeq
+	timeout := noticeTimeout
+	if isError {
+		timeout = errorTimeout
+	}
+	return tea.Tick(timeout, func(time.Time) tea.Msg {
+		return toastExpiredMsg{seq: seq}
+	})
+}
+
+func (m *model) notifyError(err error) tea.Cmd {
+	return m.notify(err.Error(), true)
+}
+
+// statusBar renders the current toast
+func (m model) statusBar() string {
+	if m.toast == nil {
+		return ""
+	}
+	if m.toast.isError {
+		return "\n" + errorToastStyle.Render("✗ "+m.toast.text+"  [E] log")
+	}
+	return "\n" + noticeStyle.Render(m.toast.text)
+}
+
+// renderLog fills the log screen, oldest entry first
+func (m *model) renderLog() {
+	if len(m.messageLog) == 0 {
+		m.logViewport.SetContent("  Nothing yet")
+		return
+	}
+	var b strings.Builder
+	for _, entry := range m.messageLog {
+		text := entry.text
+		if entry.isError {
+			text = errorStyle.Render(text)
+		}
+		b.WriteString(fmt.Sprintf("%s  %s\n", logTimeStyle.Render(entry.at.Format("15:04:05")), text))
+	}
+	m.logViewport.SetContent(b.String())
+	m.logViewport.GotoBottom()
+}
+
+func (m model) openLog() (tea.Model, tea.Cmd) {
+	m.logReturn = m.state
+	m.state = stateLog
+	m.logViewport.Width = m.width
+	m.logViewport.Height = m.height - 4
+	m.renderLog()
+	return m, nil
+}
+
+func updateLog(msg tea.KeyMsg, m model) (tea.Model, tea.Cmd) {
+	switch {
+	case key.Matches(msg, keys.Back), key.Matches(msg, keys.ErrorLog):
+		m.state = m.logReturn
+		return m, nil
+	case key.Matches(msg, keys.Quit):
+		return m, tea.Quit
+	}
+
+	var cmd tea.Cmd
+	m.logViewport, cmd = m.logViewport.Update(msg)
+	return m, cmd
+}
+
+func (m model) logView() string {
+	return fmt.Sprintf("\n  Notices and errors (%d)\n\n%s\n[↑/↓] scroll • [b] back\n", len(m.messageLog), m.logViewport.View())
+}
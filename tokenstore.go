@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/oauth2"
+)
+
+const (
+	tokenFile = "token.json"
+	// legacyTokenFileName is where tokens were kept before they moved to
+	// the config directory
+	legacyTokenFileName = ".gmail-tui-token.json"
+	// passphraseEnv holds the passphrase the token is encrypted with. When
+	// it's unset the token is stored in the clear, readable only by us.
+	passphraseEnv = "GMAIL_TUI_TOKEN_PASSPHRASE"
+)
+
+// scrypt parameters for deriving the token key; N=2^15 takes around 100ms
+const (
+	scryptN      = 1 << 15
+	scryptR      = 8
+	scryptP      = 1
+	scryptKeyLen = 32
+)
+
+var (
+	errNoPassphrase    = errors.New("the saved token is encrypted; set " + passphraseEnv + " to unlock it")
+	errWrongPassphrase = errors.New("failed to decrypt the saved token: wrong " + passphraseEnv + " or corrupt file")
+)
+
+// storedToken is the token as saved, with the scopes it was granted
+type storedToken struct {
+	*oauth2.Token
+	Scope string `json:"scope,omitempty"`
+}
+
+// sealedToken is an encrypted storedToken. The key is derived from the
+// passphrase with scrypt and the token sealed with AES-GCM, so a wrong
+// passphrase or a tampered file fails to open rather than decoding junk.
+type sealedToken struct {
+	Version    int    `json:"version"`
+	KDF        string `json:"kdf"`
+	N          int    `json:"n"`
+	R          int    `json:"r"`
+	P          int    `json:"p"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// migrateLegacyToken moves ~/.gmail-tui-token.json to path, unless there
+// is already a token there
+func migrateLegacyToken(path string) error {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return nil
+	}
+	legacy := filepath.Join(homeDir, legacyTokenFileName)
+	if _, err := os.Stat(legacy); err != nil {
+		return nil
+	}
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+
+	token, err := loadToken(legacy)
+	if err != nil {
+		return fmt.Errorf("failed to read %s to move it: %w", legacy, err)
+	}
+	if err := saveToken(path, token); err != nil {
+		return fmt.Errorf("failed to move %s: %w", legacy, err)
+	}
+	return os.Remove(legacy)
+}
+
+// loadToken reads a token from disk, decrypting it if it was saved with a
+// passphrase
+func loadToken(path string) (*storedToken, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var sealed sealedToken
+	if err := json.Unmarshal(data, &sealed); err != nil {
+		return nil, fmt.Errorf("failed to decode token: %w", err)
+	}
+	if sealed.Ciphertext != nil {
+		passphrase := os.Getenv(passphraseEnv)
+		if passphrase == "" {
+			return nil, errNoPassphrase
+		}
+		if data, err = openToken(&sealed, passphrase); err != nil {
+			return nil, err
+		}
+	}
+
+	token := &storedToken{Token: &oauth2.Token{}}
+	if err := json.Unmarshal(data, token); err != nil {
+		return nil, fmt.Errorf("failed to decode token: %w", err)
+	}
+	return token, nil
+}
+
+// newStoredToken pairs a token from Google with the scopes it was granted,
+// keeping previous ones if the response didn't list them
+func newStoredToken(token *oauth2.Token, previous string) *storedToken {
+	scope, _ := token.Extra("scope").(string)
+	if scope == "" {
+		scope = previous
+	}
+	return &storedToken{Token: token, Scope: scope}
+}
+
+// saveToken writes a token readable only by us, encrypting it when a
+// passphrase is set
+func saveToken(path string, token *storedToken) error {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return fmt.Errorf("failed to encode token: %w", err)
+	}
+	if passphrase := os.Getenv(passphraseEnv); passphrase != "" {
+		sealed, err := sealToken(data, passphrase)
+		if err != nil {
+			return err
+		}
+		if data, err = json.Marshal(sealed); err != nil {
+			return fmt.Errorf("failed to encode token: %w", err)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create token directory: %w", err)
+	}
+	return writeFileAtomic(path, data, 0600)
+}
+
+// isSealed reports whether the token at path is encrypted
+func isSealed(path string) bool {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	var sealed sealedToken
+	return json.Unmarshal(data, &sealed) == nil && sealed.Ciphertext != nil
+}
+
+func sealToken(plain []byte, passphrase string) (*sealedToken, error) {
+	sealed := &sealedToken{Version: 1, KDF: "scrypt", N: scryptN, R: scryptR, P: scryptP, Salt: make([]byte, 16)}
+	if _, err := rand.Read(sealed.Salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+	aead, err := tokenCipher(sealed, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	sealed.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(sealed.Nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	sealed.Ciphertext = aead.Seal(nil, sealed.Nonce, plain, nil)
+	return sealed, nil
+}
+
+func openToken(sealed *sealedToken, passphrase string) ([]byte, error) {
+	if sealed.Version != 1 || sealed.KDF != "scrypt" {
+		return nil, fmt.Errorf("unsupported token encryption (version %d, %s)", sealed.Version, sealed.KDF)
+	}
+	aead, err := tokenCipher(sealed, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed.Nonce) != aead.NonceSize() {
+		return nil, errors.New("saved token is corrupt")
+	}
+	plain, err := aead.Open(nil, sealed.Nonce, sealed.Ciphertext, nil)
+	if err != nil {
+		return nil, errWrongPassphrase
+	}
+	return plain, nil
+}
+
+// tokenCipher derives the key for sealed. Only the parameters this version
+// seals with are accepted, so an edited file can't make the derivation
+// cheap to brute-force or too costly to run.
+func tokenCipher(sealed *sealedToken, passphrase string) (cipher.AEAD, error) {
+	if sealed.N != scryptN || sealed.R != scryptR || sealed.P != scryptP {
+		return nil, fmt.Errorf("unsupported token key parameters (N=%d, r=%d, p=%d)", sealed.N, sealed.R, sealed.P)
+	}
+	key, err := scrypt.Key([]byte(passphrase), sealed.Salt, sealed.N, sealed.R, sealed.P, scryptKeyLen)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive token key: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func testToken() *storedToken {
+	return &storedToken{
+		Token: &oauth2.Token{AccessToken: "access", RefreshToken: "refresh", Expiry: time.Unix(1700000000, 0).UTC()},
+		Scope: "https://mail.google.com/",
+	}
+}
+
+func TestSealAndOpenToken(t *testing.T) {
+	plain := []byte(`{"access_token":"access"}`)
+	sealed, err := sealToken(plain, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := openToken(sealed, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(plain) {
+		t.Errorf("opened %q, want %q", got, plain)
+	}
+
+	if _, err := openToken(sealed, "battery staple"); !errors.Is(err, errWrongPassphrase) {
+		t.Errorf("wrong passphrase gave %v, want errWrongPassphrase", err)
+	}
+
+	tampered := *sealed
+	tampered.Ciphertext = append([]byte(nil), sealed.Ciphertext...)
+	tampered.Ciphertext[0] ^= 1
+	if _, err := openToken(&tampered, "correct horse"); !errors.Is(err, errWrongPassphrase) {
+		t.Errorf("tampered ciphertext gave %v, want errWrongPassphrase", err)
+	}
+}
+
+func TestOpenTokenRejectsOtherKeyParameters(t *testing.T) {
+	sealed, err := sealToken([]byte("{}"), "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		edit func(*sealedToken)
+	}{
+		{"cheaper N", func(s *sealedToken) { s.N = 2 }},
+		{"costlier N", func(s *sealedToken) { s.N = 1 << 30 }},
+		{"other r", func(s *sealedToken) { s.R = 1 }},
+		{"other p", func(s *sealedToken) { s.P = 64 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			edited := *sealed
+			tt.edit(&edited)
+			_, err := openToken(&edited, "pass")
+			if err == nil || errors.Is(err, errWrongPassphrase) {
+				t.Errorf("got %v, want the parameters rejected", err)
+			}
+		})
+	}
+}
+
+func TestSaveToken(t *testing.T) {
+	for name, passphrase := range map[string]string{"in the clear": "", "encrypted": "secret"} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(passphraseEnv, passphrase)
+			path := filepath.Join(t.TempDir(), "config", tokenFile)
+
+			if err := saveToken(path, testToken()); err != nil {
+				t.Fatal(err)
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mode := info.Mode().Perm(); mode != 0600 {
+				t.Errorf("mode = %v, want 0600", mode)
+			}
+			if isSealed(path) != (passphrase != "") {
+				t.Errorf("sealed = %v with passphrase %q", isSealed(path), passphrase)
+			}
+
+			got, err := loadToken(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.RefreshToken != "refresh" || got.Scope != testToken().Scope || !got.Expiry.Equal(testToken().Expiry) {
+				t.Errorf("loaded %+v, want %+v", got, testToken())
+			}
+
+			if passphrase != "" {
+				t.Setenv(passphraseEnv, "")
+				if _, err := loadToken(path); !errors.Is(err, errNoPassphrase) {
+					t.Errorf("loading without the passphrase gave %v, want errNoPassphrase", err)
+				}
+			}
+		})
+	}
+}
+
+func TestMigrateLegacyToken(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv(passphraseEnv, "")
+	legacy := filepath.Join(home, legacyTokenFileName)
+	if err := saveToken(legacy, testToken()); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(home, ".config", "gmail-tui", tokenFile)
+	if err := migrateLegacyToken(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(legacy); !errors.Is(err, os.ErrNotExist) {
+		t.Error("legacy token was left behind")
+	}
+	got, err := loadToken(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.RefreshToken != "refresh" {
+		t.Errorf("moved token = %+v", got)
+	}
+
+	// A token already in place is kept
+	other := testToken()
+	other.RefreshToken = "older"
+	if err := saveToken(legacy, other); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateLegacyToken(path); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := loadToken(path); got == nil || got.RefreshToken != "refresh" {
+		t.Errorf("migration replaced the existing token with %+v", got)
+	}
+}
@@ -1,6 +1,10 @@
 package main
 
 import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
 	"github.com/charmbracelet/bubbles/help"
 	"github.com/charmbracelet/bubbles/key"
 	"github.com/charmbracelet/bubbles/list"
@@ -21,6 +25,20 @@ const (
 	stateReplying
 	stateSearching
 	stateManagingLabels
+	stateConversation
+	stateDrafts
+	stateContacts
+	stateApplyingLabels
+	stateLog
+)
+
+// listMode says how a fetched page of messages is merged into the list
+type listMode int
+
+const (
+	listReplace listMode = iota // a new listing: clear the list first
+	listAppend                  // the next page of the current listing
+	listRefresh                 // a fresh first page: keep rows that are still present
 )
 
 // keyMap defines all keyboard shortcuts
@@ -42,6 +60,35 @@ type keyMap struct {
 	AddAttachment      key.Binding
 	RemoveAttachment   key.Binding
 	DownloadAttachment key.Binding
+	LoadMore           key.Binding
+	Refresh            key.Binding
+	ReplyAll           key.Binding
+	Forward            key.Binding
+	ToggleThreads      key.Binding
+	NextMessage        key.Binding
+	PrevMessage        key.Binding
+	Expand             key.Binding
+	Drafts             key.Binding
+	SaveDraft          key.Binding
+	Contacts           key.Binding
+	EditContact        key.Binding
+	MergeContact       key.Binding
+	NewLabel           key.Binding
+	EditLabel          key.Binding
+	ApplyLabels        key.Binding
+	ToggleLabel        key.Binding
+	Archive            key.Binding
+	Star               key.Binding
+	Important          key.Binding
+	Spam               key.Binding
+	Mute               key.Binding
+	ToggleSelect       key.Binding
+	SelectRange        key.Binding
+	SelectAll          key.Binding
+	Move               key.Binding
+	DeleteForever      key.Binding
+	Undo               key.Binding
+	ErrorLog           key.Binding
 }
 
 func (k keyMap) ShortHelp() []key.Binding {
@@ -50,10 +97,16 @@ func (k keyMap) ShortHelp() []key.Binding {
 
 func (k keyMap) FullHelp() [][]key.Binding {
 	return [][]key.Binding{
-		{k.Compose, k.Reply, k.Search, k.Labels},
-		{k.Delete, k.ToggleRead, k.Back, k.Quit},
-		{k.Send, k.NextInput, k.PrevInput},
+		{k.Compose, k.Reply, k.ReplyAll, k.Forward, k.Search, k.Labels},
+		{k.Delete, k.ToggleRead, k.LoadMore, k.Refresh, k.Back, k.Quit},
+		{k.Undo, k.ErrorLog},
+		{k.Archive, k.Star, k.Important, k.Spam, k.Mute},
+		{k.ToggleSelect, k.SelectRange, k.SelectAll, k.Move, k.DeleteForever},
+		{k.Send, k.SaveDraft, k.Drafts, k.NextInput, k.PrevInput},
+		{k.Contacts, k.EditContact, k.MergeContact},
+		{k.ApplyLabels, k.ToggleLabel, k.NewLabel, k.EditLabel},
 		{k.AddAttachment, k.RemoveAttachment, k.DownloadAttachment},
+		{k.ToggleThreads, k.NextMessage, k.PrevMessage, k.Expand},
 	}
 }
 
@@ -75,30 +128,88 @@ var keys = keyMap{
 	AddAttachment:      key.NewBinding(key.WithKeys("ctrl+a"), key.WithHelp("ctrl+a", "add attachment")),
 	RemoveAttachment:   key.NewBinding(key.WithKeys("ctrl+x"), key.WithHelp("ctrl+x", "remove attachment")),
 	DownloadAttachment: key.NewBinding(key.WithKeys("ctrl+d"), key.WithHelp("ctrl+d", "download attachment")),
+	LoadMore:           key.NewBinding(key.WithKeys("n"), key.WithHelp("n", "load more")),
+	Refresh:            key.NewBinding(key.WithKeys("R"), key.WithHelp("R", "refresh")),
+	ReplyAll:           key.NewBinding(key.WithKeys("A"), key.WithHelp("A", "reply all")),
+	Forward:            key.NewBinding(key.WithKeys("f"), key.WithHelp("f", "forward")),
+	ToggleThreads:      key.NewBinding(key.WithKeys("t"), key.WithHelp("t", "group by thread")),
+	NextMessage:        key.NewBinding(key.WithKeys("n"), key.WithHelp("n", "next message")),
+	PrevMessage:        key.NewBinding(key.WithKeys("p"), key.WithHelp("p", "previous message")),
+	Expand:             key.NewBinding(key.WithKeys("enter", " "), key.WithHelp("enter/space", "expand/collapse")),
+	Drafts:             key.NewBinding(key.WithKeys("D"), key.WithHelp("D", "drafts")),
+	SaveDraft:          key.NewBinding(key.WithKeys("ctrl+o"), key.WithHelp("ctrl+o", "save draft")),
+	Contacts:           key.NewBinding(key.WithKeys("C"), key.WithHelp("C", "contacts")),
+	EditContact:        key.NewBinding(key.WithKeys("e", "enter"), key.WithHelp("e", "edit contact")),
+	MergeContact:       key.NewBinding(key.WithKeys("m"), key.WithHelp("m", "merge contacts")),
+	NewLabel:           key.NewBinding(key.WithKeys("n"), key.WithHelp("n", "new label")),
+	EditLabel:          key.NewBinding(key.WithKeys("e"), key.WithHelp("e", "edit label")),
+	ApplyLabels:        key.NewBinding(key.WithKeys("L"), key.WithHelp("L", "apply labels")),
+	ToggleLabel:        key.NewBinding(key.WithKeys(" "), key.WithHelp("space", "toggle label")),
+	Archive:            key.NewBinding(key.WithKeys("e"), key.WithHelp("e", "archive")),
+	Star:               key.NewBinding(key.WithKeys("s"), key.WithHelp("s", "star/unstar")),
+	Important:          key.NewBinding(key.WithKeys("+"), key.WithHelp("+", "mark important/not important")),
+	Spam:               key.NewBinding(key.WithKeys("!"), key.WithHelp("!", "report spam/not spam")),
+	Mute:               key.NewBinding(key.WithKeys("M"), key.WithHelp("M", "mute/unmute thread")),
+	ToggleSelect:       key.NewBinding(key.WithKeys(" "), key.WithHelp("space", "select")),
+	SelectRange:        key.NewBinding(key.WithKeys("V"), key.WithHelp("V", "select range")),
+	SelectAll:          key.NewBinding(key.WithKeys("*"), key.WithHelp("*", "select all")),
+	Move:               key.NewBinding(key.WithKeys("v"), key.WithHelp("v", "move to label")),
+	DeleteForever:      key.NewBinding(key.WithKeys("X"), key.WithHelp("X", "delete forever")),
+	Undo:               key.NewBinding(key.WithKeys("u"), key.WithHelp("u", "undo")),
+	ErrorLog:           key.NewBinding(key.WithKeys("E"), key.WithHelp("E", "notices and errors")),
 }
 
 // emailItem represents an email in the list or detail view
 type emailItem struct {
-	id          string
-	threadId    string
-	subject     string
-	from        string
-	snippet     string
-	date        string
-	labels      []string
-	isUnread    bool
-	body        string
-	recipient   string
+	id           string
+	threadId     string
+	subject      string
+	from         string
+	snippet      string
+	date         string
+	internalDate int64
+	labels       []string
+	isUnread     bool
+	body         string
+	recipient    string
+	cc           string
+	bcc          string
+	replyTo      string
+	messageID    string
+	references   string
+	attachments  []*gmail.MessagePart
+}
+
+// outgoingEmail is a message ready to be sent. threadID and the
+// In-Reply-To/References values are only set for replies.
+type outgoingEmail struct {
+	to          string
 	cc          string
 	bcc         string
-	attachments []*gmail.MessagePart
+	subject     string
+	body        string
+	attachments []outgoingAttachment
+	threadID    string
+	inReplyTo   string
+	references  string
 }
 
 func (e emailItem) Title() string {
+	title := "  "
 	if e.isUnread {
-		return "● " + e.subject
+		title = "● "
+	}
+	if e.hasLabel("STARRED") {
+		title += "★ "
+	}
+	if e.hasLabel("IMPORTANT") {
+		title += "» "
 	}
-	return "  " + e.subject
+	return title + e.subject
+}
+
+func (e emailItem) hasLabel(id string) bool {
+	return containsString(e.labels, id)
 }
 
 func (e emailItem) Description() string {
@@ -113,26 +224,182 @@ func (e emailItem) FilterValue() string {
 	return e.subject + " " + e.from
 }
 
+// threadItem groups the loaded messages of one conversation
+type threadItem struct {
+	threadId string
+	messages []emailItem // newest first
+}
+
+func (t threadItem) latest() emailItem {
+	return t.messages[0]
+}
+
+func (t threadItem) Title() string {
+	prefix := "  "
+	for _, msg := range t.messages {
+		if msg.isUnread {
+			prefix = "● "
+			break
+		}
+	}
+
+	for _, msg := range t.messages {
+		if msg.hasLabel("STARRED") {
+			prefix += "★ "
+			break
+		}
+	}
+
+	title := prefix + t.latest().subject
+	if len(t.messages) > 1 {
+		title += fmt.Sprintf(" (%d)", len(t.messages))
+	}
+	return title
+}
+
+func (t threadItem) Description() string {
+	snippet := t.latest().snippet
+	if len(snippet) > 60 {
+		snippet = snippet[:57] + "..."
+	}
+	return t.participants() + " - " + snippet
+}
+
+func (t threadItem) FilterValue() string {
+	return t.latest().subject + " " + t.participants()
+}
+
+// participants lists the senders of the thread, oldest first
+func (t threadItem) participants() string {
+	var names []string
+	for i := len(t.messages) - 1; i >= 0; i-- {
+		name := senderName(t.messages[i].from)
+		if !containsString(names, name) {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// outgoingAttachment is a file to send: either a path on disk or data
+// already in memory, such as an attachment carried over by a forward
+type outgoingAttachment struct {
+	name     string
+	path     string
+	mimeType string
+	data     []byte
+}
+
+func fileAttachment(path string) outgoingAttachment {
+	return outgoingAttachment{name: filepath.Base(path), path: path}
+}
+
+// draftItem is a saved draft in the drafts list
+type draftItem struct {
+	id    string
+	email *emailItem
+}
+
+func (d draftItem) Title() string {
+	if d.email.subject == "" {
+		return "(no subject)"
+	}
+	return d.email.subject
+}
+
+func (d draftItem) Description() string {
+	return "To: " + d.email.recipient + " - " + d.email.snippet
+}
+
+func (d draftItem) FilterValue() string {
+	return d.email.subject + " " + d.email.recipient
+}
+
+// draftOp is a save or send of the draft of a compose session
+type draftOp struct {
+	session int
+	email   outgoingEmail
+	send    bool
+}
+
+// contactItem is an address book entry in the contacts list
+type contactItem struct {
+	contact contact
+}
+
+func (c contactItem) Title() string {
+	if c.contact.Name == "" {
+		return c.contact.Address
+	}
+	return c.contact.Name
+}
+
+func (c contactItem) Description() string {
+	return fmt.Sprintf("%s - %d received, %d sent", c.contact.Address, c.contact.Received, c.contact.Sent)
+}
+
+func (c contactItem) FilterValue() string {
+	return c.contact.Name + " " + c.contact.Address
+}
+
 // labelItem represents a Gmail label
 type labelItem struct {
 	label *gmail.Label
 }
 
-func (l labelItem) Title() string       { return l.label.Name }
+// Title shows nested user labels indented under their parent
+func (l labelItem) Title() string {
+	if !isUserLabel(l.label) {
+		return labelSwatch(l.label.Color) + " " + l.label.Name
+	}
+	parent, leaf := splitLabelName(l.label.Name)
+	indent := ""
+	if parent != "" {
+		indent = strings.Repeat("  ", strings.Count(parent, "/")+1)
+	}
+	return labelSwatch(l.label.Color) + " " + indent + leaf
+}
+
 func (l labelItem) Description() string { return "ID: " + l.label.Id }
 func (l labelItem) FilterValue() string { return l.label.Name }
 
+// labelChoice is a label in the apply-labels picker. initial records
+// whether every selected message had the label when the picker opened.
+type labelChoice struct {
+	label   *gmail.Label
+	checked bool
+	initial bool
+	single  bool // picking one label to move to, so no check box
+}
+
+func (l labelChoice) Title() string {
+	box := "[ ] "
+	if l.single {
+		box = ""
+	} else if l.checked {
+		box = "[x] "
+	}
+	return box + labelSwatch(l.label.Color) + " " + l.label.Name
+}
+
+func (l labelChoice) Description() string { return "" }
+func (l labelChoice) FilterValue() string { return l.label.Name }
+
 // model is the main application state
 type model struct {
 	state                 state
 	list                  list.Model
-	srv                   *gmail.Service
+	backend               MailBackend
 	fullEmail             string
 	loading               spinner.Model
 	viewport              viewport.Model
 	width                 int
 	height                int
-	err                   string
+	toast                 *logEntry // the notice or error on the status bar
+	toastSeq              int
+	messageLog            []logEntry
+	logViewport           viewport.Model
+	logReturn             state
 	help                  help.Model
 	showHelp              bool
 	composeFrom           textinput.Model
@@ -149,21 +416,140 @@ type model struct {
 	replyToMsg            *emailItem
 	focused               int
 	searchQuery           string
-	composeAttachments    []string
-	replyAttachments      []string
+	composeAttachments    []outgoingAttachment
+	replyAttachments      []outgoingAttachment
+	removingAttachment    bool
 	attachmentInput       textinput.Model
 	addingAttachment      bool
 	attachmentDownloading bool
 	downloadingIndex      int
+	listQuery             string
+	listLabelIDs          []string
+	nextPageToken         string
+	resultEstimate        int64
+	loadingMore           bool
+	fetch                 *itemStream
+	listLoading           bool
+	offline               bool
+	sync                  *syncEngine
+	threadMode            bool
+	threadList            list.Model
+	conversation          []*emailItem
+	convExpanded          []bool
+	convIndex             int
+	convOffsets           []int
+	replyReturn           state
+	replyAll              bool
+	ownAddresses          []string
+	draftID               string           // the draft the compose or reply form is editing
+	draftSession          int              // tags the form's draft saves, so late results find their form
+	draftCreates          map[int]*draftOp // sessions whose draft is being created, and what to do once it is
+	composeThreadID       string           // threading of a reply draft reopened in compose
+	composeInReplyTo      string
+	composeReferences     string
+	draftsList            list.Model
+	composeErr            string // why the last send attempt was refused
+	contacts              *addressBook
+	paths                 appPaths  // where files are kept, from flags and environment
+	suggestions           []contact // completions for the recipient being typed
+	suggestionIndex       int
+	contactsList          list.Model
+	contactName           textinput.Model
+	contactAddress        textinput.Model
+	editingContact        string // address of the contact being edited
+	mergeFrom             string // address of the contact picked to merge
+	contactErr            string
+	editingLabel          bool
+	labelEditID           string // the label being edited; empty when creating one
+	labelNameInput        textinput.Model
+	labelParentInput      textinput.Model
+	labelColor            int // index into labelPalette, -1 for no color
+	labelFocus            int
+	labelErr              string
+	deletingLabel         *gmail.Label // awaiting confirmation
+	labelPicker           list.Model
+	pickerTargets         []string // IDs of the messages the picker applies to
+	pickerReturn          state
+	mutedThreads          map[string]bool
+	selected              map[string]bool // message IDs marked for a bulk action
+	selectAnchor          int             // row last toggled, where a range selection starts
+	bulk                  *bulkOp         // the bulk action in progress
+	deleteTargets         []string        // messages waiting for confirmation to delete forever
+	undo                  []*undoAction
+	listRequest           request // the listing being loaded
+	screenRequest         request // the message, conversation or draft being opened
+	requestSeq            int
+	pickerMove            bool // the picker moves messages to one label
 }
 
 // Messages for tea.Cmd communication
 type (
-	emailLoadedMsg          struct{ content string }
-	emailSentMsg            struct{}
-	emailLoadErrorMsg       struct{ err error }
-	labelsLoadedMsg         struct{ labels []*gmail.Label }
-	searchResultMsg         struct{ messages []*gmail.Message }
+	emailLoadedMsg struct {
+		reqID   int
+		item    *emailItem
+		content string
+	}
+	emailSentMsg      struct{}
+	emailLoadErrorMsg struct {
+		reqID int // the request that failed; 0 for anything else
+		err   error
+	}
+	labelsLoadedMsg struct{ labels []*gmail.Label }
+	searchResultMsg struct {
+		reqID         int
+		query         string
+		labelIDs      []string
+		messages      []*gmail.Message
+		nextPageToken string
+		estimate      int64
+		mode          listMode
+	}
 	attachmentDownloadedMsg struct{ filename string }
 	notificationMsg         struct{ message string }
+	threadLoadedMsg         struct {
+		reqID    int
+		messages []*emailItem
+	}
+	identityLoadedMsg struct{ addresses []string }
+	forwardReadyMsg   struct {
+		reqID       int
+		original    *emailItem
+		attachments []outgoingAttachment
+	}
+	draftSavedMsg struct {
+		session int
+		id      string
+		created bool // the save created the draft
+		err     error
+	}
+	draftsLoadedMsg struct {
+		reqID  int
+		drafts []draftItem
+	}
+	draftReadyMsg struct {
+		reqID int
+		id    string
+		email outgoingEmail
+	}
+	draftDeletedMsg  struct{ id string }
+	contactsSavedMsg struct{ err error }
+	harvestFailedMsg struct{ err error }
+	labelsChangedMsg struct {
+		labels  []*gmail.Label
+		message string
+	}
+	messagesModifiedMsg struct {
+		messages []*gmail.Message
+		message  string
+		undo     *undoAction
+	}
+	threadModifiedMsg struct {
+		threadID string
+		add      []string
+		remove   []string
+		message  string
+		created  *gmail.Label // the Muted label, if muting had to create it
+		undo     *undoAction
+	}
+	mutedThreadsMsg struct{ threadIDs []string }
 )
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/charmbracelet/bubbles/list"
+	tea "github.com/charmbracelet/bubbletea"
+	"google.golang.org/api/gmail/v1"
+)
+
+// maxUndo is how many actions u can step back through
+const maxUndo = 20
+
+// undoAction records how to reverse a finished action. Label changes are
+// reversed message by message, taking off only the labels each one gained
+// and putting back only those it lost; trashing is reversed with Untrash,
+// which restores the labels the message had before.
+type undoAction struct {
+	note     string // what was done: "Archived 3 messages"
+	ids      []string
+	threadID string        // set when the change applied to a whole conversation
+	changes  []labelChange // the reversal, grouped by messages that need the same one
+	untrash  bool
+	rows     []emailItem // the loaded rows as they were before the action
+}
+
+// labelChange adds and removes the same labels on a group of messages
+type labelChange struct {
+	ids    []string
+	add    []string
+	remove []string
+}
+
+// undoneMsg reports that an action was reversed. If a call failed on the
+// way, action is the part that was undone, rest the part that wasn't and
+// err why.
+type undoneMsg struct {
+	action   *undoAction
+	messages []*gmail.Message
+	rest     *undoAction
+	err      error
+}
+
+// reverseLabels returns the undo for a change that added add and removed
+// remove from messages whose labels beforehand are in before. Messages
+// missing from before are left alone, since how to restore them is unknown.
+func reverseLabels(note string, before map[string][]string, ids, add, remove []string) *undoAction {
+	action := &undoAction{note: note, ids: ids}
+	groups := make(map[string]int)
+	for _, id := range ids {
+		labels, ok := before[id]
+		if !ok {
+			continue
+		}
+		var restore, takeOff []string
+		for _, l := range remove {
+			if containsString(labels, l) {
+				restore = append(restore, l)
+			}
+		}
+		for _, l := range add {
+			if !containsString(labels, l) {
+				takeOff = append(takeOff, l)
+			}
+		}
+		if len(restore) == 0 && len(takeOff) == 0 {
+			continue
+		}
+
+		key := strings.Join(restore, ",") + "|" + strings.Join(takeOff, ",")
+		i, ok := groups[key]
+		if !ok {
+			i = len(action.changes)
+			groups[key] = i
+			action.changes = append(action.changes, labelChange{add: restore, remove: takeOff})
+		}
+		action.changes[i].ids = append(action.changes[i].ids, id)
+	}
+	return action
+}
+
+// labelsBefore maps each row's ID to its labels
+func labelsBefore(rows []emailItem) map[string][]string {
+	before := make(map[string][]string, len(rows))
+	for _, row := range rows {
+		before[row.id] = row.labels
+	}
+	return before
+}
+
+// pushUndo records a finished action
+func (m *model) pushUndo(action *undoAction) {
+	if action == nil {
+		return
+	}
+	m.undo = append(m.undo, action)
+	if len(m.undo) > maxUndo {
+		m.undo = m.undo[len(m.undo)-maxUndo:]
+	}
+}
+
+// undoLast reverses the most recent action. If that fails partway, what is
+// left of it goes back on the stack.
+func (m model) undoLast() (tea.Model, tea.Cmd) {
+	if len(m.undo) == 0 {
+		return m, showNotification("Nothing to undo")
+	}
+	action := m.undo[len(m.undo)-1]
+	m.undo = m.undo[:len(m.undo)-1]
+	return m, runUndo(m.backend, action)
+}
+
+func runUndo(b MailBackend, action *undoAction) tea.Cmd {
+	return func() tea.Msg {
+		ctx := context.Background()
+		var messages []*gmail.Message
+
+		switch {
+		case action.untrash:
+			for i, id := range action.ids {
+				msg, err := b.UntrashMessage(ctx, id)
+				if err != nil {
+					done, rest := action.split(action.ids[:i], nil, action.ids[i:], nil)
+					return undoneMsg{action: done, messages: messages, rest: rest, err: err}
+				}
+				messages = append(messages, msg)
+			}
+
+		default:
+			for k, change := range action.changes {
+				if len(change.ids) == 1 {
+					req := &gmail.ModifyMessageRequest{AddLabelIds: change.add, RemoveLabelIds: change.remove}
+					msg, err := b.ModifyMessage(ctx, change.ids[0], req)
+					if err != nil {
+						done, rest := action.split(nil, action.changes[:k], nil, action.changes[k:])
+						return undoneMsg{action: done, messages: messages, rest: rest, err: err}
+					}
+					messages = append(messages, msg)
+					continue
+				}
+				for start := 0; start < len(change.ids); start += 1000 {
+					err := b.BatchModify(ctx, &gmail.BatchModifyMessagesRequest{
+						Ids:            change.ids[start:min(start+1000, len(change.ids))],
+						AddLabelIds:    change.add,
+						RemoveLabelIds: change.remove,
+					})
+					if err != nil {
+						doneChanges := action.changes[:k:k]
+						if start > 0 {
+							doneChanges = append(doneChanges, labelChange{ids: change.ids[:start], add: change.add, remove: change.remove})
+						}
+						restChanges := append([]labelChange{{ids: change.ids[start:], add: change.add, remove: change.remove}}, action.changes[k+1:]...)
+						done, rest := action.split(nil, doneChanges, nil, restChanges)
+						return undoneMsg{action: done, messages: messages, rest: rest, err: err}
+					}
+				}
+			}
+		}
+		return undoneMsg{action: action, messages: messages}
+	}
+}
+
+// split divides an action that was undone only partway into the part that
+// was undone and the part still to undo. For label changes the IDs are
+// those of the changes.
+func (a *undoAction) split(doneIDs []string, doneChanges []labelChange, restIDs []string, restChanges []labelChange) (done, rest *undoAction) {
+	if !a.untrash {
+		doneIDs, restIDs = changeIDs(doneChanges), changeIDs(restChanges)
+	}
+	done = &undoAction{note: a.note, ids: doneIDs, threadID: a.threadID, changes: doneChanges, untrash: a.untrash}
+	rest = &undoAction{note: a.note, ids: restIDs, threadID: a.threadID, changes: restChanges, untrash: a.untrash}
+
+	pending := make(map[string]bool, len(restIDs))
+	for _, id := range restIDs {
+		pending[id] = true
+	}
+	for _, row := range a.rows {
+		if pending[row.id] {
+			rest.rows = append(rest.rows, row)
+		} else {
+			done.rows = append(done.rows, row)
+		}
+	}
+	return done, rest
+}
+
+func changeIDs(changes []labelChange) []string {
+	var ids []string
+	for _, change := range changes {
+		ids = append(ids, change.ids...)
+	}
+	return ids
+}
+
+// handleUndone puts back the rows an undone action removed, then applies
+// the labels the server reported. What a failure left undone can be tried
+// again with another u.
+func (m model) handleUndone(msg undoneMsg) (tea.Model, tea.Cmd) {
+	action := msg.action
+	setCmd := m.restoreRows(action.rows)
+	if action.threadID != "" {
+		for _, change := range action.changes {
+			m.trackMuted(action.threadID, change.add, change.remove)
+		}
+	}
+
+	notice := showNotification("Undid: " + action.note)
+	if msg.err != nil {
+		m.pushUndo(msg.rest)
+		err := fmt.Errorf("failed to undo %q: %w", action.note, msg.err)
+		if len(action.ids) > 0 {
+			total := len(action.ids) + len(msg.rest.ids)
+			err = fmt.Errorf("undid %d of %s of %q, then failed; u tries the rest: %w", len(action.ids), pluralize(total, "message"), action.note, msg.err)
+		}
+		notice = m.notifyError(err)
+	}
+	return m, tea.Batch(setCmd, m.relabelRows(msg.messages), notice)
+}
+
+// undoRows returns the loaded rows of ids
+func undoRows(items []list.Item, ids []string) []emailItem {
+	var rows []emailItem
+	for _, id := range ids {
+		if i := itemIndex(items, id); i >= 0 {
+			rows = append(rows, items[i].(emailItem))
+		}
+	}
+	return rows
+}
@@ -4,12 +4,16 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/charmbracelet/bubbles/key"
 	"github.com/charmbracelet/bubbles/list"
+	"github.com/charmbracelet/bubbles/textinput"
 	tea "github.com/charmbracelet/bubbletea"
+	"google.golang.org/api/gmail/v1"
 )
 
 func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
@@ -26,6 +30,91 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		return m.handleLabelsLoaded(msg)
 	case searchResultMsg:
 		return m.handleSearchResult(msg)
+	case itemsFetchedMsg:
+		return m.handleItemsFetched(msg)
+	case syncDoneMsg:
+		return m.handleSyncDone(msg)
+	case threadLoadedMsg:
+		return m.handleThreadLoaded(msg)
+	case identityLoadedMsg:
+		m.ownAddresses = msg.addresses
+		m.contacts.SetOwnAddresses(msg.addresses)
+		return m, nil
+	case labelsChangedMsg:
+		m.labels = msg.labels
+		m.setLabelItems()
+		return m, showNotification(msg.message)
+	case messagesModifiedMsg:
+		return m.handleMessagesModified(msg)
+	case threadModifiedMsg:
+		return m.handleThreadModified(msg)
+	case bulkProgressMsg:
+		return m.handleBulkProgress(msg)
+	case undoneMsg:
+		return m.handleUndone(msg)
+	case actionFailedMsg:
+		return m.handleActionFailed(msg)
+	case allMatchingMsg:
+		for _, id := range msg.ids {
+			m.selected[id] = true
+		}
+		note := fmt.Sprintf("Selected all %s matching", pluralize(len(msg.ids), "message"))
+		if msg.truncated {
+			note = fmt.Sprintf("Selected the first %s matching", pluralize(len(msg.ids), "message"))
+		}
+		return m, showNotification(note)
+	case mutedThreadsMsg:
+		for _, id := range msg.threadIDs {
+			m.mutedThreads[id] = true
+		}
+		return m, nil
+	case contactsSavedMsg:
+		if msg.err != nil {
+			return m, m.notifyError(fmt.Errorf("could not save contacts: %w", msg.err))
+		}
+		return m, nil
+	case harvestFailedMsg:
+		return m, m.notifyError(fmt.Errorf("could not read sent mail for contacts: %w", msg.err))
+	case forwardReadyMsg:
+		return m.handleForwardReady(msg)
+	case draftSavedMsg:
+		return m.handleDraftSaved(msg)
+	case draftsLoadedMsg:
+		return m.handleDraftsLoaded(msg)
+	case draftReadyMsg:
+		return m.handleDraftReady(msg)
+	case draftDeletedMsg:
+		if i := draftIndex(m.draftsList.Items(), msg.id); i >= 0 {
+			m.draftsList.RemoveItem(i)
+		}
+		return m, showNotification("Draft discarded")
+	case emailLoadErrorMsg:
+		if isCanceled(msg.err) {
+			// The request was abandoned; nothing to report
+			return m, nil
+		}
+		if msg.reqID != 0 && !m.listRequest.current(msg.reqID) && !m.screenRequest.current(msg.reqID) {
+			// A newer request took its place
+			return m, nil
+		}
+		m.loadingMore = false
+		if m.state == stateLoading {
+			// Whatever was loading isn't coming
+			m.state = stateInbox
+			m.listLoading = false
+		}
+		return m, m.notifyError(msg.err)
+	case notificationMsg:
+		return m, m.notify(msg.message, false)
+	case retryNotice:
+		return m, m.notify(fmt.Sprintf("Gmail %s failed (%v); retrying in %s…", msg.op, msg.err, msg.wait.Round(100*time.Millisecond)), false)
+	case cacheNotice:
+		return m, m.notify(msg.text, msg.isError)
+	case toastExpiredMsg:
+		if msg.seq == m.toastSeq {
+			m.toast = nil
+		}
+		return m, nil
 	case attachmentDownloadedMsg:
 		return m, showNotification(fmt.Sprintf("Downloaded: %s", msg.filename))
 	}
@@ -39,10 +128,26 @@ func (m model) handleWindowSize(msg tea.WindowSizeMsg) (tea.Model, tea.Cmd) {
 	m.help.Width = msg.Width
 
 	if m.state == stateInbox {
-		m.list.SetSize(msg.Width, msg.Height-3)
+		m.list.SetSize(msg.Width, msg.Height-4)
+		m.threadList.SetSize(msg.Width, msg.Height-4)
 	} else if m.state == stateViewing {
 		m.viewport.Width = msg.Width
 		m.viewport.Height = msg.Height - 7
+	} else if m.state == stateConversation {
+		m.viewport.Width = msg.Width
+		m.viewport.Height = msg.Height - 6
+		m.renderConversation()
+	} else if m.state == stateDrafts {
+		m.draftsList.SetSize(msg.Width, msg.Height-4)
+	} else if m.state == stateContacts {
+		m.contactsList.SetSize(msg.Width, msg.Height-4)
+	} else if m.state == stateManagingLabels {
+		m.labelsList.SetSize(msg.Width, msg.Height-4)
+	} else if m.state == stateLog {
+		m.logViewport.Width = msg.Width
+		m.logViewport.Height = msg.Height - 4
+	} else if m.state == stateApplyingLabels {
+		m.labelPicker.SetSize(msg.Width, msg.Height-4)
 	}
 	return m, nil
 }
@@ -63,6 +168,10 @@ func (m model) handleKeyPress(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 		return m.handleAttachmentDownload(msg)
 	}
 
+	if m.state == stateLoading && key.Matches(msg, keys.Back) {
+		return m.cancelLoading()
+	}
+
 	// Route to state-specific handlers
 	switch m.state {
 	case stateInbox:
@@ -77,6 +186,16 @@ func (m model) handleKeyPress(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 		return updateSearching(msg, m)
 	case stateManagingLabels:
 		return updateLabelManagement(msg, m)
+	case stateConversation:
+		return updateConversation(msg, m)
+	case stateDrafts:
+		return updateDrafts(msg, m)
+	case stateContacts:
+		return updateContacts(msg, m)
+	case stateApplyingLabels:
+		return updateLabelPicker(msg, m)
+	case stateLog:
+		return updateLog(msg, m)
 	}
 
 	return m, nil
@@ -93,9 +212,13 @@ func (m model) handleAttachmentDownload(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 		if err == nil && digit > 0 && digit <= len(m.currentMsg.attachments) {
 			m.attachmentDownloading = false
 			attachment := m.currentMsg.attachments[digit-1]
+			dir, err := m.paths.downloadPath()
+			if err != nil {
+				return m, m.notifyError(err)
+			}
 			return m, tea.Batch(
 				showNotification(fmt.Sprintf("Downloading %s...", attachment.Filename)),
-				downloadAttachment(m.srv, m.currentMsg.id, attachment),
+				downloadAttachment(m.backend, dir, m.currentMsg.id, attachment),
 			)
 		}
 	}
@@ -103,7 +226,13 @@ func (m model) handleAttachmentDownload(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 }
 
 func (m model) handleEmailLoaded(msg emailLoadedMsg) (tea.Model, tea.Cmd) {
+	if !m.screenRequest.current(msg.reqID) {
+		return m, nil
+	}
 	m.state = stateViewing
+	if msg.item != nil {
+		m.currentMsg = msg.item
+	}
 	m.fullEmail = msg.content
 	m.viewport.Width = m.width
 	m.viewport.Height = m.height - 7
@@ -113,33 +242,580 @@ func (m model) handleEmailLoaded(msg emailLoadedMsg) (tea.Model, tea.Cmd) {
 
 func (m model) handleEmailSent() (tea.Model, tea.Cmd) {
 	m.state = stateInbox
+	m.draftID = ""
 	m.viewport.GotoTop()
 	return m, showNotification("Email sent successfully!")
 }
 
 func (m model) handleLabelsLoaded(msg labelsLoadedMsg) (tea.Model, tea.Cmd) {
-	items := make([]list.Item, len(msg.labels))
-	for i, label := range msg.labels {
-		items[i] = labelItem{label: label}
-	}
 	m.labels = msg.labels
-	m.labelsList.SetItems(items)
+	m.setLabelItems()
+	m.labelsList.SetSize(m.width, m.height-4)
+	m.editingLabel = false
+	m.deletingLabel = nil
 	m.state = stateManagingLabels
 	return m, nil
 }
 
+// setLabelItems fills the labels screen from m.labels
+func (m *model) setLabelItems() {
+	sorted := sortLabels(m.labels)
+	items := make([]list.Item, len(sorted))
+	for i, label := range sorted {
+		items[i] = labelItem{label: label}
+	}
+	m.labelsList.SetItems(items)
+}
+
+// selectionAction handles the keys that mark rows and the actions that
+// apply to every marked row, reporting false for any other key
+func (m model) selectionAction(msg tea.KeyMsg) (tea.Model, tea.Cmd, bool) {
+	active := m.activeList()
+
+	switch {
+	case key.Matches(msg, keys.ToggleSelect):
+		if item := active.SelectedItem(); item != nil {
+			m.toggleSelected(itemIDs(item))
+			m.selectAnchor = active.Index()
+			active.CursorDown()
+		}
+		return m, nil, true
+
+	case key.Matches(msg, keys.SelectRange):
+		visible := active.VisibleItems()
+		from, to := min(m.selectAnchor, active.Index()), max(m.selectAnchor, active.Index())
+		for i := from; i <= to && i < len(visible); i++ {
+			for _, id := range itemIDs(visible[i]) {
+				m.selected[id] = true
+			}
+		}
+		return m, nil, true
+
+	case key.Matches(msg, keys.SelectAll):
+		return m.selectAll()
+
+	case msg.Type == tea.KeyEsc && len(m.selected) > 0:
+		clear(m.selected)
+		return m, nil, true
+
+	case key.Matches(msg, keys.Move):
+		if len(m.selected) == 0 {
+			selected, ok := m.selectedEmail()
+			if !ok {
+				return m, nil, true
+			}
+			next, cmd := m.openMovePicker([]emailItem{selected})
+			return next, cmd, true
+		}
+	}
+
+	if len(m.selected) == 0 {
+		return m, nil, false
+	}
+	if m.bulk != nil && (key.Matches(msg, keys.Delete, keys.Archive, keys.ToggleRead, keys.ApplyLabels, keys.Move, keys.DeleteForever)) {
+		return m, showNotification("Wait for the current bulk action to finish"), true
+	}
+
+	switch {
+	case key.Matches(msg, keys.Delete):
+		next, cmd := m.startBulk(&bulkOp{verb: "Moved", detail: " to trash", ids: m.selectedIDs(), add: []string{"TRASH"}, remove: []string{"INBOX"}})
+		return next, cmd, true
+
+	case key.Matches(msg, keys.Archive):
+		next, cmd := m.startBulk(&bulkOp{verb: "Archived", ids: m.selectedIDs(), remove: []string{"INBOX"}})
+		return next, cmd, true
+
+	case key.Matches(msg, keys.ToggleRead):
+		op := &bulkOp{verb: "Marked", detail: " as unread", ids: m.selectedIDs(), add: []string{"UNREAD"}}
+		for _, item := range m.selectedItems() {
+			if item.isUnread {
+				op = &bulkOp{verb: "Marked", detail: " as read", ids: op.ids, remove: []string{"UNREAD"}}
+				break
+			}
+		}
+		next, cmd := m.startBulk(op)
+		return next, cmd, true
+
+	case key.Matches(msg, keys.ApplyLabels):
+		next, cmd := m.openLabelPicker(m.selectedItems())
+		return next, cmd, true
+
+	case key.Matches(msg, keys.Move):
+		next, cmd := m.openMovePicker(m.selectedItems())
+		return next, cmd, true
+
+	case key.Matches(msg, keys.DeleteForever):
+		m.deleteTargets = m.selectedIDs()
+		return m, nil, true
+	}
+	return m, nil, false
+}
+
+// toggleSelected selects ids, or deselects them if they all already are
+func (m *model) toggleSelected(ids []string) {
+	all := true
+	for _, id := range ids {
+		all = all && m.selected[id]
+	}
+	for _, id := range ids {
+		if all {
+			delete(m.selected, id)
+		} else {
+			m.selected[id] = true
+		}
+	}
+}
+
+// selectAll selects every visible row. Pressed again with more pages left
+// to load, it selects every message matching the listing on the server;
+// pressed once everything is selected, it clears the selection.
+func (m model) selectAll() (tea.Model, tea.Cmd, bool) {
+	visible := m.activeList().VisibleItems()
+	added := 0
+	for _, item := range visible {
+		for _, id := range itemIDs(item) {
+			if !m.selected[id] {
+				m.selected[id] = true
+				added++
+			}
+		}
+	}
+
+	filtered := m.activeList().FilterState() != list.Unfiltered
+	switch {
+	case added > 0 && m.nextPageToken != "" && !filtered:
+		return m, showNotification(fmt.Sprintf("Selected %s • press * again to select all ~%d", pluralize(len(m.selected), "message"), m.resultEstimate)), true
+	case added > 0:
+		return m, nil, true
+	case m.nextPageToken != "" && !filtered && len(m.selected) < int(m.resultEstimate):
+		return m, listAllMatching(m.backend, m.listQuery, m.listLabelIDs), true
+	}
+	clear(m.selected)
+	return m, nil, true
+}
+
+// selectedIDs returns the selected message IDs, loaded rows first in list
+// order
+func (m model) selectedIDs() []string {
+	ids := make([]string, 0, len(m.selected))
+	seen := make(map[string]bool, len(m.selected))
+	for _, item := range m.list.Items() {
+		if e, ok := item.(emailItem); ok && m.selected[e.id] {
+			ids = append(ids, e.id)
+			seen[e.id] = true
+		}
+	}
+	var rest []string
+	for id := range m.selected {
+		if !seen[id] {
+			rest = append(rest, id)
+		}
+	}
+	sort.Strings(rest)
+	return append(ids, rest...)
+}
+
+// selectedItems returns the selected messages. Those selected from the
+// server but never loaded have only their ID.
+func (m model) selectedItems() []emailItem {
+	items := make([]emailItem, 0, len(m.selected))
+	for _, id := range m.selectedIDs() {
+		if i := itemIndex(m.list.Items(), id); i >= 0 {
+			items = append(items, m.list.Items()[i].(emailItem))
+		} else {
+			items = append(items, emailItem{id: id})
+		}
+	}
+	return items
+}
+
+// startBulk shows the change on every loaded row at once and starts
+// sending it to the server
+func (m model) startBulk(op *bulkOp) (tea.Model, tea.Cmd) {
+	if len(op.ids) == 0 {
+		return m, nil
+	}
+	m.bulk = op
+
+	items := m.list.Items()
+	op.rows = undoRows(items, op.ids)
+	op.before = labelsBefore(op.rows)
+	var modified []*gmail.Message
+	for _, row := range op.rows {
+		if op.delete {
+			items = removeItem(items, row.id)
+			continue
+		}
+		modified = append(modified, &gmail.Message{Id: row.id, LabelIds: applyLabelChanges(row.labels, op.add, op.remove)})
+	}
+	setCmd := m.setItems(items)
+	return m, tea.Batch(setCmd, m.relabelRows(modified), runBulkChunk(m.backend, op))
+}
+
+// handleBulkProgress records a finished chunk, putting its rows back if
+// it failed, and sends the next one, reporting a summary after the last
+func (m model) handleBulkProgress(msg bulkProgressMsg) (tea.Model, tea.Cmd) {
+	op := msg.op
+	var cmd tea.Cmd
+	if msg.err != nil {
+		op.failed += len(msg.ids)
+		op.err = msg.err
+		cmd = m.restoreRows(rowsOf(op.rows, msg.ids))
+	} else {
+		op.done += len(msg.ids)
+		op.succeeded = append(op.succeeded, msg.ids...)
+		for id, labels := range msg.before {
+			op.before[id] = labels
+		}
+		for _, id := range msg.ids {
+			delete(m.selected, id)
+		}
+	}
+
+	if !op.finished() {
+		return m, tea.Batch(cmd, runBulkChunk(m.backend, op))
+	}
+	if m.bulk == op {
+		m.bulk = nil
+	}
+	if !op.delete && len(op.succeeded) > 0 {
+		undo := reverseLabels(op.summary(), op.before, op.succeeded, op.add, op.remove)
+		undo.rows = rowsOf(op.rows, op.succeeded)
+		m.pushUndo(undo)
+	}
+	if op.failed > 0 {
+		return m, tea.Batch(cmd, m.notify(op.summary(), true))
+	}
+	return m, tea.Batch(cmd, showNotification(op.summary()))
+}
+
+// handleMessagesModified updates the labels of the modified rows in place,
+// dropping rows that no longer belong in the listing
+func (m model) handleMessagesModified(msg messagesModifiedMsg) (tea.Model, tea.Cmd) {
+	m.pushUndo(msg.undo)
+	cmd := m.relabelRows(msg.messages)
+	if msg.message == "" {
+		return m, cmd
+	}
+	return m, tea.Batch(cmd, showNotification(msg.message))
+}
+
+// handleThreadModified applies a conversation-wide label change to the
+// rows of that conversation
+func (m model) handleThreadModified(msg threadModifiedMsg) (tea.Model, tea.Cmd) {
+	if msg.created != nil {
+		m.labels = append(m.labels, msg.created)
+	}
+	m.trackMuted(msg.threadID, msg.add, msg.remove)
+
+	var modified []*gmail.Message
+	for _, item := range m.list.Items() {
+		if e, ok := item.(emailItem); ok && e.threadId == msg.threadID {
+			modified = append(modified, &gmail.Message{Id: e.id, LabelIds: applyLabelChanges(e.labels, msg.add, msg.remove)})
+		}
+	}
+	return m.handleMessagesModified(messagesModifiedMsg{messages: modified, message: msg.message, undo: msg.undo})
+}
+
+// trackMuted notes a conversation gaining or losing the Muted label
+func (m *model) trackMuted(threadID string, add, remove []string) {
+	if muted := findLabelByName(m.labels, mutedLabelName); muted != nil {
+		if containsString(add, muted.Id) {
+			m.mutedThreads[threadID] = true
+		} else if containsString(remove, muted.Id) {
+			delete(m.mutedThreads, threadID)
+		}
+	}
+}
+
+// relabelRows gives rows their new labels, removing those the listing no
+// longer matches
+func (m *model) relabelRows(messages []*gmail.Message) tea.Cmd {
+	items := m.list.Items()
+	for _, modified := range messages {
+		if m.currentMsg != nil && m.currentMsg.id == modified.Id {
+			updated := withLabels(*m.currentMsg, modified.LabelIds)
+			m.currentMsg = &updated
+		}
+		i := itemIndex(items, modified.Id)
+		if i < 0 {
+			continue
+		}
+		if !m.belongsInList(modified.LabelIds) {
+			items = removeItem(items, modified.Id)
+			continue
+		}
+		items[i] = withLabels(items[i].(emailItem), modified.LabelIds)
+	}
+	return m.setItems(items)
+}
+
+// belongsInList reports whether a message with these labels matches the
+// current listing. Free-text searches can't be checked locally, so their
+// rows stay unless the message went to trash or spam.
+func (m model) belongsInList(labelIDs []string) bool {
+	for _, hidden := range []string{"TRASH", "SPAM"} {
+		listed := containsString(m.listLabelIDs, hidden) || strings.Contains(strings.ToLower(m.listQuery), "in:"+strings.ToLower(hidden))
+		if containsString(labelIDs, hidden) && !listed {
+			return false
+		}
+	}
+	if m.listQuery != inboxQuery && m.listQuery != "" {
+		return true
+	}
+	msg := &gmail.Message{LabelIds: labelIDs}
+	return hasAllLabels(msg, m.listLabelIDs) && matchesQuery(msg, m.listQuery)
+}
+
+// mailAction runs the archive, star, important, spam and mute keys on
+// item, reporting false for any other key
+func (m *model) mailAction(msg tea.KeyMsg, item emailItem) (tea.Cmd, bool) {
+	switch {
+	case key.Matches(msg, keys.Archive):
+		if !item.hasLabel("INBOX") {
+			return showNotification("Already archived"), true
+		}
+		return m.modify(item, nil, []string{"INBOX"}, "Archived"), true
+
+	case key.Matches(msg, keys.Star):
+		if item.hasLabel("STARRED") {
+			return m.modify(item, nil, []string{"STARRED"}, "Unstarred"), true
+		}
+		return m.modify(item, []string{"STARRED"}, nil, "Starred"), true
+
+	case key.Matches(msg, keys.Important):
+		if item.hasLabel("IMPORTANT") {
+			return m.modify(item, nil, []string{"IMPORTANT"}, "Marked not important"), true
+		}
+		return m.modify(item, []string{"IMPORTANT"}, nil, "Marked important"), true
+
+	case key.Matches(msg, keys.Spam):
+		if item.hasLabel("SPAM") {
+			return m.modify(item, []string{"INBOX"}, []string{"SPAM"}, "Not spam: moved to inbox"), true
+		}
+		return m.modify(item, []string{"SPAM"}, []string{"INBOX"}, "Reported as spam"), true
+
+	case key.Matches(msg, keys.Mute):
+		ids := m.threadMessageIDs(item.threadId)
+		if muted := findLabelByName(m.labels, mutedLabelName); muted != nil && m.mutedThreads[item.threadId] {
+			add, remove := []string{"INBOX"}, []string{muted.Id}
+			return m.optimistic(modifyThread(m.backend, item.threadId, add, remove, "Conversation unmuted"), ids, add, remove), true
+		}
+		return m.optimistic(muteThread(m.backend, m.labels, item.threadId), ids, nil, []string{"INBOX"}), true
+	}
+	return nil, false
+}
+
+// modify changes the labels of one message, showing the change at once
+func (m *model) modify(item emailItem, add, remove []string, note string) tea.Cmd {
+	return m.optimistic(modifyMessage(m.backend, item.id, add, remove, note), []string{item.id}, add, remove)
+}
+
+func (m *model) trash(item emailItem) tea.Cmd {
+	return m.optimistic(deleteEmail(m.backend, item.id), []string{item.id}, []string{"TRASH"}, []string{"INBOX"})
+}
+
+func (m *model) toggleRead(item emailItem) tea.Cmd {
+	cmd := toggleReadStatus(m.backend, item.id, item.isUnread)
+	if item.isUnread {
+		return m.optimistic(cmd, []string{item.id}, nil, []string{"UNREAD"})
+	}
+	return m.optimistic(cmd, []string{item.id}, []string{"UNREAD"}, nil)
+}
+
+// archiveIfMuted archives a message that arrived in the inbox as part of a
+// muted conversation, reporting whether it did
+func (m model) archiveIfMuted(item emailItem) (tea.Cmd, bool) {
+	muted := findLabelByName(m.labels, mutedLabelName)
+	if muted == nil || !m.mutedThreads[item.threadId] || !item.hasLabel("INBOX") {
+		return nil, false
+	}
+	return modifyThread(m.backend, item.threadId, []string{muted.Id}, []string{"INBOX"}, ""), true
+}
+
 func (m model) handleSearchResult(msg searchResultMsg) (tea.Model, tea.Cmd) {
-	items := make([]list.Item, 0, len(msg.messages))
-	for _, message := range msg.messages {
-		if item := createEmailItem(m.srv, message.Id, true); item != nil {
-			items = append(items, *item)
+	if !m.listRequest.current(msg.reqID) {
+		return m, nil
+	}
+	m.nextPageToken = msg.nextPageToken
+	m.resultEstimate = msg.estimate
+	switch msg.mode {
+	case listReplace:
+		m.listQuery = msg.query
+		m.listLabelIDs = msg.labelIDs
+		clear(m.selected)
+		m.list.ResetSelected()
+		m.threadList.ResetSelected()
+		m.setItems([]list.Item{})
+		m.listLoading = true
+	case listRefresh:
+		m.setItems(keepListedItems(m.list.Items(), msg.messages))
+	}
+
+	var cmd tea.Cmd
+	m.fetch, cmd = startItemFetch(m.listRequest.ctx, m.backend, msg.messages)
+	return m, cmd
+}
+
+// handleItemsFetched merges streamed rows into the list, switching from the
+// loading screen to the inbox as soon as the first rows are available
+func (m model) handleItemsFetched(msg itemsFetchedMsg) (tea.Model, tea.Cmd) {
+	if msg.stream != m.fetch {
+		// A newer listing replaced the one these rows belong to
+		return m, nil
+	}
+
+	msg.stream.fetched += msg.count
+	items := m.list.Items()
+	learned := false
+	var archives []tea.Cmd
+	for _, item := range msg.items {
+		if m.contacts.Observe(&item) {
+			learned = true
+		}
+		if archive, ok := m.archiveIfMuted(item); ok {
+			archives = append(archives, archive)
+			continue
 		}
+		items = upsertItem(items, item)
 	}
-	m.list.SetItems(items)
-	m.state = stateInbox
+	cmd := tea.Batch(append(archives, m.setItems(items))...)
+	if learned {
+		cmd = tea.Batch(cmd, saveContacts(m.contacts))
+	}
+	if len(msg.errs) > 0 {
+		// The rows that did load are still shown
+		err := fmt.Errorf("could not load %s: %w", pluralize(len(msg.errs), "message"), msg.errs[0])
+		cmd = tea.Batch(cmd, m.notifyError(err))
+	}
+
+	if m.listLoading && (len(items) > 0 || msg.done) {
+		m.listLoading = false
+		m.state = stateInbox
+		m.list.SetSize(m.width, m.height-4)
+		m.threadList.SetSize(m.width, m.height-4)
+	}
+
+	if msg.done {
+		m.fetch = nil
+		m.loadingMore = false
+		return m, cmd
+	}
+	return m, tea.Batch(cmd, waitForItems(msg.stream))
+}
+
+// handleSyncDone applies a sync result to the visible list
+func (m model) handleSyncDone(msg syncDoneMsg) (tea.Model, tea.Cmd) {
+	result := msg.result
+	if result.resync {
+		m.loadingMore = false
+		ctx := m.startRequest(&m.listRequest)
+		return m, fetchMessagePage(ctx, m.backend, m.listQuery, m.listLabelIDs, "", m.pageSize(), listRefresh)
+	}
+
+	cache := m.sync.backend.cache
+	// Only listings we can evaluate locally gain or lose rows; free-text
+	// searches just get their existing rows updated
+	matchable := m.listQuery == inboxQuery || m.listQuery == ""
+	listed := func(msg *gmail.Message) bool {
+		return matchable && hasAllLabels(msg, m.listLabelIDs) && matchesQuery(msg, m.listQuery)
+	}
+
+	items := m.list.Items()
+	for _, id := range result.deleted {
+		items = removeItem(items, id)
+	}
+	for _, id := range result.changed {
+		cached, ok := cache.Message(id, false)
+		if !ok {
+			continue
+		}
+		if matchable && !listed(cached) {
+			items = removeItem(items, id)
+			continue
+		}
+		if i := itemIndex(items, id); i >= 0 {
+			items[i] = withLabels(items[i].(emailItem), cached.LabelIds)
+		} else if matchable {
+			// Moved into this listing elsewhere
+			items = upsertItem(items, *newEmailItem(cached))
+		}
+	}
+	var archives []tea.Cmd
+	for _, id := range result.added {
+		if cached, ok := cache.Message(id, false); ok && listed(cached) {
+			item := newEmailItem(cached)
+			if archive, ok := m.archiveIfMuted(*item); ok {
+				archives = append(archives, archive)
+				continue
+			}
+			items = upsertItem(items, *item)
+		}
+	}
+
+	cmds := append(archives, m.setItems(items))
+	for _, err := range result.errs {
+		cmds = append(cmds, m.notifyError(fmt.Errorf("sync: %w", err)))
+	}
+	return m, tea.Batch(cmds...)
+}
+
+// handleThreadLoaded opens the conversation screen with the newest and any
+// unread messages expanded
+func (m model) handleThreadLoaded(msg threadLoadedMsg) (tea.Model, tea.Cmd) {
+	if !m.screenRequest.current(msg.reqID) {
+		return m, nil
+	}
+	if len(msg.messages) == 0 {
+		m.state = stateInbox
+		return m, nil
+	}
+
+	m.conversation = msg.messages
+	m.convExpanded = make([]bool, len(msg.messages))
+	for i, item := range msg.messages {
+		m.convExpanded[i] = item.isUnread || i == len(msg.messages)-1
+	}
+	m.convIndex = len(msg.messages) - 1
+	m.currentMsg = m.conversation[m.convIndex]
+
+	m.state = stateConversation
+	m.viewport.Width = m.width
+	m.viewport.Height = m.height - 6
+	m.renderConversation()
+	m.viewport.SetYOffset(m.convOffsets[m.convIndex])
 	return m, nil
 }
 
+// refresh brings the current listing up to date, incrementally when a
+// sync engine is available
+func (m model) refresh() (model, tea.Cmd) {
+	if m.sync != nil {
+		return m, runSync(m.sync)
+	}
+	m.loadingMore = false // a page still loading is abandoned
+	ctx := m.startRequest(&m.listRequest)
+	return m, fetchMessagePage(ctx, m.backend, m.listQuery, m.listLabelIDs, "", m.pageSize(), listRefresh)
+}
+
+// loadMore requests the next page of the current listing, if there is one
+func (m model) loadMore() (model, tea.Cmd) {
+	if m.nextPageToken == "" || m.loadingMore || m.fetch != nil {
+		return m, nil
+	}
+	m.loadingMore = true
+	ctx := m.startRequest(&m.listRequest)
+	return m, fetchMessagePage(ctx, m.backend, m.listQuery, m.listLabelIDs, m.nextPageToken, m.pageSize(), listAppend)
+}
+
+// pageSize keeps "load more" pages the same size as the listing's first page
+func (m model) pageSize() int64 {
+	if m.listQuery != "" && m.listQuery != inboxQuery {
+		return searchMaxResults
+	}
+	return defaultMaxResults
+}
+
 func (m model) updateComponents(msg tea.Msg) (tea.Model, tea.Cmd) {
 	var cmds []tea.Cmd
 	var cmd tea.Cmd
@@ -166,10 +842,43 @@ func (m model) updateComponents(msg tea.Msg) (tea.Model, tea.Cmd) {
 }
 
 func updateInbox(msg tea.KeyMsg, m model) (tea.Model, tea.Cmd) {
+	if m.deleteTargets != nil {
+		ids := m.deleteTargets
+		m.deleteTargets = nil
+		if msg.String() == "y" {
+			return m.startBulk(&bulkOp{verb: "Deleted", ids: ids, delete: true})
+		}
+		return m, nil
+	}
+	if m.list.FilterState() != list.Filtering {
+		if next, cmd, ok := m.selectionAction(msg); ok {
+			return next, cmd
+		}
+	}
+
+	if selected, ok := m.selectedEmail(); ok && m.list.FilterState() != list.Filtering {
+		if cmd, ok := m.mailAction(msg, selected); ok {
+			return m, cmd
+		}
+	}
+
 	switch {
 	case key.Matches(msg, keys.Compose):
 		m.state = stateComposing
+		m.resetCompose()
 		m.composeFrom.SetValue("me")
+		return m, m.focusComposeField()
+
+	case key.Matches(msg, keys.Drafts) && m.list.FilterState() != list.Filtering:
+		m.state = stateLoading
+		ctx := m.startRequest(&m.screenRequest)
+		return m, tea.Batch(m.loading.Tick, loadDrafts(ctx, m.backend))
+
+	case key.Matches(msg, keys.Contacts) && m.list.FilterState() != list.Filtering:
+		m.state = stateContacts
+		m.mergeFrom = ""
+		m.refreshContacts()
+		m.contactsList.SetSize(m.width, m.height-4)
 		return m, nil
 
 	case key.Matches(msg, keys.Search):
@@ -178,56 +887,123 @@ func updateInbox(msg tea.KeyMsg, m model) (tea.Model, tea.Cmd) {
 		return m, nil
 
 	case key.Matches(msg, keys.Labels):
-		return m, loadLabels(m.srv)
+		return m, loadLabels(m.backend)
+
+	case key.Matches(msg, keys.ApplyLabels) && m.list.FilterState() != list.Filtering:
+		if selected, ok := m.selectedEmail(); ok {
+			return m.openLabelPicker([]emailItem{selected})
+		}
 
 	case key.Matches(msg, keys.Quit):
 		return m, tea.Quit
 
 	case key.Matches(msg, keys.Select):
-		selected, ok := m.list.SelectedItem().(emailItem)
+		if thread, ok := m.threadList.SelectedItem().(threadItem); ok && m.threadMode {
+			m.state = stateLoading
+			ctx := m.startRequest(&m.screenRequest)
+			return m, tea.Batch(m.loading.Tick, loadThread(ctx, m.backend, thread.threadId))
+		}
+		selected, ok := m.selectedEmail()
 		if ok {
 			m.currentMsg = &selected
 			m.state = stateLoading
-			return m, tea.Batch(m.loading.Tick, loadEmail(m.srv, selected.id))
+			ctx := m.startRequest(&m.screenRequest)
+			return m, tea.Batch(m.loading.Tick, loadEmail(ctx, m.backend, selected.id))
 		}
 
 	case key.Matches(msg, keys.Delete):
-		if selected, ok := m.list.SelectedItem().(emailItem); ok {
-			return m, deleteEmail(m.srv, selected.id)
+		if selected, ok := m.selectedEmail(); ok {
+			return m, m.trash(selected)
 		}
 
 	case key.Matches(msg, keys.ToggleRead):
-		if selected, ok := m.list.SelectedItem().(emailItem); ok {
-			return m, toggleReadStatus(m.srv, selected.id, selected.isUnread)
+		if selected, ok := m.selectedEmail(); ok {
+			return m, m.toggleRead(selected)
+		}
+
+	case key.Matches(msg, keys.DeleteForever) && m.list.FilterState() != list.Filtering:
+		if selected, ok := m.selectedEmail(); ok {
+			m.deleteTargets = []string{selected.id}
+		}
+		return m, nil
+
+	case key.Matches(msg, keys.Undo) && m.list.FilterState() != list.Filtering:
+		return m.undoLast()
+
+	case key.Matches(msg, keys.ErrorLog) && m.list.FilterState() != list.Filtering:
+		return m.openLog()
+
+	case key.Matches(msg, keys.ToggleThreads) && m.list.FilterState() != list.Filtering:
+		m.threadMode = !m.threadMode
+		if m.threadMode {
+			m.threadList.Title = m.list.Title
+			m.threadList.SetItems(groupThreads(m.list.Items()))
+			m.threadList.SetSize(m.width, m.height-4)
 		}
+		return m, nil
+
+	case key.Matches(msg, keys.LoadMore) && m.list.FilterState() != list.Filtering:
+		return m.loadMore()
+
+	case key.Matches(msg, keys.Refresh) && m.list.FilterState() != list.Filtering:
+		return m.refresh()
 	}
 
 	var cmd tea.Cmd
-	m.list, cmd = m.list.Update(msg)
+	active := m.activeList()
+	*active, cmd = active.Update(msg)
+
+	// Fetch the next page automatically once the cursor reaches the bottom
+	if active.FilterState() == list.Unfiltered && len(active.Items()) > 0 &&
+		active.Index() == len(active.Items())-1 {
+		var more tea.Cmd
+		m, more = m.loadMore()
+		return m, tea.Batch(cmd, more)
+	}
 	return m, cmd
 }
 
 func updateViewing(msg tea.KeyMsg, m model) (tea.Model, tea.Cmd) {
+	if cmd, ok := m.mailAction(msg, *m.currentMsg); ok {
+		if key.Matches(msg, keys.Archive, keys.Spam, keys.Mute) {
+			// The message leaves the inbox, so go back to it like Gmail does
+			m.state = stateInbox
+			m.viewport.GotoTop()
+		}
+		return m, cmd
+	}
+
 	switch {
 	case key.Matches(msg, keys.Back):
 		m.state = stateInbox
 		m.viewport.GotoTop()
 		return m, nil
 
-	case key.Matches(msg, keys.Reply):
-		m.state = stateReplying
-		m.replyToMsg = m.currentMsg
-		m.replyBody.Focus()
-		return m, nil
+	case key.Matches(msg, keys.Reply), key.Matches(msg, keys.ReplyAll):
+		return m.startReply(key.Matches(msg, keys.ReplyAll)), nil
+
+	case key.Matches(msg, keys.Forward):
+		m.state = stateLoading
+		ctx := m.startRequest(&m.screenRequest)
+		return m, tea.Batch(m.loading.Tick, forwardEmail(ctx, m.backend, m.currentMsg.id))
 
 	case key.Matches(msg, keys.Delete):
-		return m, deleteEmail(m.srv, m.currentMsg.id)
+		return m, m.trash(*m.currentMsg)
 
 	case key.Matches(msg, keys.ToggleRead):
-		return m, toggleReadStatus(m.srv, m.currentMsg.id, m.currentMsg.isUnread)
+		return m, m.toggleRead(*m.currentMsg)
+
+	case key.Matches(msg, keys.Undo):
+		return m.undoLast()
+
+	case key.Matches(msg, keys.ErrorLog):
+		return m.openLog()
 
 	case key.Matches(msg, keys.Labels):
-		return m, loadLabels(m.srv)
+		return m, loadLabels(m.backend)
+
+	case key.Matches(msg, keys.ApplyLabels):
+		return m.openLabelPicker([]emailItem{*m.currentMsg})
 
 	case key.Matches(msg, keys.Quit):
 		return m, tea.Quit
@@ -248,7 +1024,250 @@ func updateViewing(msg tea.KeyMsg, m model) (tea.Model, tea.Cmd) {
 	return m, cmd
 }
 
+func updateConversation(msg tea.KeyMsg, m model) (tea.Model, tea.Cmd) {
+	switch {
+	case key.Matches(msg, keys.Back):
+		m.state = stateInbox
+		m.viewport.GotoTop()
+		return m, nil
+
+	case key.Matches(msg, keys.NextMessage):
+		return m.focusConversationMessage(m.convIndex + 1), nil
+
+	case key.Matches(msg, keys.PrevMessage):
+		return m.focusConversationMessage(m.convIndex - 1), nil
+
+	case key.Matches(msg, keys.Expand):
+		m.convExpanded[m.convIndex] = !m.convExpanded[m.convIndex]
+		m.renderConversation()
+		m.viewport.SetYOffset(m.convOffsets[m.convIndex])
+		return m, nil
+
+	case key.Matches(msg, keys.Reply), key.Matches(msg, keys.ReplyAll):
+		return m.startReply(key.Matches(msg, keys.ReplyAll)), nil
+
+	case key.Matches(msg, keys.Forward):
+		m.state = stateLoading
+		ctx := m.startRequest(&m.screenRequest)
+		return m, tea.Batch(m.loading.Tick, forwardEmail(ctx, m.backend, m.currentMsg.id))
+
+	case key.Matches(msg, keys.ErrorLog):
+		return m.openLog()
+
+	case key.Matches(msg, keys.Quit):
+		return m, tea.Quit
+	}
+
+	var cmd tea.Cmd
+	m.viewport, cmd = m.viewport.Update(msg)
+	return m, cmd
+}
+
+// focusConversationMessage moves the conversation cursor to index i and
+// scrolls it into view
+func (m model) focusConversationMessage(i int) model {
+	if i < 0 || i >= len(m.conversation) {
+		return m
+	}
+	m.convIndex = i
+	m.currentMsg = m.conversation[i]
+	m.renderConversation()
+	m.viewport.SetYOffset(m.convOffsets[i])
+	return m
+}
+
+// startReply opens the reply form for the current message, returning to
+// the screen it was opened from
+func (m model) startReply(all bool) model {
+	m.replyReturn = m.state
+	m.state = stateReplying
+	m.replyToMsg = m.currentMsg
+	m.replyAll = all
+	m.replyBody.Reset()
+	m.replyAttachments = []outgoingAttachment{}
+	m.startDraftSession()
+	m.replyBody.Focus()
+	return m
+}
+
+// handleForwardReady opens the compose form pre-filled with the forward
+func (m model) handleForwardReady(msg forwardReadyMsg) (tea.Model, tea.Cmd) {
+	if !m.screenRequest.current(msg.reqID) {
+		return m, nil
+	}
+	m.resetCompose()
+	m.composeFrom.SetValue("me")
+	m.composeSubj.SetValue(forwardSubject(msg.original.subject))
+	m.composeBody.SetValue(forwardBody(msg.original))
+	m.composeBody.CursorStart()
+	m.composeAttachments = msg.attachments
+	m.state = stateComposing
+	m.focused = 1
+	return m, m.focusComposeField()
+}
+
+// resetCompose clears the compose form, detaching it from any draft
+func (m *model) resetCompose() {
+	m.composeTo.Reset()
+	m.composeCc.Reset()
+	m.composeBcc.Reset()
+	m.composeSubj.Reset()
+	m.composeBody.Reset()
+	m.composeAttachments = []outgoingAttachment{}
+	m.startDraftSession()
+	m.composeThreadID = ""
+	m.composeInReplyTo = ""
+	m.composeReferences = ""
+	m.composeErr = ""
+	m.suggestions = nil
+	m.focused = 0
+}
+
+// startDraftSession detaches the compose or reply form from any draft.
+// Saves still in flight for the previous session no longer touch the form.
+func (m *model) startDraftSession() {
+	m.requestSeq++
+	m.draftSession = m.requestSeq
+	m.draftID = ""
+}
+
+// saveOrSendDraft saves the form's draft, or sends it when send is set.
+// Only one create runs per session: while the draft is being created the
+// latest save or send waits for its ID, so the form never makes two drafts
+// or sends one and leaves the other behind.
+func (m *model) saveOrSendDraft(email outgoingEmail, send bool) tea.Cmd {
+	return m.runDraftOp(draftOp{session: m.draftSession, email: email, send: send}, m.draftID)
+}
+
+func (m *model) runDraftOp(op draftOp, draftID string) tea.Cmd {
+	if _, creating := m.draftCreates[op.session]; creating {
+		m.draftCreates[op.session] = &op
+		if op.send {
+			return showNotification("Sending once the draft is saved")
+		}
+		return nil
+	}
+	switch {
+	case op.send && draftID != "":
+		return sendDraft(m.backend, draftID, op.email)
+	case op.send:
+		return sendEmail(m.backend, op.email)
+	case draftID == "":
+		m.draftCreates[op.session] = nil
+	}
+	return saveDraft(m.backend, op.session, draftID, op.email)
+}
+
+// handleDraftSaved gives the form that saved a draft its ID, then runs
+// whatever was waiting for the draft to be created
+func (m model) handleDraftSaved(msg draftSavedMsg) (tea.Model, tea.Cmd) {
+	var queued *draftOp
+	if msg.created {
+		queued = m.draftCreates[msg.session]
+		delete(m.draftCreates, msg.session)
+	}
+	if msg.err == nil && msg.session == m.draftSession {
+		m.draftID = msg.id
+	}
+
+	var next tea.Cmd
+	if queued != nil {
+		// After a failed create there is no draft, so this creates one
+		next = m.runDraftOp(*queued, msg.id)
+	}
+	if msg.err != nil {
+		return m, tea.Batch(m.notifyError(msg.err), next)
+	}
+	return m, tea.Batch(showNotification("Draft saved"), next)
+}
+
+// normalizeRecipients rewrites the address fields in canonical form, so
+// that a name typed as Doe, Jane <jane@x> is sent quoted
+func (m *model) normalizeRecipients() {
+	for _, field := range []*textinput.Model{&m.composeTo, &m.composeCc, &m.composeBcc} {
+		if formatted := formatRecipients(field.Value()); formatted != field.Value() {
+			field.SetValue(formatted)
+		}
+	}
+}
+
+// pendingCompose is the message the compose screen would send
+func (m model) pendingCompose() outgoingEmail {
+	return outgoingEmail{
+		to:          m.composeTo.Value(),
+		cc:          m.composeCc.Value(),
+		bcc:         m.composeBcc.Value(),
+		subject:     m.composeSubj.Value(),
+		body:        m.composeBody.Value(),
+		attachments: m.composeAttachments,
+		threadID:    m.composeThreadID,
+		inReplyTo:   m.composeInReplyTo,
+		references:  m.composeReferences,
+	}
+}
+
+// composeHasContent reports whether leaving the compose form would lose
+// anything worth keeping as a draft
+func (m model) composeHasContent() bool {
+	return m.composeTo.Value() != "" || m.composeCc.Value() != "" || m.composeBcc.Value() != "" ||
+		m.composeSubj.Value() != "" || m.composeBody.Value() != "" || len(m.composeAttachments) > 0
+}
+
+// pendingReply is the message the reply screen would send
+func (m model) pendingReply(body string) outgoingEmail {
+	if m.replyAll {
+		return newReplyAll(m.replyToMsg, m.ownAddresses, body, m.replyAttachments)
+	}
+	return newReply(m.replyToMsg, body, m.replyAttachments)
+}
+
+// attachmentChoice converts the key pressed while choosing an attachment
+// into its index, or -1
+func attachmentChoice(msg tea.KeyMsg, attachments []outgoingAttachment) int {
+	if msg.Type != tea.KeyRunes {
+		return -1
+	}
+	digit, err := strconv.Atoi(string(msg.Runes))
+	if err != nil || digit < 1 || digit > len(attachments) {
+		return -1
+	}
+	return digit - 1
+}
+
+// dropAttachment removes attachments[i] and reports it
+func dropAttachment(attachments []outgoingAttachment, i int) ([]outgoingAttachment, tea.Cmd) {
+	if i < 0 {
+		return attachments, nil
+	}
+	name := attachments[i].name
+	return append(attachments[:i:i], attachments[i+1:]...), showNotification(fmt.Sprintf("Removed: %s", name))
+}
+
 func updateComposing(msg tea.KeyMsg, m model) (tea.Model, tea.Cmd) {
+	if m.removingAttachment {
+		var cmd tea.Cmd
+		m.removingAttachment = false
+		m.composeAttachments, cmd = dropAttachment(m.composeAttachments, attachmentChoice(msg, m.composeAttachments))
+		return m, cmd
+	}
+
+	if len(m.suggestions) > 0 && !m.addingAttachment {
+		switch {
+		case msg.Type == tea.KeyEsc:
+			m.suggestions = nil
+			return m, nil
+		case msg.Type == tea.KeyDown:
+			m.suggestionIndex = (m.suggestionIndex + 1) % len(m.suggestions)
+			return m, nil
+		case msg.Type == tea.KeyUp:
+			m.suggestionIndex = (m.suggestionIndex - 1 + len(m.suggestions)) % len(m.suggestions)
+			return m, nil
+		case key.Matches(msg, keys.NextInput):
+			m.acceptSuggestion()
+			return m, nil
+		}
+	}
+
 	switch {
 	case key.Matches(msg, keys.Back):
 		if m.addingAttachment {
@@ -257,18 +1276,23 @@ func updateComposing(msg tea.KeyMsg, m model) (tea.Model, tea.Cmd) {
 			return m, m.focusComposeField()
 		}
 		m.state = stateInbox
+		m.suggestions = nil
+		if m.composeHasContent() {
+			return m, m.saveOrSendDraft(m.pendingCompose(), false)
+		}
 		return m, nil
 
+	case key.Matches(msg, keys.SaveDraft):
+		return m, m.saveOrSendDraft(m.pendingCompose(), false)
+
 	case key.Matches(msg, keys.Send):
-		return m, sendEmail(
-			m.srv,
-			m.composeTo.Value(),
-			m.composeCc.Value(),
-			m.composeBcc.Value(),
-			m.composeSubj.Value(),
-			m.composeBody.Value(),
-			m.composeAttachments,
-		)
+		m.normalizeRecipients()
+		if err := validateRecipients(m.composeTo.Value(), m.composeCc.Value(), m.composeBcc.Value()); err != nil {
+			m.composeErr = err.Error()
+			return m, nil
+		}
+		m.composeErr = ""
+		return m, m.saveOrSendDraft(m.pendingCompose(), true)
 
 	case key.Matches(msg, keys.AddAttachment):
 		if !m.addingAttachment {
@@ -278,22 +1302,30 @@ func updateComposing(msg tea.KeyMsg, m model) (tea.Model, tea.Cmd) {
 		return m, nil
 
 	case key.Matches(msg, keys.RemoveAttachment):
-		if !m.addingAttachment && len(m.composeAttachments) > 0 {
-			m.composeAttachments = m.composeAttachments[:len(m.composeAttachments)-1]
-			return m, showNotification("Removed last attachment")
+		if !m.addingAttachment && len(m.composeAttachments) == 1 {
+			var cmd tea.Cmd
+			m.composeAttachments, cmd = dropAttachment(m.composeAttachments, 0)
+			return m, cmd
 		}
+		// With several attachments, ask which one to drop
+		m.removingAttachment = !m.addingAttachment && len(m.composeAttachments) > 1
+		return m, nil
 
 	case msg.Type == tea.KeyEnter && m.addingAttachment:
 		return m.handleAttachmentAdd()
 
 	case key.Matches(msg, keys.NextInput):
 		if !m.addingAttachment {
+			m.normalizeRecipients()
+			m.suggestions = nil
 			m.focused = (m.focused + 1) % 6
 			return m, m.focusComposeField()
 		}
 
 	case key.Matches(msg, keys.PrevInput):
 		if !m.addingAttachment {
+			m.normalizeRecipients()
+			m.suggestions = nil
 			m.focused = (m.focused - 1 + 6) % 6
 			return m, m.focusComposeField()
 		}
@@ -309,7 +1341,7 @@ func (m model) handleAttachmentAdd() (tea.Model, tea.Cmd) {
 	}
 
 	if _, err := os.Stat(path); err == nil {
-		m.composeAttachments = append(m.composeAttachments, path)
+		m.composeAttachments = append(m.composeAttachments, fileAttachment(path))
 		m.addingAttachment = false
 		m.attachmentInput.Reset()
 		return m, tea.Batch(
@@ -323,6 +1355,7 @@ func (m model) handleAttachmentAdd() (tea.Model, tea.Cmd) {
 
 func (m model) updateComposeFields(msg tea.Msg) (tea.Model, tea.Cmd) {
 	var cmd tea.Cmd
+	m.composeErr = ""
 	if m.addingAttachment {
 		m.attachmentInput, cmd = m.attachmentInput.Update(msg)
 		return m, cmd
@@ -342,33 +1375,78 @@ func (m model) updateComposeFields(msg tea.Msg) (tea.Model, tea.Cmd) {
 	case 5:
 		m.composeBody, cmd = m.composeBody.Update(msg)
 	}
+	m.updateSuggestions()
 	return m, cmd
 }
 
+// recipientInput returns the focused address field, if one is focused
+func (m *model) recipientInput() *textinput.Model {
+	switch m.focused {
+	case 1:
+		return &m.composeTo
+	case 2:
+		return &m.composeCc
+	case 3:
+		return &m.composeBcc
+	}
+	return nil
+}
+
+// updateSuggestions completes the recipient being typed from the address
+// book. Entries already written out as Name <address> aren't completed.
+func (m *model) updateSuggestions() {
+	m.suggestions = nil
+	m.suggestionIndex = 0
+
+	input := m.recipientInput()
+	if input == nil {
+		return
+	}
+	if _, current := lastRecipient(input.Value()); !strings.Contains(current, "<") {
+		m.suggestions = m.contacts.Complete(current)
+	}
+}
+
+// acceptSuggestion replaces the recipient being typed with the chosen
+// contact, leaving the field ready for the next one
+func (m *model) acceptSuggestion() {
+	input := m.recipientInput()
+	if input == nil {
+		m.suggestions = nil
+		return
+	}
+
+	done, _ := lastRecipient(input.Value())
+	if done != "" {
+		done = strings.TrimRight(done, " ") + " "
+	}
+	input.SetValue(done + m.suggestions[m.suggestionIndex].String() + ", ")
+	input.CursorEnd()
+	m.suggestions = nil
+}
+
 func updateReplying(msg tea.KeyMsg, m model) (tea.Model, tea.Cmd) {
+	if m.removingAttachment {
+		var cmd tea.Cmd
+		m.removingAttachment = false
+		m.replyAttachments, cmd = dropAttachment(m.replyAttachments, attachmentChoice(msg, m.replyAttachments))
+		return m, cmd
+	}
+
 	switch {
 	case key.Matches(msg, keys.Back):
-		m.state = stateViewing
+		m.state = m.replyReturn
 		m.addingAttachment = false
+		if m.replyBody.Value() != "" || len(m.replyAttachments) > 0 {
+			return m, m.saveOrSendDraft(m.pendingReply(m.replyBody.Value()), false)
+		}
 		return m, nil
 
+	case key.Matches(msg, keys.SaveDraft):
+		return m, m.saveOrSendDraft(m.pendingReply(m.replyBody.Value()), false)
+
 	case key.Matches(msg, keys.Send):
-		quoted := fmt.Sprintf(
-			"\n\n--- Original Message ---\nFrom: %s\nDate: %s\n\n%s",
-			m.replyToMsg.from,
-			m.replyToMsg.date,
-			indentText(m.currentMsg.body),
-		)
-		fullBody := m.replyBody.Value() + quoted
-		return m, sendEmail(
-			m.srv,
-			m.replyToMsg.from,
-			"",
-			"",
-			"Re: "+m.replyToMsg.subject,
-			fullBody,
-			m.replyAttachments,
-		)
+		return m, m.saveOrSendDraft(m.pendingReply(m.replyBody.Value()), true)
 
 	case key.Matches(msg, keys.AddAttachment):
 		m.addingAttachment = true
@@ -376,16 +1454,19 @@ func updateReplying(msg tea.KeyMsg, m model) (tea.Model, tea.Cmd) {
 		return m, nil
 
 	case key.Matches(msg, keys.RemoveAttachment):
-		if len(m.replyAttachments) > 0 {
-			m.replyAttachments = m.replyAttachments[:len(m.replyAttachments)-1]
+		if len(m.replyAttachments) == 1 {
+			var cmd tea.Cmd
+			m.replyAttachments, cmd = dropAttachment(m.replyAttachments, 0)
+			return m, cmd
 		}
+		m.removingAttachment = len(m.replyAttachments) > 1
 		return m, nil
 
 	case msg.Type == tea.KeyEnter && m.addingAttachment:
 		path := strings.TrimSpace(m.attachmentInput.Value())
 		if path != "" {
 			if _, err := os.Stat(path); err == nil {
-				m.replyAttachments = append(m.replyAttachments, path)
+				m.replyAttachments = append(m.replyAttachments, fileAttachment(path))
 				m.addingAttachment = false
 				m.attachmentInput.Reset()
 			}
@@ -411,7 +1492,10 @@ func updateSearching(msg tea.KeyMsg, m model) (tea.Model, tea.Cmd) {
 	case msg.Type == tea.KeyEnter:
 		m.state = stateLoading
 		m.searchQuery = m.searchInput.Value()
-		return m, tea.Batch(m.loading.Tick, performSearch(m.srv, m.searchQuery))
+		m.loadingMore = false
+		m.listLoading = true
+		ctx := m.startRequest(&m.listRequest)
+		return m, tea.Batch(m.loading.Tick, performSearch(ctx, m.backend, m.searchQuery))
 	}
 
 	var cmd tea.Cmd
@@ -420,15 +1504,55 @@ func updateSearching(msg tea.KeyMsg, m model) (tea.Model, tea.Cmd) {
 }
 
 func updateLabelManagement(msg tea.KeyMsg, m model) (tea.Model, tea.Cmd) {
+	if m.editingLabel {
+		return updateLabelForm(msg, m)
+	}
+	if m.deletingLabel != nil {
+		label := m.deletingLabel
+		m.deletingLabel = nil
+		if msg.String() == "y" {
+			return m, deleteLabel(m.backend, label)
+		}
+		return m, nil
+	}
+
+	filtering := m.labelsList.FilterState() == list.Filtering
+	selected, hasSelection := m.labelsList.SelectedItem().(labelItem)
+
 	switch {
-	case key.Matches(msg, keys.Back):
+	case key.Matches(msg, keys.Back) && !filtering:
 		m.state = stateInbox
 		return m, nil
 
+	case key.Matches(msg, keys.NewLabel) && !filtering:
+		parent := ""
+		if hasSelection && isUserLabel(selected.label) {
+			// New labels start out next to the selected one
+			parent, _ = splitLabelName(selected.label.Name)
+		}
+		return m, m.startLabelForm(nil, parent)
+
+	case key.Matches(msg, keys.EditLabel) && !filtering && hasSelection:
+		if !isUserLabel(selected.label) {
+			return m, showNotification("System labels can't be changed")
+		}
+		parent, _ := splitLabelName(selected.label.Name)
+		return m, m.startLabelForm(selected.label, parent)
+
+	case key.Matches(msg, keys.Delete) && !filtering && hasSelection:
+		if !isUserLabel(selected.label) {
+			return m, showNotification("System labels can't be deleted")
+		}
+		m.deletingLabel = selected.label
+		return m, nil
+
 	case key.Matches(msg, keys.Select):
 		if selected, ok := m.labelsList.SelectedItem().(labelItem); ok {
 			m.state = stateLoading
-			return m, tea.Batch(m.loading.Tick, loadEmailsByLabel(m.srv, selected.label.Id))
+			m.loadingMore = false
+			m.listLoading = true
+			ctx := m.startRequest(&m.listRequest)
+			return m, tea.Batch(m.loading.Tick, loadEmailsByLabel(ctx, m.backend, selected.label.Id))
 		}
 	}
 
@@ -436,3 +1560,370 @@ func updateLabelManagement(msg tea.KeyMsg, m model) (tea.Model, tea.Cmd) {
 	m.labelsList, cmd = m.labelsList.Update(msg)
 	return m, cmd
 }
+
+// startLabelForm opens the label form to edit label, or to create a new
+// label under parent when label is nil
+func (m *model) startLabelForm(label *gmail.Label, parent string) tea.Cmd {
+	m.editingLabel = true
+	m.labelErr = ""
+	m.labelFocus = 0
+	m.labelParentInput.SetValue(parent)
+	if label == nil {
+		m.labelEditID = ""
+		m.labelNameInput.SetValue("")
+		m.labelColor = -1
+	} else {
+		_, leaf := splitLabelName(label.Name)
+		m.labelEditID = label.Id
+		m.labelNameInput.SetValue(leaf)
+		m.labelColor = paletteIndex(label.Color)
+	}
+	m.labelParentInput.Blur()
+	return m.labelNameInput.Focus()
+}
+
+// updateLabelForm handles the name, parent and color fields of the label
+// form. Left and right cycle through the palette on the color field.
+func updateLabelForm(msg tea.KeyMsg, m model) (tea.Model, tea.Cmd) {
+	switch {
+	case msg.Type == tea.KeyEsc:
+		m.editingLabel = false
+		return m, nil
+
+	case key.Matches(msg, keys.NextInput), key.Matches(msg, keys.PrevInput):
+		step := 1
+		if key.Matches(msg, keys.PrevInput) {
+			step = 2
+		}
+		m.labelFocus = (m.labelFocus + step) % 3
+		m.labelNameInput.Blur()
+		m.labelParentInput.Blur()
+		switch m.labelFocus {
+		case 0:
+			return m, m.labelNameInput.Focus()
+		case 1:
+			return m, m.labelParentInput.Focus()
+		}
+		return m, nil
+
+	case msg.Type == tea.KeyEnter:
+		name, err := joinLabelName(m.labelParentInput.Value(), m.labelNameInput.Value())
+		if err != nil {
+			m.labelErr = err.Error()
+			return m, nil
+		}
+		var color *gmail.LabelColor
+		if m.labelColor >= 0 {
+			color = &labelPalette[m.labelColor].color
+		}
+		m.editingLabel = false
+		return m, saveLabel(m.backend, m.labels, m.labelEditID, name, color)
+	}
+
+	var cmd tea.Cmd
+	m.labelErr = ""
+	switch m.labelFocus {
+	case 0:
+		m.labelNameInput, cmd = m.labelNameInput.Update(msg)
+	case 1:
+		m.labelParentInput, cmd = m.labelParentInput.Update(msg)
+	case 2:
+		switch msg.Type {
+		case tea.KeyRight:
+			m.labelColor = (m.labelColor+2)%(len(labelPalette)+1) - 1
+		case tea.KeyLeft:
+			m.labelColor = (m.labelColor+len(labelPalette)+1)%(len(labelPalette)+1) - 1
+		}
+	}
+	return m, cmd
+}
+
+// openLabelPicker lists the user labels with the ones every message in
+// items already has ticked
+func (m model) openLabelPicker(items []emailItem) (tea.Model, tea.Cmd) {
+	var choices []list.Item
+	for _, label := range sortLabels(m.labels) {
+		if !isUserLabel(label) {
+			continue
+		}
+		all := true
+		for _, item := range items {
+			if !containsString(item.labels, label.Id) {
+				all = false
+				break
+			}
+		}
+		choices = append(choices, labelChoice{label: label, checked: all, initial: all})
+	}
+	if len(choices) == 0 {
+		return m, showNotification("No labels yet; create one from the labels screen [l]")
+	}
+
+	m.showLabelPicker(choices, items, "Apply Labels")
+	m.pickerMove = false
+	return m, nil
+}
+
+// openMovePicker lists the user labels to move items to: the chosen label
+// is added and the messages leave the inbox
+func (m model) openMovePicker(items []emailItem) (tea.Model, tea.Cmd) {
+	var choices []list.Item
+	for _, label := range sortLabels(m.labels) {
+		if isUserLabel(label) && label.Name != mutedLabelName {
+			choices = append(choices, labelChoice{label: label, single: true})
+		}
+	}
+	if len(choices) == 0 {
+		return m, showNotification("No labels yet; create one from the labels screen [l]")
+	}
+
+	m.showLabelPicker(choices, items, "Move To")
+	m.pickerMove = true
+	return m, nil
+}
+
+func (m *model) showLabelPicker(choices []list.Item, items []emailItem, title string) {
+	m.pickerTargets = nil
+	for _, item := range items {
+		m.pickerTargets = append(m.pickerTargets, item.id)
+	}
+	m.labelPicker.Title = title
+	m.labelPicker.SetItems(choices)
+	m.labelPicker.ResetSelected()
+	m.labelPicker.ResetFilter()
+	m.labelPicker.SetSize(m.width, m.height-4)
+	m.pickerReturn = m.state
+	m.state = stateApplyingLabels
+}
+
+func updateLabelPicker(msg tea.KeyMsg, m model) (tea.Model, tea.Cmd) {
+	filtering := m.labelPicker.FilterState() == list.Filtering
+
+	switch {
+	case key.Matches(msg, keys.Back) && !filtering:
+		m.state = m.pickerReturn
+		return m, nil
+
+	case key.Matches(msg, keys.Select) && !filtering && m.pickerMove:
+		m.state = m.pickerReturn
+		choice, ok := m.labelPicker.SelectedItem().(labelChoice)
+		if !ok {
+			return m, nil
+		}
+		add, remove := []string{choice.label.Id}, []string{"INBOX"}
+		if len(m.pickerTargets) == 1 {
+			cmd := modifyMessage(m.backend, m.pickerTargets[0], add, remove, "Moved to "+choice.label.Name)
+			return m, m.optimistic(cmd, m.pickerTargets, add, remove)
+		}
+		return m.startBulk(&bulkOp{verb: "Moved", detail: " to " + choice.label.Name, ids: m.pickerTargets, add: add, remove: remove})
+
+	case key.Matches(msg, keys.ToggleLabel) && !filtering && !m.pickerMove:
+		if choice, ok := m.labelPicker.SelectedItem().(labelChoice); ok {
+			choice.checked = !choice.checked
+			return m, m.labelPicker.SetItem(m.labelPicker.GlobalIndex(), choice)
+		}
+		return m, nil
+
+	case key.Matches(msg, keys.Select) && !filtering:
+		var add, remove []string
+		for _, item := range m.labelPicker.Items() {
+			choice := item.(labelChoice)
+			switch {
+			case choice.checked && !choice.initial:
+				add = append(add, choice.label.Id)
+			case !choice.checked && choice.initial:
+				remove = append(remove, choice.label.Id)
+			}
+		}
+		m.state = m.pickerReturn
+		if len(add) == 0 && len(remove) == 0 {
+			return m, nil
+		}
+		if len(m.pickerTargets) > 1 {
+			return m.startBulk(&bulkOp{verb: "Labeled", ids: m.pickerTargets, add: add, remove: remove})
+		}
+		return m, m.optimistic(applyLabels(m.backend, m.pickerTargets, add, remove), m.pickerTargets, add, remove)
+	}
+
+	var cmd tea.Cmd
+	m.labelPicker, cmd = m.labelPicker.Update(msg)
+	return m, cmd
+}
+
+func (m model) handleDraftsLoaded(msg draftsLoadedMsg) (tea.Model, tea.Cmd) {
+	if !m.screenRequest.current(msg.reqID) {
+		return m, nil
+	}
+	items := make([]list.Item, len(msg.drafts))
+	for i, draft := range msg.drafts {
+		items[i] = draft
+	}
+	m.draftsList.SetItems(items)
+	m.draftsList.SetSize(m.width, m.height-4)
+	m.state = stateDrafts
+	return m, nil
+}
+
+// handleDraftReady loads a reopened draft into the compose form. Replies
+// keep their threading so they still land in the original conversation.
+func (m model) handleDraftReady(msg draftReadyMsg) (tea.Model, tea.Cmd) {
+	if !m.screenRequest.current(msg.reqID) {
+		return m, nil
+	}
+	m.resetCompose()
+	m.composeFrom.SetValue("me")
+	m.composeTo.SetValue(msg.email.to)
+	m.composeCc.SetValue(msg.email.cc)
+	m.composeBcc.SetValue(msg.email.bcc)
+	m.composeSubj.SetValue(msg.email.subject)
+	m.composeBody.SetValue(msg.email.body)
+	if msg.email.attachments != nil {
+		m.composeAttachments = msg.email.attachments
+	}
+	m.draftID = msg.id
+	m.composeThreadID = msg.email.threadID
+	m.composeInReplyTo = msg.email.inReplyTo
+	m.composeReferences = msg.email.references
+	m.state = stateComposing
+	m.focused = 5
+	return m, m.focusComposeField()
+}
+
+func updateDrafts(msg tea.KeyMsg, m model) (tea.Model, tea.Cmd) {
+	filtering := m.draftsList.FilterState() == list.Filtering
+
+	switch {
+	case key.Matches(msg, keys.Back) && !filtering:
+		m.state = stateInbox
+		return m, nil
+
+	case key.Matches(msg, keys.Select) && !filtering:
+		if selected, ok := m.draftsList.SelectedItem().(draftItem); ok {
+			m.state = stateLoading
+			ctx := m.startRequest(&m.screenRequest)
+			return m, tea.Batch(m.loading.Tick, openDraft(ctx, m.backend, selected.id))
+		}
+
+	case key.Matches(msg, keys.Delete) && !filtering:
+		if selected, ok := m.draftsList.SelectedItem().(draftItem); ok {
+			return m, deleteDraft(m.backend, selected.id)
+		}
+
+	case key.Matches(msg, keys.Quit) && !filtering:
+		return m, tea.Quit
+	}
+
+	var cmd tea.Cmd
+	m.draftsList, cmd = m.draftsList.Update(msg)
+	return m, cmd
+}
+
+// refreshContacts reloads the contacts list from the address book
+func (m *model) refreshContacts() {
+	ranked := m.contacts.Contacts()
+	items := make([]list.Item, len(ranked))
+	for i, c := range ranked {
+		items[i] = contactItem{contact: c}
+	}
+	m.contactsList.SetItems(items)
+}
+
+func updateContacts(msg tea.KeyMsg, m model) (tea.Model, tea.Cmd) {
+	if m.editingContact != "" {
+		return updateContactEdit(msg, m)
+	}
+	filtering := m.contactsList.FilterState() == list.Filtering
+	selected, hasSelection := m.contactsList.SelectedItem().(contactItem)
+
+	switch {
+	case key.Matches(msg, keys.Back) && !filtering:
+		if m.mergeFrom != "" {
+			m.mergeFrom = ""
+			return m, nil
+		}
+		m.state = stateInbox
+		return m, nil
+
+	case key.Matches(msg, keys.EditContact) && !filtering && hasSelection:
+		m.editingContact = selected.contact.Address
+		m.contactErr = ""
+		m.contactName.SetValue(selected.contact.Name)
+		m.contactAddress.SetValue(selected.contact.Address)
+		m.contactAddress.Blur()
+		return m, m.contactName.Focus()
+
+	case key.Matches(msg, keys.MergeContact) && !filtering && hasSelection:
+		if m.mergeFrom == "" {
+			m.mergeFrom = selected.contact.Address
+			return m, nil
+		}
+		from := m.mergeFrom
+		m.mergeFrom = ""
+		if err := m.contacts.Merge(from, selected.contact.Address); err != nil {
+			return m, showNotification(err.Error())
+		}
+		m.refreshContacts()
+		return m, tea.Batch(saveContacts(m.contacts), showNotification(fmt.Sprintf("Merged %s into %s", from, selected.contact.Address)))
+
+	case key.Matches(msg, keys.Delete) && !filtering && hasSelection:
+		m.contacts.Delete(selected.contact.Address)
+		m.refreshContacts()
+		return m, saveContacts(m.contacts)
+
+	case key.Matches(msg, keys.Quit) && !filtering:
+		return m, tea.Quit
+	}
+
+	var cmd tea.Cmd
+	m.contactsList, cmd = m.contactsList.Update(msg)
+	return m, cmd
+}
+
+// updateContactEdit handles the name and address form of the contacts
+// screen. Giving a contact the address of another one merges them.
+func updateContactEdit(msg tea.KeyMsg, m model) (tea.Model, tea.Cmd) {
+	var cmd tea.Cmd
+
+	switch msg.Type {
+	case tea.KeyEsc:
+		m.editingContact = ""
+		return m, nil
+
+	case tea.KeyTab, tea.KeyShiftTab:
+		if m.contactName.Focused() {
+			m.contactName.Blur()
+			return m, m.contactAddress.Focus()
+		}
+		m.contactAddress.Blur()
+		return m, m.contactName.Focus()
+
+	case tea.KeyEnter:
+		name := strings.TrimSpace(m.contactName.Value())
+		address := strings.TrimSpace(m.contactAddress.Value())
+		if err := m.contacts.Update(m.editingContact, name, address); err != nil {
+			m.contactErr = err.Error()
+			return m, nil
+		}
+		m.editingContact = ""
+		m.refreshContacts()
+		return m, saveContacts(m.contacts)
+	}
+
+	m.contactErr = ""
+	if m.contactName.Focused() {
+		m.contactName, cmd = m.contactName.Update(msg)
+	} else {
+		m.contactAddress, cmd = m.contactAddress.Update(msg)
+	}
+	return m, cmd
+}
+
+// draftIndex returns the position of the draft with the given ID, or -1
+func draftIndex(items []list.Item, id string) int {
+	for i, item := range items {
+		if draft, ok := item.(draftItem); ok && draft.id == id {
+			return i
+		}
+	}
+	return -1
+}
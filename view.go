@@ -2,9 +2,9 @@ package main
 
 import (
 	"fmt"
-	"path/filepath"
 	"strings"
 
+	"github.com/charmbracelet/bubbles/textinput"
 	"github.com/charmbracelet/lipgloss"
 )
 
@@ -12,7 +12,10 @@ func (m model) View() string {
 	if m.showHelp {
 		return m.help.View(keys)
 	}
+	return m.screenView() + m.statusBar()
+}
 
+func (m model) screenView() string {
 	switch m.state {
 	case stateInbox:
 		return m.inboxView()
@@ -28,13 +31,52 @@ func (m model) View() string {
 		return m.searchView()
 	case stateManagingLabels:
 		return m.labelsView()
+	case stateConversation:
+		return m.conversationView()
+	case stateDrafts:
+		return m.draftsView()
+	case stateContacts:
+		return m.contactsView()
+	case stateApplyingLabels:
+		return m.labelPickerView()
+	case stateLog:
+		return m.logView()
 	}
 	return ""
 }
 
 func (m model) inboxView() string {
-	help := "\n[c] compose • [r] reply • [d] delete • [m] mark read/unread • [l] labels • [/] search • [?] help • [q] quit\n"
-	return m.list.View() + help
+	help := "\n[c] compose • [r] reply • [d] delete • [m] mark read/unread • [e] archive • [s] star • [l] labels • [L] apply labels • [D] drafts • [C] contacts • [/] search • [t] threads • [u] undo • [E] log • [?] help • [q] quit\n"
+	switch {
+	case m.deleteTargets != nil:
+		help = fmt.Sprintf("\nPermanently delete %s? This can't be undone. [y/n]\n", pluralize(len(m.deleteTargets), "message"))
+	case len(m.selected) > 0:
+		help = "\n[space] select • [V] select range • [*] select all • [d] trash • [e] archive • [m] read/unread • [L] label • [v] move • [X] delete forever • [u] undo • [esc] clear selection\n"
+	}
+	return m.activeList().View() + "\n" + m.listStatus() + help
+}
+
+// listStatus reports how much of the current listing has been loaded
+func (m model) listStatus() string {
+	status := fmt.Sprintf("  %d of ~%d", len(m.list.Items()), max(m.resultEstimate, int64(len(m.list.Items()))))
+	switch {
+	case m.fetch != nil:
+		status += fmt.Sprintf(" • fetching %d/%d", m.fetch.fetched, m.fetch.total)
+	case m.loadingMore:
+		status += " • loading more..."
+	case m.nextPageToken != "":
+		status += " • [n] load more"
+	}
+	if len(m.selected) > 0 {
+		status += fmt.Sprintf(" • %d selected", len(m.selected))
+	}
+	if m.bulk != nil {
+		status += fmt.Sprintf(" • %s %d/%d", m.bulk.verb, m.bulk.done+m.bulk.failed, len(m.bulk.ids))
+	}
+	if m.offline {
+		status += " • offline (read-only)"
+	}
+	return status
 }
 
 func (m model) emailView() string {
@@ -51,7 +93,11 @@ func (m model) emailView() string {
 	}
 
 	b.WriteString(fmt.Sprintf("Subject: %s\n", m.currentMsg.subject))
-	b.WriteString(fmt.Sprintf("Date: %s\n\n", m.currentMsg.date))
+	b.WriteString(fmt.Sprintf("Date: %s\n", m.currentMsg.date))
+	if names := m.userLabelNames(m.currentMsg.labels); len(names) > 0 {
+		b.WriteString(fmt.Sprintf("Labels: %s\n", strings.Join(names, ", ")))
+	}
+	b.WriteString("\n")
 	b.WriteString(m.viewport.View() + "\n\n")
 
 	if m.attachmentDownloading {
@@ -69,18 +115,73 @@ func (m model) emailView() string {
 		b.WriteString("\n")
 	}
 
-	b.WriteString("\n[b] back • [r] reply • [d] delete • [m] mark read/unread • [ctrl+d] download attachment • [q] quit\n")
+	b.WriteString("\n[b] back • [r] reply • [A] reply all • [f] forward • [d] delete • [m] mark read/unread • [e] archive • [s] star • [+] important • [!] spam • [M] mute • [L] apply labels • [u] undo • [E] log • [ctrl+d] download attachment • [q] quit\n")
 	return b.String()
 }
 
+func (m model) conversationView() string {
+	var b strings.Builder
+
+	b.WriteString(fmt.Sprintf("\n  %s (%d messages)\n\n", m.conversation[0].subject, len(m.conversation)))
+	b.WriteString(m.viewport.View() + "\n")
+	b.WriteString("\n[n/p] next/prev message • [enter] expand/collapse • [r] reply • [A] reply all • [f] forward • [E] log • [b] back • [q] quit\n")
+	return b.String()
+}
+
+// renderConversation lays out the thread into the viewport, recording the
+// line each message starts on so n/p can scroll to it
+func (m *model) renderConversation() {
+	selected := lipgloss.NewStyle().Foreground(lipgloss.Color("62")).Bold(true)
+
+	var b strings.Builder
+	m.convOffsets = make([]int, len(m.conversation))
+	line := 0
+	for i, msg := range m.conversation {
+		m.convOffsets[i] = line
+
+		marker := "▸"
+		if m.convExpanded[i] {
+			marker = "▾"
+		}
+		header := fmt.Sprintf("%s %s · %s", marker, senderName(msg.from), msg.date)
+		if i == m.convIndex {
+			header = selected.Render(header)
+		}
+
+		var entry strings.Builder
+		entry.WriteString(header + "\n")
+		if m.convExpanded[i] {
+			entry.WriteString(fmt.Sprintf("  From: %s\n  To: %s\n", msg.from, msg.recipient))
+			if msg.cc != "" {
+				entry.WriteString(fmt.Sprintf("  CC: %s\n", msg.cc))
+			}
+			entry.WriteString("\n" + msg.body + "\n")
+			for j, att := range msg.attachments {
+				entry.WriteString(fmt.Sprintf("  [%d] %s (%s)\n", j+1, att.Filename, humanSize(att.Body.Size)))
+			}
+		} else {
+			entry.WriteString("  " + msg.snippet + "\n")
+		}
+		entry.WriteString("\n")
+
+		b.WriteString(entry.String())
+		line += strings.Count(entry.String(), "\n")
+	}
+	m.viewport.SetContent(b.String())
+}
+
 func (m model) loadingView() string {
+	text := "Loading..."
+	if m.listLoading && m.fetch != nil {
+		text = fmt.Sprintf("Fetching messages %d/%d...", m.fetch.fetched, m.fetch.total)
+	}
 	return lipgloss.Place(
 		m.width, m.height,
 		lipgloss.Center, lipgloss.Center,
 		lipgloss.JoinVertical(
 			lipgloss.Center,
 			m.loading.View(),
-			"Loading...",
+			text,
 		),
 	)
 }
@@ -88,48 +189,127 @@ func (m model) loadingView() string {
 func (m model) composeView() string {
 	var b strings.Builder
 
-	b.WriteString("\n  Compose New Email\n\n")
+	if m.draftID != "" {
+		b.WriteString("\n  Edit Draft\n\n")
+	} else {
+		b.WriteString("\n  Compose New Email\n\n")
+	}
 	b.WriteString(fmt.Sprintf("  From: %s\n", m.composeFrom.View()))
-	b.WriteString(fmt.Sprintf("  To:   %s\n", m.composeTo.View()))
-	b.WriteString(fmt.Sprintf("  CC:   %s\n", m.composeCc.View()))
-	b.WriteString(fmt.Sprintf("  BCC:  %s\n", m.composeBcc.View()))
+	b.WriteString(fmt.Sprintf("  To:   %s\n", m.addressField(1, m.composeTo)))
+	b.WriteString(fmt.Sprintf("  CC:   %s\n", m.addressField(2, m.composeCc)))
+	b.WriteString(fmt.Sprintf("  BCC:  %s\n", m.addressField(3, m.composeBcc)))
 	b.WriteString(fmt.Sprintf("  Subj: %s\n\n", m.composeSubj.View()))
 	b.WriteString("  Body:\n" + m.composeBody.View() + "\n")
 
-	if len(m.composeAttachments) > 0 {
-		b.WriteString("\nAttachments:\n")
-		for i, f := range m.composeAttachments {
-			b.WriteString(fmt.Sprintf("  [%d] %s\n", i+1, filepath.Base(f)))
-		}
-	}
+	b.WriteString(attachmentList(m.composeAttachments, m.removingAttachment))
 
 	if m.addingAttachment {
 		b.WriteString("\nAttachment Path: " + m.attachmentInput.View())
 	}
 
-	b.WriteString("\n[ctrl+s] send • [ctrl+a] add attachment • [ctrl+x] remove attachment • [esc] back")
+	if m.composeErr != "" {
+		b.WriteString("\n" + errorStyle.Render("  Can't send: "+m.composeErr) + "\n")
+	}
+
+	b.WriteString("\n[ctrl+s] send • [ctrl+o] save draft • [ctrl+a] add attachment • [ctrl+x] remove attachment • [esc] save & back")
+	return b.String()
+}
+
+// addressField shows the input while it is being edited and the parsed
+// recipients as chips otherwise, flagging any entry that isn't an address
+func (m model) addressField(index int, input textinput.Model) string {
+	if m.focused == index {
+		return input.View() + m.suggestionsView()
+	}
+	if strings.TrimSpace(input.Value()) == "" {
+		return input.View()
+	}
+
+	var chips []string
+	var problem error
+	for _, r := range parseRecipients(input.Value()) {
+		if r.err != nil {
+			chips = append(chips, invalidChipStyle.Render(r.raw))
+			if problem == nil {
+				problem = r.err
+			}
+			continue
+		}
+		label := r.addr.Name
+		if label == "" {
+			label = r.addr.Address
+		}
+		chips = append(chips, chipStyle.Render(label))
+	}
+
+	field := strings.Join(chips, " ")
+	if problem != nil {
+		field += "\n        " + errorStyle.Render(problem.Error())
+	}
+	return field
+}
+
+// suggestionsView lists the address book matches for the recipient being
+// typed, highlighting the one tab would insert
+func (m model) suggestionsView() string {
+	var b strings.Builder
+	for i, c := range m.suggestions {
+		if i == m.suggestionIndex {
+			b.WriteString("\n        " + chipStyle.Render(c.String()))
+		} else {
+			b.WriteString("\n        " + c.String())
+		}
+	}
 	return b.String()
 }
 
 func (m model) replyView() string {
 	var b strings.Builder
 
-	b.WriteString(fmt.Sprintf("\n  Reply to: %s\n", m.replyToMsg.from))
-	b.WriteString(fmt.Sprintf("  Subject: Re: %s\n\n", m.replyToMsg.subject))
+	reply := m.pendingReply("")
+	b.WriteString(fmt.Sprintf("\n  Reply to: %s\n", reply.to))
+	if reply.cc != "" {
+		b.WriteString(fmt.Sprintf("  CC: %s\n", reply.cc))
+	}
+	b.WriteString(fmt.Sprintf("  Subject: %s\n\n", reply.subject))
 	b.WriteString(m.replyBody.View() + "\n")
 
-	if len(m.replyAttachments) > 0 {
-		b.WriteString("\nAttachments:\n")
-		for i, f := range m.replyAttachments {
-			b.WriteString(fmt.Sprintf("  [%d] %s\n", i+1, filepath.Base(f)))
-		}
-	}
+	b.WriteString(attachmentList(m.replyAttachments, m.removingAttachment))
 
 	if m.addingAttachment {
 		b.WriteString("\nAttachment Path: " + m.attachmentInput.View())
 	}
 
-	b.WriteString("\n[ctrl+s] send • [ctrl+a] add attachment • [ctrl+x] remove attachment • [esc] back")
+	b.WriteString("\n[ctrl+s] send • [ctrl+o] save draft • [ctrl+a] add attachment • [ctrl+x] remove attachment • [esc] save & back")
+	return b.String()
+}
+
+var (
+	chipStyle        = lipgloss.NewStyle().Foreground(lipgloss.Color("230")).Background(lipgloss.Color("62")).Padding(0, 1)
+	invalidChipStyle = chipStyle.Copy().Background(lipgloss.Color("160"))
+	errorStyle       = lipgloss.NewStyle().Foreground(lipgloss.Color("160"))
+)
+
+// attachmentList renders outgoing attachments, with the removal prompt
+// when one is being chosen
+func attachmentList(attachments []outgoingAttachment, removing bool) string {
+	if len(attachments) == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	if removing {
+		b.WriteString("\nRemove which attachment? (1-9) [esc] cancel\n")
+	} else {
+		b.WriteString("\nAttachments:\n")
+	}
+	for i, att := range attachments {
+		size := ""
+		if att.data != nil {
+			size = fmt.Sprintf(" (%s)", humanSize(int64(len(att.data))))
+		}
+		b.WriteString(fmt.Sprintf("  [%d] %s%s\n", i+1, att.name, size))
+	}
 	return b.String()
 }
 
@@ -137,11 +317,81 @@ func (m model) searchView() string {
 	return "\n  Search: " + m.searchInput.View() + "\n\n[enter] search • [esc] cancel\n"
 }
 
+func (m model) draftsView() string {
+	help := "\n[enter] open • [d] discard • [b] back\n"
+	return m.draftsList.View() + help
+}
+
+func (m model) contactsView() string {
+	if m.editingContact != "" {
+		var b strings.Builder
+		b.WriteString("\n  Edit Contact\n\n")
+		b.WriteString(fmt.Sprintf("  Name:    %s\n", m.contactName.View()))
+		b.WriteString(fmt.Sprintf("  Address: %s\n", m.contactAddress.View()))
+		if m.contactErr != "" {
+			b.WriteString("\n" + errorStyle.Render("  "+m.contactErr) + "\n")
+		}
+		b.WriteString("\n[tab] next field • [enter] save • [esc] cancel")
+		return b.String()
+	}
+
+	help := "\n[e] edit • [m] merge • [d] delete • [/] filter • [b] back\n"
+	if m.mergeFrom != "" {
+		help = fmt.Sprintf("\nMerging %s: select the contact to keep and press [m] • [esc] cancel\n", m.mergeFrom)
+	}
+	return m.contactsList.View() + help
+}
+
+// userLabelNames returns the names of the user labels among labelIDs
+func (m model) userLabelNames(labelIDs []string) []string {
+	var names []string
+	for _, label := range sortLabels(m.labels) {
+		if isUserLabel(label) && containsString(labelIDs, label.Id) {
+			names = append(names, label.Name)
+		}
+	}
+	return names
+}
+
 func (m model) labelsView() string {
-	help := "\n[↑/↓] navigate • [enter] select • [b] back\n"
+	if m.editingLabel {
+		var b strings.Builder
+		if m.labelEditID == "" {
+			b.WriteString("\n  New Label\n\n")
+		} else {
+			b.WriteString("\n  Edit Label\n\n")
+		}
+		b.WriteString(fmt.Sprintf("  Name:   %s\n", m.labelNameInput.View()))
+		b.WriteString(fmt.Sprintf("  Parent: %s\n", m.labelParentInput.View()))
+
+		color := paletteName(m.labelColor)
+		if m.labelColor >= 0 {
+			color = labelSwatch(&labelPalette[m.labelColor].color) + " " + color
+		}
+		if m.labelFocus == 2 {
+			color = "< " + color + " >"
+		}
+		b.WriteString(fmt.Sprintf("  Color:  %s\n", color))
+
+		if m.labelErr != "" {
+			b.WriteString("\n" + errorStyle.Render("  "+m.labelErr) + "\n")
+		}
+		b.WriteString("\n[tab] next field • [←/→] color • [enter] save • [esc] cancel")
+		return b.String()
+	}
+
+	help := "\n[↑/↓] navigate • [enter] open • [n] new • [e] edit • [d] delete • [b] back\n"
+	if m.deletingLabel != nil {
+		help = fmt.Sprintf("\nDelete label %q? It is removed from every message. [y/n]\n", m.deletingLabel.Name)
+	}
 	return m.labelsList.View() + help
 }
 
+func (m model) labelPickerView() string {
+	help := "\n[space] toggle • [enter] apply • [/] filter • [esc] cancel\n"
+	return m.labelPicker.View() + help
+}
+
 func humanSize(bytes int64) string {
 	const unit = 1024
 	if bytes < unit {